@@ -0,0 +1,141 @@
+package catalog
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// AdminConfig configures the admin HTTP handler.
+type AdminConfig struct {
+	// ReadyMaxAge is how long ago both sides must have been fetched
+	// successfully for /readyz to succeed.
+	ReadyMaxAge time.Duration
+	// Pprof serves the runtime profiles under /debug/pprof/.
+	Pprof bool
+	// Control enables the /admin/ endpoints, which require Token as bearer
+	// token. Without a Token they are disabled.
+	Control *Control
+	Token   string
+}
+
+// adminState is the response of the /admin/ endpoints.
+type adminState struct {
+	Paused map[string]bool `json:"paused"`
+}
+
+// NewAdminHandler serves the state of status:
+//
+//	/healthz  200 as long as the process serves requests
+//	/readyz   200 once both sides were fetched within ReadyMaxAge, 503 before,
+//	          with the role, leader or standby, in the body
+//	/status   the Report of status as JSON
+//
+// and, with a Control and Token, accepts POST requests to
+//
+//	/admin/pause?direction=     pause to-aws, to-eureka or both directions
+//	/admin/resume?direction=    resume to-aws, to-eureka or both directions
+//	/admin/fetch                fetch both sides now
+//	/admin/reconcile?service=   sync service, or all services, to AWS now
+func NewAdminHandler(status *Status, c AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		role := status.Role()
+		if !status.Ready(c.ReadyMaxAge) {
+			http.Error(w, "not ready\nrole: "+role, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\nrole: " + role + "\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		report := struct {
+			Report
+			Paused map[string]bool `json:"paused,omitempty"`
+		}{Report: status.Report()}
+		if c.Control != nil {
+			report.Paused = c.Control.PausedDirections()
+		}
+		enc.Encode(report)
+	})
+	if c.Control != nil && len(c.Token) > 0 {
+		mux.Handle("/admin/", adminControl(status, c.Control, c.Token))
+	}
+	if c.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// adminControl serves the /admin/ endpoints of NewAdminHandler.
+func adminControl(status *Status, control *Control, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		directions := []string{DirectionToAWS, DirectionToEureka}
+		if d := r.URL.Query().Get("direction"); len(d) > 0 {
+			directions = []string{d}
+		}
+		var err error
+		switch r.URL.Path {
+		case "/admin/pause":
+			for _, d := range directions {
+				if err = control.Pause(d); err != nil {
+					break
+				}
+			}
+		case "/admin/resume":
+			for _, d := range directions {
+				if err = control.Resume(d); err != nil {
+					break
+				}
+			}
+		case "/admin/fetch":
+			control.Fetch()
+		case "/admin/reconcile":
+			if status.Role() != RoleLeader {
+				err = ErrNotLeader
+			} else {
+				err = control.Reconcile(r.URL.Query().Get("service"))
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		switch err {
+		case nil:
+		case ErrPaused, ErrBusy, ErrNotLeader:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(adminState{Paused: control.PausedDirections()})
+	})
+}
@@ -0,0 +1,135 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	status := NewStatus()
+	ts := httptest.NewServer(NewAdminHandler(status, AdminConfig{ReadyMaxAge: time.Minute}))
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/healthz")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// not ready until both sides were fetched
+	resp = get("/readyz")
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	status.fetched(SideAWS, map[string]service{})
+	resp = get("/readyz")
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	eureka := map[string]service{
+		"web": {name: "web", nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80}},
+		}},
+	}
+	status.fetched(SideEureka, eureka)
+	resp = get("/readyz")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok\nrole: leader\n", string(body))
+
+	// standbys are ready as well
+	status.setRole(RoleStandby)
+	resp = get("/readyz")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok\nrole: standby\n", string(body))
+
+	status.running(WorkerSyncToAWS, true)
+	created := newSyncResult()
+	created.record(opRegister, "web", "web-1", errors.New("denied"))
+	status.reconciled(time.Now(), eureka, map[string]service{}, created, newSyncResult(), newSyncResult())
+
+	resp = get("/status")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report Report
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	require.True(t, report.Healthy)
+	require.Equal(t, RoleStandby, report.Role)
+	require.Equal(t, 1, report.Fetches[SideEureka].Instances)
+	require.Equal(t, []string{"register web/web-1: denied"}, report.Reconcile.Errors)
+	require.Equal(t, 1, report.Reconcile.Failed)
+	web := report.Services["web"]
+	require.True(t, web.InEureka)
+	require.False(t, web.InAWS)
+	require.Equal(t, 1, web.EurekaInstances)
+	require.Equal(t, "denied", web.LastError)
+
+	// pprof is off by default
+	resp = get("/debug/pprof/")
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminControl(t *testing.T) {
+	control := NewControl()
+	status := NewStatus()
+	ts := httptest.NewServer(NewAdminHandler(status, AdminConfig{Control: control, Token: "secret"}))
+	defer ts.Close()
+
+	post := func(path, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, nil)
+		require.NoError(t, err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusUnauthorized, post("/admin/pause", "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, post("/admin/pause", "wrong").StatusCode)
+	require.False(t, control.Paused(DirectionToAWS))
+
+	resp, err := http.Get(ts.URL + "/admin/fetch")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	require.Equal(t, http.StatusAccepted, post("/admin/pause?direction=to-aws", "secret").StatusCode)
+	require.True(t, control.Paused(DirectionToAWS))
+	require.False(t, control.Paused(DirectionToEureka))
+	require.Equal(t, http.StatusConflict, post("/admin/reconcile", "secret").StatusCode)
+	require.Equal(t, http.StatusBadRequest, post("/admin/pause?direction=up", "secret").StatusCode)
+	require.Equal(t, http.StatusAccepted, post("/admin/pause", "secret").StatusCode)
+	require.True(t, control.Paused(DirectionToEureka))
+	require.Equal(t, http.StatusAccepted, post("/admin/resume", "secret").StatusCode)
+	require.Equal(t, map[string]bool{DirectionToAWS: false, DirectionToEureka: false}, control.PausedDirections())
+
+	require.Equal(t, http.StatusAccepted, post("/admin/reconcile?service=web", "secret").StatusCode)
+	require.Equal(t, "web", <-control.reconcile)
+	require.Equal(t, http.StatusAccepted, post("/admin/fetch", "secret").StatusCode)
+	status.setRole(RoleStandby)
+	require.Equal(t, http.StatusConflict, post("/admin/reconcile", "secret").StatusCode)
+	require.Empty(t, control.reconcile)
+	require.Len(t, control.fetch[SideAWS], 1)
+	require.Equal(t, http.StatusNotFound, post("/admin/restart", "secret").StatusCode)
+
+	// without a token the endpoints are disabled
+	ts = httptest.NewServer(NewAdminHandler(NewStatus(), AdminConfig{Control: control}))
+	defer ts.Close()
+	require.Equal(t, http.StatusNotFound, post("/admin/pause", "").StatusCode)
+}
@@ -0,0 +1,93 @@
+package catalog
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Registries an AuditEvent applies to.
+const (
+	RegistryAWS    = "aws"
+	RegistryEureka = "eureka"
+)
+
+// Outcomes of an AuditEvent.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// AuditEvent records a single mutation of a registry: what was changed, why
+// and whether it succeeded.
+type AuditEvent struct {
+	Time       time.Time         `json:"time"`
+	SyncID     string            `json:"syncId,omitempty"`
+	Registry   string            `json:"registry"`
+	Operation  string            `json:"operation"`
+	Service    string            `json:"service"`
+	ServiceID  string            `json:"serviceId,omitempty"`
+	Instance   string            `json:"instance,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Reason     string            `json:"reason"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Auditor receives an AuditEvent for every mutation of Sync.
+type Auditor interface {
+	Audit(e AuditEvent)
+}
+
+type nopAuditor struct{}
+
+func (nopAuditor) Audit(AuditEvent) {}
+
+type jsonAuditor struct {
+	lock   sync.Mutex
+	enc    *json.Encoder
+	syncID string
+	log    hclog.Logger
+}
+
+// NewJSONAuditor writes every event as a line of JSON to w, tagged with
+// syncID.
+func NewJSONAuditor(w io.Writer, syncID string, log hclog.Logger) Auditor {
+	return &jsonAuditor{enc: json.NewEncoder(w), syncID: syncID, log: log}
+}
+
+func (a *jsonAuditor) Audit(e AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(e.SyncID) == 0 {
+		e.SyncID = a.syncID
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		a.log.Error("cannot write audit event", "error", err)
+	}
+}
+
+// audit records a mutation of CloudMap with the outcome of err.
+func (a *aws) audit(operation, service, serviceID, instance string, attributes map[string]string, reason string, err error) {
+	e := AuditEvent{
+		Registry:   RegistryAWS,
+		Operation:  operation,
+		Service:    service,
+		ServiceID:  serviceID,
+		Instance:   instance,
+		Attributes: attributes,
+		Reason:     reason,
+		Outcome:    OutcomeSuccess,
+	}
+	if err != nil {
+		e.Outcome = OutcomeError
+		e.Error = err.Error()
+	}
+	a.auditor.Audit(e)
+}
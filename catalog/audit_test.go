@@ -0,0 +1,80 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// auditEvents decodes the JSON lines written by a jsonAuditor sorted by
+// operation and instance.
+func auditEvents(t *testing.T, b *bytes.Buffer) []AuditEvent {
+	events := []AuditEvent{}
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var e AuditEvent
+		require.NoError(t, dec.Decode(&e))
+		require.False(t, e.Time.IsZero())
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Operation != events[j].Operation {
+			return events[i].Operation < events[j].Operation
+		}
+		return events[i].Instance < events[j].Instance
+	})
+	return events
+}
+
+func TestAWSAudit(t *testing.T) {
+	f := newFakeCloudMap()
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: input.(*sd.CreateServiceInput).CreatorRequestId}}, nil
+	})
+	f.handle("DeregisterInstance", func(input interface{}) (interface{}, error) {
+		return nil, awserr.New(sd.ErrCodeResourceInUse, "in use", nil)
+	})
+	var b bytes.Buffer
+	a := newTestAWS(f)
+	a.auditor = NewJSONAuditor(&b, "sync-1", hclog.NewNullLogger())
+
+	a.create(context.Background(), map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+		}},
+	})
+	a.remove(context.Background(), map[string]service{
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "i-3"}},
+		}},
+	}, map[string]service{})
+
+	events := auditEvents(t, &b)
+	require.Len(t, events, 3)
+	id := *f.inputs("CreateService")[0].(*sd.CreateServiceInput).CreatorRequestId
+	for i := range events {
+		events[i].Time = events[0].Time
+	}
+	require.Equal(t, []AuditEvent{
+		{Time: events[0].Time, SyncID: "sync-1", Registry: RegistryAWS, Operation: "CreateService",
+			Service: "web", ServiceID: id, Reason: "service in Eureka but not in CloudMap", Outcome: OutcomeSuccess},
+		{Time: events[0].Time, SyncID: "sync-1", Registry: RegistryAWS, Operation: "DeregisterInstance",
+			Service: "db", ServiceID: "srv-2", Instance: "i-3", Reason: "instance no longer in Eureka",
+			Outcome: OutcomeError, Error: "ResourceInUse: in use"},
+		{Time: events[0].Time, SyncID: "sync-1", Registry: RegistryAWS, Operation: "RegisterInstance",
+			Service: "web", ServiceID: id, Instance: "web-1",
+			Attributes: a.instanceAttributes(node{host: "1.1.1.1", port: 80, instanceID: "web-1"}),
+			Reason:     "instance in Eureka missing or changed in CloudMap", Outcome: OutcomeSuccess},
+	}, events)
+
+	// the service isn't deleted while an instance is left
+	require.Empty(t, f.inputs("DeleteService"))
+}
@@ -3,22 +3,26 @@ package catalog
 import (
 	"context"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
 	x "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
 type namespace struct {
-	id     string
-	name   string
-	isHTTP bool
+	id       string
+	name     string
+	isHTTP   bool
+	isPublic bool
 }
 
 const (
@@ -29,10 +33,33 @@ const (
 	EurekaAWSID     = "external-aws-id"
 )
 
+// Attributes CloudMap and ECS set on instances.
+const (
+	awsInstanceIPv4  = "AWS_INSTANCE_IPV4"
+	awsInstanceIPv6  = "AWS_INSTANCE_IPV6"
+	awsInstanceCNAME = "AWS_INSTANCE_CNAME"
+	awsInstancePort  = "AWS_INSTANCE_PORT"
+	awsAttrPrefix    = "AWS_"
+	ecsClusterName   = "ECS_CLUSTER_NAME"
+	availabilityZone = "AVAILABILITY_ZONE"
+)
+
+// instanceHostname is the attribute hostnames are registered with in HTTP
+// namespaces, which have no CNAME records.
+const instanceHostname = "hostname"
+
+const (
+	eurekaAmazonDataCenter  = "Amazon"
+	eurekaAmazonInfoClass   = "com.netflix.appinfo.AmazonInfo"
+	eurekaMyOwnDataCenter   = "MyOwn"
+	eurekaDefaultInfoClass  = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+	eurekaECSClusterNameKey = "ecs-cluster-name"
+)
+
 type aws struct {
 	lock         sync.RWMutex
 	client       *sd.Client
-	dd           *statsd.Client
+	metrics      Metrics
 	log          hclog.Logger
 	namespace    namespace
 	services     map[string]service
@@ -42,33 +69,73 @@ type aws struct {
 	toEureka     bool
 	pullInterval time.Duration
 	dnsTTL       int64
+	config       *ServicesConfig
+	operations   *operationTracker
+	concurrency  int
+	retries      RetryConfig
+	limiter      *rateLimiter
+	callTimeout  time.Duration
+	tracer       trace.Tracer
+	auditor      Auditor
+	notifier     Notifier
+	leader       *leader
+	state        *stateStore
+	// fetched is set once CloudMap was fetched, the cache may be filled
+	// from the state before.
+	fetched bool
+
+	warnLock sync.Mutex
+	warned   map[string]bool
+
+	// registered holds the instances the sync to Eureka registered, keyed
+	// by app and instance ID.
+	registeredLock sync.Mutex
+	registered     map[string]registration
 }
 
 var awsServiceDescription = "Imported from Eureka"
 
-func (a *aws) sync(eureka *eureka, stop, stopped chan struct{}) {
-	defer close(stopped)
+// warnOnce logs msg as a warning the first time it is logged for key and at
+// debug level after that, for conditions that persist across sync cycles.
+func (a *aws) warnOnce(key, msg string, args ...interface{}) {
+	a.warnLock.Lock()
+	first := !a.warned[key]
+	if first {
+		if a.warned == nil {
+			a.warned = map[string]bool{}
+		}
+		a.warned[key] = true
+	}
+	a.warnLock.Unlock()
+	if first {
+		a.log.Warn(msg, args...)
+	} else {
+		a.log.Debug(msg, args...)
+	}
+}
+
+func (a *aws) sync(eureka *eureka, control *Control, stop <-chan struct{}) {
 	for {
 		select {
 		case <-a.trigger:
 			if !a.toEureka {
 				continue
 			}
-			/*
-				// todo: enable this once everything working
-				create := onlyInFirst(a.getServices(), eureka.getServices())
-				count := eureka.create(create)
-				if count > 0 {
-					count := 0
-					e.log.Info("created", "count", fmt.Sprintf("%d", count))
-				}
-
-				remove := onlyInFirst(aws.getServices(), e.getServices())
-				//e.log.Info("sync()", "aws", aws.getServices(), "eureka", e.getServices())
-				count = aws.remove(remove)
-				if count > 0 {
-					e.log.Info("removed", "count", fmt.Sprintf("%d", count))
-				}*/
+			if control.Paused(DirectionToEureka) {
+				a.log.Info("sync to eureka is paused")
+				continue
+			}
+			if !a.leader.isLeader() {
+				a.log.Debug("standby, not syncing to eureka")
+				continue
+			}
+			result := a.syncToEureka(eureka)
+			if result.count(opRegister) > 0 || result.count(opDeregister) > 0 {
+				a.log.Info("synced to eureka", "registered", result.count(opRegister), "unregistered", result.count(opDeregister))
+			}
+			if len(result.errors) > 0 {
+				a.log.Warn("sync to eureka failed", "errors", len(result.errors))
+			}
 		case <-stop:
 			a.log.Info("sync()", "stopped", 1)
 			return
@@ -76,38 +143,41 @@ func (a *aws) sync(eureka *eureka, stop, stopped chan struct{}) {
 	}
 }
 
-func (a *aws) fetchNamespace(id string) (*sd.Namespace, error) {
-	req := a.client.GetNamespaceRequest(&sd.GetNamespaceInput{Id: x.String(id)})
-	resp, err := req.Send(context.Background())
+func (a *aws) fetchNamespace(ctx context.Context, id string) (*sd.Namespace, error) {
+	var resp *sd.GetNamespaceResponse
+	err := a.retry(ctx, "GetNamespace", func(ctx context.Context) (err error) {
+		req := a.client.GetNamespaceRequest(&sd.GetNamespaceInput{Id: x.String(id)})
+		resp, err = req.Send(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Namespace, nil
 }
 
-func (a *aws) fetchServices() ([]sd.ServiceSummary, error) {
-	req := a.client.ListServicesRequest(&sd.ListServicesInput{
-		Filters: []sd.ServiceFilter{{
-			Name:      sd.ServiceFilterNameNamespaceId,
-			Condition: sd.FilterConditionEq,
-			Values:    []string{a.namespace.id},
-		}},
+func (a *aws) fetchServices(ctx context.Context) ([]sd.ServiceSummary, error) {
+	var resp *sd.ListServicesResponse
+	err := a.retry(ctx, "ListServices", func(ctx context.Context) (err error) {
+		req := a.client.ListServicesRequest(&sd.ListServicesInput{
+			Filters: []sd.ServiceFilter{{
+				Name:      sd.ServiceFilterNameNamespaceId,
+				Condition: sd.FilterConditionEq,
+				Values:    []string{a.namespace.id},
+			}},
+		})
+		resp, err = req.Send(ctx)
+		return err
 	})
-
-	resp, err := req.Send(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	a.log.Debug("fetchServices()", "resp", resp)
 	a.log.Info("fetchServices()", "count", len(resp.Services))
 
-	err = a.dd.Gauge("eureka_aws.sync.aws.services.count",
+	a.metrics.Gauge("eureka_aws.sync.aws.services.count",
 		float64(len(resp.Services)),
-		[]string{"environment:stage-v2"}, 1)
-
-	if err != nil {
-		a.log.Error("Unable to post to statsd", "error", err)
-	}
+		[]string{})
 
 	services := resp.Services
 	return services, nil
@@ -116,13 +186,22 @@ func (a *aws) fetchServices() ([]sd.ServiceSummary, error) {
 func (a *aws) transformServices(awsServices []sd.ServiceSummary) map[string]service {
 	services := map[string]service{}
 	for _, as := range awsServices {
+		if isLeaseService(as) {
+			// the leader lease lives in the synced namespace but isn't
+			// a service to sync
+			continue
+		}
 		s := service{
 			id:           *as.Id,
 			name:         *as.Name,
 			awsID:        *as.Id,
 			awsNamespace: a.namespace.id,
+			description:  x.StringValue(as.Description),
+			dnsConfig:    as.DnsConfig,
+			healthCheck:  as.HealthCheckConfig,
+			customHealth: as.HealthCheckCustomConfig,
 		}
-		if as.Description != nil && *as.Description == awsServiceDescription {
+		if as.Description != nil && strings.HasPrefix(*as.Description, awsServiceDescription) {
 			s.fromEureka = true
 			s.name = strings.TrimPrefix(s.name, a.eurekaPrefix)
 		}
@@ -137,11 +216,14 @@ func (a *aws) transformNamespace(awsNamespace *sd.Namespace) namespace {
 	if awsNamespace.Type == sd.NamespaceTypeHttp {
 		namespace.isHTTP = true
 	}
+	if awsNamespace.Type == sd.NamespaceTypeDnsPublic {
+		namespace.isPublic = true
+	}
 	return namespace
 }
 
-func (a *aws) setupNamespace(id string) error {
-	namespace, err := a.fetchNamespace(id)
+func (a *aws) setupNamespace(ctx context.Context, id string) error {
+	namespace, err := a.fetchNamespace(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -149,79 +231,72 @@ func (a *aws) setupNamespace(id string) error {
 	return nil
 }
 
-func (a *aws) fetch() error {
-	awsService, err := a.fetchServices()
+func (a *aws) fetch(ctx context.Context) (err error) {
+	start := time.Now()
+	ctx, span := a.tracer.Start(ctx, "aws.fetch")
+	defer func() {
+		a.metrics.Timing("eureka_aws.sync.aws.fetch.duration", time.Since(start), []string{})
+		endSpan(ctx, span, err)
+	}()
+	awsService, err := a.fetchServices(ctx)
 	if err != nil {
 		return err
 	}
 	services := a.transformServices(awsService)
+	span.SetAttributes(kv.Int("services", len(services)))
 	for h, s := range services {
-		var awsNodes []sd.InstanceSummary
-		var err error
-		name := s.name
-		if s.fromEureka {
-			name = a.eurekaPrefix + name
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		awsNodes, err = a.discoverNodes(name)
-		if err != nil {
-			a.log.Error("cannot discover nodes", "error", err)
-			continue
+		if s, ok := a.fetchInstances(ctx, h, s); ok {
+			services[h] = s
+			a.log.Debug("fetch()", "service", s)
 		}
-
-		nodes := a.transformNodes(awsNodes)
-		//a.log.Info("fetch()", "service", s.name, "nodesCount", length(nodes))
-		if len(nodes) == 0 {
-			continue
-		}
-		s.nodes = nodes
-
-		healths, err := a.fetchHealths(s.awsID)
-		a.log.Info("fetch()", "healths", healths, "awsID", s.awsID)
-		if err != nil {
-			a.log.Error("fetch(): cannot fetch healths", "error", err)
-		} else {
-			if s.fromEureka {
-				healths = a.rekeyHealths(s.name, healths)
-			}
-			s.healths = healths
-		}
-
-		services[h] = s
-		a.log.Debug("fetch()", "service", s)
 	}
-	a.setServices(services)
+	a.lock.Lock()
+	a.services = services
+	a.fetched = true
+	a.lock.Unlock()
+	a.operations.prune(start)
+	a.validateState(services)
+	for k, s := range services {
+		a.metrics.Gauge("eureka_aws.sync.aws.instances.count",
+			float64(countNodes(map[string]service{k: s})),
+			[]string{"service:" + k})
+	}
 	return nil
 }
 
-func (a *aws) getNodeForEurekaID(name, id string) (node, bool) {
-	a.lock.RLock()
-	copy, ok := a.services[name]
-	a.lock.RUnlock()
-	if !ok {
-		return node{}, ok
+// fetchInstances adds the nodes and healths of s and reports whether it has
+// any nodes.
+func (a *aws) fetchInstances(ctx context.Context, k string, s service) (service, bool) {
+	ctx, span := a.tracer.Start(ctx, "aws.fetch.service", trace.WithAttributes(kv.String("service", k)))
+	defer span.End()
+	name := s.name
+	if s.fromEureka {
+		name = a.eurekaPrefix + name
 	}
-	for _, nodes := range copy.nodes {
-		for _, n := range nodes {
-			if n.eurekaID == id {
-				return n, true
-			}
-		}
+	awsNodes, err := a.discoverNodes(ctx, name)
+	if err != nil {
+		a.log.Error("cannot discover nodes", "error", err)
+		return s, false
 	}
-	return node{}, false
-}
 
-func (a *aws) rekeyHealths(name string, healths map[string]health) map[string]health {
-	rekeyed := map[string]health{}
-	s, ok := a.getService(name)
-	if !ok {
-		return nil
+	nodes := a.transformNodes(awsNodes)
+	//a.log.Info("fetch()", "service", s.name, "nodesCount", length(nodes))
+	if len(nodes) == 0 {
+		return s, false
 	}
-	for k, h := range s.healths {
-		if n, ok := a.getNodeForEurekaID(name, k); ok {
-			rekeyed[id(k, n.host, n.port)] = h
-		}
+	s.nodes = nodes
+
+	healths, err := a.fetchHealths(ctx, s.awsID)
+	a.log.Info("fetch()", "healths", healths, "awsID", s.awsID)
+	if err != nil {
+		a.log.Error("fetch(): cannot fetch healths", "error", err)
+	} else {
+		s.healths = healths
 	}
-	return rekeyed
+	return s, true
 }
 
 func statusFromAWS(aws sd.HealthStatus) health {
@@ -251,13 +326,29 @@ func statusToCustomHealth(h health) sd.CustomHealthStatus {
 	return result
 }
 
-func (a *aws) fetchHealths(id string) (map[string]health, error) {
-	req := a.client.GetInstancesHealthStatusRequest(&sd.GetInstancesHealthStatusInput{
-		ServiceId: &id,
-	})
+func statusToEureka(h health) string {
+	switch h {
+	case up, healthy:
+		return _e.UP
+	case unhealthy:
+		return _e.DOWN
+	case out_of_service:
+		return string(out_of_service)
+	default:
+		return "UNKNOWN"
+	}
+}
 
+func (a *aws) fetchHealths(ctx context.Context, id string) (map[string]health, error) {
 	result := map[string]health{}
-	resp, err := req.Send(context.Background())
+	var resp *sd.GetInstancesHealthStatusResponse
+	err := a.retry(ctx, "GetInstancesHealthStatus", func(ctx context.Context) (err error) {
+		req := a.client.GetInstancesHealthStatusRequest(&sd.GetInstancesHealthStatusInput{
+			ServiceId: &id,
+		})
+		resp, err = req.Send(ctx)
+		return err
+	})
 	a.log.Debug("fetchHealths", "resp", resp)
 
 	if err != nil {
@@ -274,10 +365,19 @@ func (a *aws) fetchHealths(id string) (map[string]health, error) {
 func (a *aws) transformNodes(awsNodes []sd.InstanceSummary) map[string]map[int]node {
 	nodes := map[string]map[int]node{}
 	for _, an := range awsNodes {
-		h := an.Attributes["AWS_INSTANCE_IPV4"]
+		h := an.Attributes[awsInstanceIPv4]
+		if len(h) == 0 {
+			h = an.Attributes[awsInstanceIPv6]
+		}
+		if len(h) == 0 {
+			h = an.Attributes[awsInstanceCNAME]
+		}
+		if len(h) == 0 {
+			h = an.Attributes[instanceHostname]
+		}
 		p := 0
-		if an.Attributes["AWS_INSTANCE_PORT"] != "" {
-			p, _ = strconv.Atoi(an.Attributes["AWS_INSTANCE_PORT"])
+		if an.Attributes[awsInstancePort] != "" {
+			p, _ = strconv.Atoi(an.Attributes[awsInstancePort])
 		}
 		if nodes[h] == nil {
 			nodes[h] = map[int]node{}
@@ -289,34 +389,147 @@ func (a *aws) transformNodes(awsNodes []sd.InstanceSummary) map[string]map[int]n
 	return nodes
 }
 
-// TODO: not used anywhere, remove
-func (a *aws) fetchNodes(id string) ([]sd.InstanceSummary, error) {
-	req := a.client.ListInstancesRequest(&sd.ListInstancesInput{
-		ServiceId: &id,
-	})
+// transformInstanceInfo translates a CloudMap instance of the named service
+// into a Eureka InstanceInfo using the mapping configured for the service.
+func (a *aws) transformInstanceInfo(name string, n node, h health) (*_e.InstanceInfo, error) {
+	mapping := a.config.forService(name).Mapping
+	attributes := n.attributes
+
+	ip := attributes[awsInstanceIPv4]
+	if len(ip) == 0 {
+		ip = attributes[awsInstanceIPv6]
+	}
+	if len(ip) == 0 {
+		ip = n.host
+	}
+	host := attributes["local-hostname"]
+	if len(host) == 0 {
+		host = attributes[awsInstanceCNAME]
+	}
+	if len(host) == 0 {
+		host = attributes[instanceHostname]
+	}
+	if len(host) == 0 {
+		host = ip
+	}
+
+	app := strings.ToUpper(a.awsPrefix + name)
+	data := instanceTemplateData{
+		Name:       name,
+		App:        app,
+		IP:         ip,
+		Host:       host,
+		Port:       n.port,
+		HostPort:   net.JoinHostPort(host, strconv.Itoa(n.port)),
+		InstanceID: n.awsID,
+		Attributes: attributes,
+	}
+
+	info := &_e.InstanceInfo{
+		App:        app,
+		HostName:   host,
+		IpAddr:     ip,
+		InstanceID: n.awsID,
+		Status:     statusToEureka(h),
+		Port:       &_e.Port{Port: n.port, Enabled: true},
+		DataCenterInfo: &_e.DataCenterInfo{
+			Name:  eurekaMyOwnDataCenter,
+			Class: eurekaDefaultInfoClass,
+		},
+	}
+
+	var err error
+	if info.VipAddress, err = mapping.render("vipAddress", data); err != nil {
+		return nil, err
+	}
+	if info.HomePageUrl, err = mapping.render("homePageUrl", data); err != nil {
+		return nil, err
+	}
+	if info.StatusPageUrl, err = mapping.render("statusPageUrl", data); err != nil {
+		return nil, err
+	}
+	if info.HealthCheckUrl, err = mapping.render("healthCheckUrl", data); err != nil {
+		return nil, err
+	}
+
+	az := attributes[availabilityZone]
+	if len(az) == 0 {
+		az = attributes["availability-zone"]
+	}
+	if len(az) > 0 || len(attributes[ecsClusterName]) > 0 {
+		info.DataCenterInfo = &_e.DataCenterInfo{
+			Name:  eurekaAmazonDataCenter,
+			Class: eurekaAmazonInfoClass,
+			Metadata: &_e.DataCenterMetadata{
+				InstanceId:       n.awsID,
+				AvailabilityZone: az,
+				LocalIpv4:        attributes["local-ipv4"],
+				PublicIpv4:       attributes["public-ipv4"],
+				LocalHostname:    attributes["local-hostname"],
+				PublicHostname:   attributes["public-hostname"],
+			},
+		}
+		if len(info.DataCenterInfo.Metadata.LocalIpv4) == 0 {
+			info.DataCenterInfo.Metadata.LocalIpv4 = attributes[awsInstanceIPv4]
+		}
+	}
+
+	metadata := map[string]string{}
+	for k, v := range attributes {
+		if strings.HasPrefix(k, awsAttrPrefix) || k == availabilityZone || mapping.excludes(k) {
+			continue
+		}
+		switch k {
+		case ecsClusterName:
+			metadata[eurekaECSClusterNameKey] = v
+		case "local-ipv4", "public-ipv4", "local-hostname", "public-hostname", "availability-zone",
+			"homePageUrl", "statusPageUrl", "healthCheckUrl":
+			// already part of InstanceInfo
+		default:
+			metadata[k] = v
+		}
+	}
+	if len(metadata) > 0 {
+		info.Metadata = &_e.MetaData{Map: metadata}
+	}
+	return info, nil
+}
 
-	resp, err := req.Send(context.Background())
-	a.log.Debug("fetchNodes", "resp", resp)
+// fetchNodes lists all instances of a service regardless of their health,
+// unlike discoverNodes.
+func (a *aws) fetchNodes(ctx context.Context, id string) ([]sd.InstanceSummary, error) {
+	var nodes []sd.InstanceSummary
+	err := a.retry(ctx, "ListInstances", func(ctx context.Context) error {
+		req := a.client.ListInstancesRequest(&sd.ListInstancesInput{
+			ServiceId: &id,
+		})
+
+		nodes = []sd.InstanceSummary{}
+		p := sd.NewListInstancesPaginator(req)
+		for p.Next(ctx) {
+			nodes = append(nodes, p.CurrentPage().Instances...)
+		}
+		return p.Err()
+	})
 	if err != nil {
 		a.log.Error("fetchNodes()", "resp", err)
 		return nil, err
 	}
+	a.log.Debug("fetchNodes", "count", len(nodes))
+	return nodes, nil
+}
 
-	nodes := []sd.InstanceSummary{}
-	//nodes = append(nodes, resp.Instances)
-	/*for p.Next() {
-		nodes = append(nodes, p.CurrentPage().Instances...)
-	}*/
-	return nodes, nil //p.Err()
-}
-
-func (a *aws) discoverNodes(name string) ([]sd.InstanceSummary, error) {
-	req := a.client.DiscoverInstancesRequest(&sd.DiscoverInstancesInput{
-		HealthStatus:  sd.HealthStatusFilterHealthy,
-		NamespaceName: x.String(a.namespace.name),
-		ServiceName:   x.String(name),
+func (a *aws) discoverNodes(ctx context.Context, name string) ([]sd.InstanceSummary, error) {
+	var resp *sd.DiscoverInstancesResponse
+	err := a.retry(ctx, "DiscoverInstances", func(ctx context.Context) (err error) {
+		req := a.client.DiscoverInstancesRequest(&sd.DiscoverInstancesInput{
+			HealthStatus:  sd.HealthStatusFilterAll,
+			NamespaceName: x.String(a.namespace.name),
+			ServiceName:   x.String(name),
+		})
+		resp, err = req.Send(ctx)
+		return err
 	})
-	resp, err := req.Send(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -343,44 +556,382 @@ func (a *aws) getService(name string) (service, bool) {
 	return copy, ok
 }
 
+// known reports whether the cache was filled by a fetch or the state, so
+// services can be created and updated without trying to create every
+// service.
+func (a *aws) known() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.services != nil
+}
+
+// ready reports whether CloudMap was fetched, so the services and instances
+// missing in Eureka are really in CloudMap and may be removed. Loaded state
+// doesn't count, it may be outdated.
+func (a *aws) ready() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.fetched
+}
+
 func (a *aws) setServices(services map[string]service) {
 	a.lock.Lock()
 	a.services = services
 	a.lock.Unlock()
 }
 
-//TODO: check if service exists
-//      split create service and register nodes
-func (a *aws) create(services map[string]service) int {
-	wg := sync.WaitGroup{}
-	count := 0
+func (a *aws) deleteService(name string) {
+	a.lock.Lock()
+	services := make(map[string]service, len(a.services))
+	for k, v := range a.services {
+		if k != name {
+			services[k] = v
+		}
+	}
+	a.services = services
+	a.lock.Unlock()
+}
+
+// removeNode drops a deregistered node and its health from the cached
+// service name.
+func (a *aws) removeNode(name, host string, n node) {
+	a.updateService(name, func(s *service) {
+		nodes := make(map[string]map[int]node, len(s.nodes))
+		for h, ports := range s.nodes {
+			if h != host {
+				nodes[h] = ports
+				continue
+			}
+			remaining := map[int]node{}
+			for p, pn := range ports {
+				if p != n.port {
+					remaining[p] = pn
+				}
+			}
+			if len(remaining) > 0 {
+				nodes[h] = remaining
+			}
+		}
+		s.nodes = nodes
+
+		healths := make(map[string]health, len(s.healths))
+		for id, h := range s.healths {
+			if id != n.awsID {
+				healths[id] = h
+			}
+		}
+		s.healths = healths
+	})
+}
+
+// addService caches a created service.
+func (a *aws) addService(s service) {
+	a.lock.Lock()
+	services := make(map[string]service, len(a.services)+1)
+	for k, v := range a.services {
+		services[k] = v
+	}
+	services[s.name] = s
+	a.services = services
+	a.lock.Unlock()
+}
+
+// addNode caches a registered node of service name. Services missing in the
+// cache are added without their configuration.
+func (a *aws) addNode(name, serviceID string, n node) {
+	a.lock.Lock()
+	services := make(map[string]service, len(a.services)+1)
+	for k, v := range a.services {
+		services[k] = v
+	}
+	s, ok := services[name]
+	if !ok {
+		s = service{id: serviceID, name: name, awsID: serviceID, awsNamespace: a.namespace.id, fromEureka: true, partial: true}
+	}
+	nodes := make(map[string]map[int]node, len(s.nodes)+1)
+	for h, ports := range s.nodes {
+		nodes[h] = ports
+	}
+	ports := make(map[int]node, len(nodes[n.host])+1)
+	for p, pn := range nodes[n.host] {
+		ports[p] = pn
+	}
+	ports[n.port] = n
+	nodes[n.host] = ports
+	s.nodes = nodes
+	services[name] = s
+	a.services = services
+	a.lock.Unlock()
+}
+
+// setHealth caches the health of instance id of service name.
+func (a *aws) setHealth(name, id string, h health) {
+	a.updateService(name, func(s *service) {
+		healths := make(map[string]health, len(s.healths)+1)
+		for k, v := range s.healths {
+			healths[k] = v
+		}
+		healths[id] = h
+		s.healths = healths
+	})
+}
+
+// updateService applies f to the cached service name. The map is copied
+// because getServices hands it out without holding the lock.
+func (a *aws) updateService(name string, f func(s *service)) {
+	a.lock.Lock()
+	services := make(map[string]service, len(a.services))
+	for k, v := range a.services {
+		services[k] = v
+	}
+	if s, ok := services[name]; ok {
+		f(&s)
+		services[name] = s
+	}
+	a.services = services
+	a.lock.Unlock()
+}
+
+// dnsRecordTypes picks the DNS records for a service from the addresses of
+// its nodes. SRV is used whenever every node has a port, A and AAAA for the
+// address families present without a port and CNAME if the service consists
+// of hostnames only. CloudMap doesn't allow mixing CNAME with other record
+// types, so a service mixing hostnames and IP addresses is an error.
+func dnsRecordTypes(nodes map[string]map[int]node) ([]sd.RecordType, error) {
+	types := map[addressType]string{}
+	withPort := true
+	for h, ports := range nodes {
+		for p := range ports {
+			if t := addressTypeOf(h); len(types[t]) == 0 || h < types[t] {
+				types[t] = h
+			}
+			if p == 0 {
+				withPort = false
+			}
+		}
+	}
+	hostname, ok := types[addressHostname]
+	if ok && len(types) > 1 {
+		ip := types[addressIPv4]
+		if len(ip) == 0 {
+			ip = types[addressIPv6]
+		}
+		return nil, fmt.Errorf("service mixes hostnames and IP addresses, such as %s and %s, which CloudMap can't serve with one record type", hostname, ip)
+	}
+	if ok {
+		return []sd.RecordType{sd.RecordTypeCname}, nil
+	}
+	if withPort {
+		return []sd.RecordType{sd.RecordTypeSrv}, nil
+	}
+	var records []sd.RecordType
+	if _, ok := types[addressIPv4]; ok {
+		records = append(records, sd.RecordTypeA)
+	}
+	if _, ok := types[addressIPv6]; ok {
+		records = append(records, sd.RecordTypeAaaa)
+	}
+	if len(records) == 0 {
+		records = append(records, sd.RecordTypeA)
+	}
+	return records, nil
+}
+
+// instanceAttributes returns the attributes to register n with. The address
+// is written to the attribute matching its type; hostnames only become
+// AWS_INSTANCE_CNAME in DNS namespaces since HTTP namespaces have no DNS
+// records.
+func (a *aws) instanceAttributes(n node) map[string]string {
+	attributes := make(map[string]string, len(n.attributes)+2)
+	for k, v := range n.attributes {
+		attributes[k] = v
+	}
+
+	switch addressTypeOf(n.host) {
+	case addressIPv4:
+		if len(n.attributes["local-ipv4"]) > 0 {
+			attributes[awsInstanceIPv4] = n.attributes["local-ipv4"]
+		} else {
+			attributes[awsInstanceIPv4] = n.host
+		}
+	case addressIPv6:
+		attributes[awsInstanceIPv6] = n.host
+	case addressHostname:
+		if !a.namespace.isHTTP {
+			attributes[awsInstanceCNAME] = n.host
+		} else {
+			attributes[instanceHostname] = n.host
+		}
+	}
+
+	if n.port > 0 {
+		attributes[awsInstancePort] = fmt.Sprintf("%d", n.port)
+	}
+	return attributes
+}
+
+// diffToAWS returns what create needs to do to bring CloudMap to the state of
+// eurekaServices: the services missing in awsServices, the instances missing
+// or registered with attributes that hash differently than the ones they
+// would be registered with now, and the healths that differ. Instances are
+// matched by ID since CloudMap keys them by their address attribute, which
+// isn't necessarily the host in Eureka.
+func (a *aws) diffToAWS(eurekaServices, awsServices map[string]service) map[string]service {
+	result := map[string]service{}
+	for k, es := range eurekaServices {
+		as, ok := awsServices[k]
+		if !ok {
+			result[k] = es
+			continue
+		}
+		registered := map[string]node{}
+		for _, nodes := range as.nodes {
+			for _, n := range nodes {
+				registered[n.awsID] = n
+			}
+		}
+		nodes := map[string]map[int]node{}
+		for h, ports := range es.nodes {
+			for p, n := range ports {
+				if rn, ok := registered[n.instanceID]; ok && rn.hash() == attributesHash(a.instanceAttributes(n)) {
+					continue
+				}
+				if nodes[h] == nil {
+					nodes[h] = map[int]node{}
+				}
+				nodes[h][p] = n
+			}
+		}
+		healths := map[string]health{}
+		if a.usesCustomHealth(k) {
+			for id, h := range es.healths {
+				if ah, ok := as.healths[id]; !ok || ah == unknown || statusToCustomHealth(ah) != statusToCustomHealth(h) {
+					healths[id] = h
+				}
+			}
+		}
+		if len(nodes) == 0 && len(healths) == 0 {
+			continue
+		}
+		s := service{
+			id:           as.id,
+			name:         k,
+			awsID:        as.awsID,
+			eurekaID:     es.eurekaID,
+			awsNamespace: as.awsNamespace,
+			fromEureka:   true,
+			fromAWS:      as.fromAWS,
+		}
+		if len(nodes) > 0 {
+			s.nodes = nodes
+		}
+		if len(healths) > 0 {
+			s.healths = healths
+		}
+		result[k] = s
+	}
+	return result
+}
+
+// diffFromAWS returns what remove needs to do to bring CloudMap to the state
+// of eurekaServices: the services missing in eurekaServices with all their
+// instances, and the instances of the others whose ID isn't in Eureka.
+// Instances are matched by ID like in diffToAWS, so an instance registered
+// again under a new address isn't deregistered.
+func (a *aws) diffFromAWS(awsServices, eurekaServices map[string]service) map[string]service {
+	result := map[string]service{}
+	for k, as := range awsServices {
+		es, ok := eurekaServices[k]
+		if !ok {
+			result[k] = as
+			continue
+		}
+		ids := map[string]bool{}
+		for _, nodes := range es.nodes {
+			for _, n := range nodes {
+				ids[n.instanceID] = true
+			}
+		}
+		nodes := map[string]map[int]node{}
+		for h, ports := range as.nodes {
+			for p, n := range ports {
+				if ids[n.awsID] {
+					continue
+				}
+				if nodes[h] == nil {
+					nodes[h] = map[int]node{}
+				}
+				nodes[h][p] = n
+			}
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+		s := as
+		s.nodes = nodes
+		s.healths = nil
+		result[k] = s
+	}
+	return result
+}
+
+// create creates the services missing in CloudMap and registers their nodes
+// and health statuses. Registrations and health updates run on a bounded
+// worker pool; health updates only start once every registration finished,
+// otherwise CloudMap doesn't know the instances yet.
+func (a *aws) create(ctx context.Context, services map[string]service) (result syncResult) {
+	ctx, span := a.tracer.Start(ctx, "aws.create", trace.WithAttributes(kv.Int("services", len(services))))
+	spans := newServiceSpans(ctx, a.tracer, "aws.create.service")
+	defer func() {
+		spans.end(result)
+		span.End()
+	}()
+	result = newSyncResult()
+	customHealth := map[string]bool{}
+	ids := map[string]string{}
+	pool := newWorkerPool(ctx, a.concurrency)
 	for k, s := range services {
 		a.log.Debug("create()", "serviceName", s.name)
 		if s.fromAWS {
 			continue
 		}
+		ctx := spans.start(k)
 		name := a.eurekaPrefix + k
 		a.log.Info("create()", "awsServiceName", name, "namespace", a.namespace.id)
+		customHealth[k] = a.usesCustomHealth(k)
 		if len(s.awsID) == 0 {
+			description := a.serviceDescription(k)
 			input := sd.CreateServiceInput{
-				Description: &awsServiceDescription,
-				Name:        &name,
-				NamespaceId: &a.namespace.id,
-				HealthCheckCustomConfig: &sd.HealthCheckCustomConfig{
-					FailureThreshold: x.Int64(5),
-				},
+				CreatorRequestId: creatorRequestID(),
+				Description:      &description,
+				Name:             &name,
+				NamespaceId:      &a.namespace.id,
 			}
 
 			if !a.namespace.isHTTP {
-				input.DnsConfig = &sd.DnsConfig{
-					DnsRecords: []sd.DnsRecord{
-						{TTL: &a.dnsTTL, Type: sd.RecordTypeSrv},
-					},
+				dns, err := a.dnsConfig(k, s.nodes)
+				if err != nil {
+					result.record(opCreateService, k, "", err)
+					a.log.Error("cannot create service", "name", name, "error", err)
+					continue
 				}
+				input.DnsConfig = dns
 			}
+			input.HealthCheckConfig, input.HealthCheckCustomConfig = a.healthCheckConfig(k, s.nodes, input.DnsConfig)
+			customHealth[k] = input.HealthCheckCustomConfig != nil
 
-			req := a.client.CreateServiceRequest(&input)
-			resp, err := req.Send(context.Background())
+			var resp *sd.CreateServiceResponse
+			err := a.retry(ctx, "CreateService", func(ctx context.Context) (err error) {
+				req := a.client.CreateServiceRequest(&input)
+				resp, err = req.Send(ctx)
+				return err
+			})
+			result.record(opCreateService, k, "", err)
+			id := ""
+			if err == nil {
+				id = x.StringValue(resp.Service.Id)
+			}
+			a.audit("CreateService", k, id, "", nil, "service in Eureka but not in CloudMap", err)
 			if err != nil {
 				if err, ok := err.(awserr.Error); ok {
 					switch err.Code() {
@@ -395,147 +946,193 @@ func (a *aws) create(services map[string]service) int {
 				continue
 			}
 			s.awsID = *resp.Service.Id
+			a.addService(service{
+				id:           s.awsID,
+				name:         k,
+				awsID:        s.awsID,
+				awsNamespace: a.namespace.id,
+				fromEureka:   true,
+				description:  description,
+				dnsConfig:    input.DnsConfig,
+				healthCheck:  input.HealthCheckConfig,
+				customHealth: input.HealthCheckCustomConfig,
+			})
 
 			a.log.Info("Created service:", "name", name, "ns", a.namespace.id, "namespaceID", s.awsID)
-			count++
+			a.notifier.Notify(Event{Type: EventServiceCreated, Service: k, ServiceID: s.awsID,
+				Reason: "service in Eureka but not in CloudMap"})
 		}
+		ids[k] = s.awsID
 
 		for h, nodes := range s.nodes {
 			for _, n := range nodes {
-				wg.Add(1)
-				go func(serviceID, name, h string, n node) {
-					wg.Done()
-					instanceID := n.instanceID //id(serviceID, h, n.port)
-					attributes := n.attributes
-					if len(n.attributes["local-ipv4"]) > 0 {
-						attributes["AWS_INSTANCE_IPV4"] = n.attributes["local-ipv4"]
-					} else {
-						attributes["AWS_INSTANCE_IPV4"] = n.host
+				k, serviceID, h, n := k, s.awsID, h, n
+				pool.run(opRegister, k, n.instanceID, func() error {
+					instanceID := n.instanceID
+					input := sd.RegisterInstanceInput{
+						CreatorRequestId: creatorRequestID(),
+						ServiceId:        &serviceID,
+						Attributes:       a.instanceAttributes(n),
+						InstanceId:       &instanceID,
 					}
-
-					attributes["AWS_INSTANCE_PORT"] = fmt.Sprintf("%d", n.port)
-
-					req := a.client.RegisterInstanceRequest(&sd.RegisterInstanceInput{
-						ServiceId:  &serviceID,
-						Attributes: attributes,
-						InstanceId: &instanceID,
+					var resp *sd.RegisterInstanceResponse
+					err := a.retry(ctx, "RegisterInstance", func(ctx context.Context) (err error) {
+						req := a.client.RegisterInstanceRequest(&input)
+						resp, err = req.Send(ctx)
+						return err
 					})
-					_, err := req.Send(context.Background())
+					if err == nil {
+						err = a.operations.track(ctx, "register", serviceID, instanceID, resp.OperationId)
+					}
+					a.audit("RegisterInstance", k, serviceID, instanceID, input.Attributes,
+						"instance in Eureka missing or changed in CloudMap", err)
 					if err != nil {
 						a.log.Error("cannot register node", "error", err)
-						err := a.dd.Count("eureka_aws.sync.aws.instances.update_error",
-							int64(count),
-							[]string{}, 1)
-
-						if err != nil {
-							a.log.Error("Unable to post to statsd", "error", err)
-						}
-					} else {
-						a.log.Info("Registered node", "ID", instanceID, "service", serviceID, "ip", h, "ns", a.namespace.id)
+						a.metrics.Count("eureka_aws.sync.aws.instances.update_error",
+							1,
+							[]string{"service:" + k})
+						return err
 					}
-				}(s.awsID, name, h, n)
+					a.log.Info("Registered node", "ID", instanceID, "service", serviceID, "ip", h, "ns", a.namespace.id)
+					a.addNode(k, serviceID, node{host: n.host, port: n.port, awsID: instanceID,
+						instanceID: instanceID, attributes: input.Attributes})
+					return nil
+				})
 			}
-			err := a.dd.Count("eureka_aws.sync.aws.services.updated_count",
+			a.metrics.Count("eureka_aws.sync.aws.services.updated_count",
 				1,
-				[]string{}, 1)
+				[]string{"service:" + k})
+		}
+	}
+	registered := pool.wait()
 
-			if err != nil {
-				a.log.Error("Unable to post to statsd", "error", err)
-			}
+	for k, s := range services {
+		if len(ids[k]) == 0 || !customHealth[k] {
+			continue
 		}
+		ctx := spans.start(k)
 		for instanceID, h := range s.healths {
-			wg.Add(1)
-			go func(serviceID, instanceID string, h health) {
-				defer wg.Done()
-				req := a.client.UpdateInstanceCustomHealthStatusRequest(&sd.UpdateInstanceCustomHealthStatusInput{
-					ServiceId:  &serviceID,
-					InstanceId: &instanceID,
-					Status:     statusToCustomHealth(h),
+			if registered.failedInstance(opRegister, k, instanceID) {
+				// the instance doesn't exist, there is no health to update
+				continue
+			}
+			k, serviceID, instanceID, h := k, ids[k], instanceID, h
+			pool.run(opUpdateHealth, k, instanceID, func() error {
+				status := statusToCustomHealth(h)
+				err := a.retry(ctx, "UpdateInstanceCustomHealthStatus", func(ctx context.Context) error {
+					req := a.client.UpdateInstanceCustomHealthStatusRequest(&sd.UpdateInstanceCustomHealthStatusInput{
+						ServiceId:  &serviceID,
+						InstanceId: &instanceID,
+						Status:     status,
+					})
+					_, err := req.Send(ctx)
+					return err
 				})
-				_, err := req.Send(context.Background())
+				a.audit("UpdateInstanceCustomHealthStatus", k, serviceID, instanceID,
+					map[string]string{"status": string(status)}, "health status of the instance in Eureka", err)
 				if err != nil {
 					// Can be ignored for the first time
-					err := a.dd.Count("eureka_aws.sync.aws.instances.health_update_error",
+					a.metrics.Count("eureka_aws.sync.aws.instances.health_update_error",
 						1,
-						[]string{}, 1)
-
-					if err != nil {
-						a.log.Error("Unable to post to statsd", "error", err)
-					}
+						[]string{"service:" + k})
 
 					a.log.Error("cannot create custom health", "error", err)
-				} else {
-					err := a.dd.Count("eureka_aws.sync.aws.instances.health_updated",
-						1,
-						[]string{}, 1)
-
-					if err != nil {
-						a.log.Error("Unable to post to statsd", "error", err)
-					}
-
-					a.log.Info("custom health status updated", "service", serviceID, "instance", instanceID, "new status", h)
+					return err
 				}
-			}(s.awsID, instanceID, h)
+				a.metrics.Count("eureka_aws.sync.aws.instances.health_updated",
+					1,
+					[]string{"service:" + k})
+
+				a.log.Info("custom health status updated", "service", serviceID, "instance", instanceID, "new status", h)
+				a.setHealth(k, instanceID, h)
+				return nil
+			})
 		}
-		wg.Wait()
 	}
+	healths := pool.wait()
 
-	return count
+	result.succeeded[opRegister] += registered.count(opRegister)
+	result.succeeded[opUpdateHealth] += healths.count(opUpdateHealth)
+	result.errors = append(result.errors, registered.errors...)
+	result.errors = append(result.errors, healths.errors...)
+	return result
 }
 
-func (a *aws) remove(services map[string]service) int {
-	wg := sync.WaitGroup{}
-	//deletedNodes := []string{}
-
-	for _, s := range services {
+// remove deregisters the nodes in services, which are the nodes found in
+// CloudMap but not in Eureka. A service is only deleted once it vanished from
+// Eureka altogether and the deregistration operations of all its nodes
+// succeeded, otherwise CloudMap refuses with ResourceInUse. The cache is
+// updated after every successful call so the next cycle doesn't retry them.
+func (a *aws) remove(ctx context.Context, services map[string]service, eurekaServices map[string]service) (result syncResult) {
+	ctx, span := a.tracer.Start(ctx, "aws.remove", trace.WithAttributes(kv.Int("services", len(services))))
+	spans := newServiceSpans(ctx, a.tracer, "aws.remove.service")
+	defer func() {
+		spans.end(result)
+		span.End()
+	}()
+	pool := newWorkerPool(ctx, a.concurrency)
+	for k, s := range services {
 		if !s.fromEureka || len(s.awsID) == 0 {
 			continue
 		}
+		ctx := spans.start(k)
 		for h, nodes := range s.nodes {
 			for _, n := range nodes {
-				wg.Add(1)
-				go func(serviceID, id string) {
+				name, serviceID, h, n := k, s.awsID, h, n
+				pool.run(opDeregister, name, n.awsID, func() error {
 					a.log.Info("remove()", "instanceId", n.awsID, "ipv4", h)
-					defer wg.Done()
-					req := a.client.DeregisterInstanceRequest(&sd.DeregisterInstanceInput{
-						ServiceId:  &serviceID,
-						InstanceId: &id,
+					var resp *sd.DeregisterInstanceResponse
+					err := a.retry(ctx, "DeregisterInstance", func(ctx context.Context) (err error) {
+						req := a.client.DeregisterInstanceRequest(&sd.DeregisterInstanceInput{
+							ServiceId:  &serviceID,
+							InstanceId: &n.awsID,
+						})
+						resp, err = req.Send(ctx)
+						return err
 					})
-					_, err := req.Send(context.Background())
+					if err == nil {
+						err = a.operations.track(ctx, "deregister", serviceID, n.awsID, resp.OperationId)
+					}
+					a.audit("DeregisterInstance", name, serviceID, n.awsID, nil, "instance no longer in Eureka", err)
 					if err != nil {
 						a.log.Error("cannot remove instance", "error", err)
-					} else {
-						// TODO:  remove instance from struct
-						//delete(nodes, n)
+						return err
 					}
-				}(s.awsID, n.awsID)
+					a.removeNode(name, h, n)
+					return nil
+				})
 			}
 		}
 	}
-	wg.Wait()
+	result = pool.wait()
 
-	count := 0
 	for k, s := range services {
 		if !s.fromEureka || len(s.awsID) == 0 {
 			continue
 		}
-		origService, _ := a.getService(k)
-		if len(s.nodes) < len(origService.nodes) {
+		if _, ok := eurekaServices[k]; ok || result.failed(opDeregister, k) {
 			continue
 		}
-		req := a.client.DeleteServiceRequest(&sd.DeleteServiceInput{
-			Id: &s.awsID,
+		ctx := spans.start(k)
+		id := s.awsID
+		err := a.retry(ctx, "DeleteService", func(ctx context.Context) error {
+			req := a.client.DeleteServiceRequest(&sd.DeleteServiceInput{
+				Id: &id,
+			})
+			_, err := req.Send(ctx)
+			return err
 		})
-		_, err := req.Send(context.Background())
+		result.record(opDeleteService, k, "", err)
+		a.audit("DeleteService", k, id, "", nil, "service no longer in Eureka", err)
 		if err != nil {
-			a.log.Error("cannot remove services", "name", k, "id", s.awsID, "error", err)
+			a.log.Error("cannot remove services", "name", k, "id", id, "error", err)
 		} else {
-			// todo remove service from srtuct
-
-			count++
+			a.deleteService(k)
+			a.notifier.Notify(Event{Type: EventServiceRemoved, Service: k, ServiceID: id,
+				Reason: "service no longer in Eureka"})
 		}
 	}
-	return count
+	return result
 }
 
 func IsClosed(ch <-chan struct{}) bool {
@@ -548,21 +1145,12 @@ func IsClosed(ch <-chan struct{}) bool {
 	return false
 }
 
-func (a *aws) fetchIndefinetely(stop, stopped chan struct{}) {
-	defer close(stopped)
-
-	for {
-		err := a.fetch()
-		if err != nil {
-			a.log.Error("error fetching", "error", err)
-		} else {
-			a.trigger <- true
-		}
-		select {
-		case <-stop:
-			return
-		case <-time.After(a.pullInterval):
-			continue
+func (a *aws) fetchIndefinetely(ctx context.Context, status *Status, force <-chan struct{}, stop <-chan struct{}) {
+	fetchLoop(WorkerAWSFetch, a.log, status, a.pullInterval, a.trigger, force, func() error {
+		if err := a.fetch(ctx); err != nil {
+			return err
 		}
-	}
+		status.fetched(SideAWS, a.getServices())
+		return nil
+	}, stop)
 }
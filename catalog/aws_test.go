@@ -1,24 +1,111 @@
 package catalog
 
 import (
+	"context"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
 	x "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
 	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
-	sdi "github.com/aws/aws-sdk-go-v2/service/servicediscovery/servicediscoveryiface"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
-type mSDClint struct {
-	sdi.ClientAPI
+// fakeCloudMap answers CloudMap requests in memory. Operations without a
+// handler succeed with an empty output.
+type fakeCloudMap struct {
+	lock     sync.Mutex
+	calls    []fakeCall
+	handlers map[string]func(input interface{}) (interface{}, error)
 }
 
-func (m *mSDClint) CreateServiceRequest(input *sd.CreateServiceRequest) (*sd.CreateServiceOutput, error) {
-	return nil, nil
+func newFakeCloudMap() *fakeCloudMap {
+	return &fakeCloudMap{handlers: map[string]func(interface{}) (interface{}, error){}}
 }
 
-func (m *mSDClint) RegisterInstanceRequest(input *sd.RegisterInstanceRequest) (*sd.RegisterInstanceOutput, error) {
-	return nil, nil
+func (f *fakeCloudMap) handle(operation string, h func(input interface{}) (interface{}, error)) {
+	f.lock.Lock()
+	f.handlers[operation] = h
+	f.lock.Unlock()
+}
+
+// inputs returns the inputs of all requests to operation in order.
+func (f *fakeCloudMap) inputs(operation string) []interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := []interface{}{}
+	for _, c := range f.calls {
+		if c.operation == operation {
+			result = append(result, c.input)
+		}
+	}
+	return result
+}
+
+type fakeCall struct {
+	operation string
+	input     interface{}
+}
+
+func (f *fakeCloudMap) send(r *x.Request) {
+	f.lock.Lock()
+	f.calls = append(f.calls, fakeCall{operation: r.Operation.Name, input: r.Params})
+	h := f.handlers[r.Operation.Name]
+	f.lock.Unlock()
+	if h == nil {
+		return
+	}
+	out, err := h(r.Params)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	if out != nil {
+		reflect.ValueOf(r.Data).Elem().Set(reflect.ValueOf(out).Elem())
+	}
+}
+
+func (f *fakeCloudMap) client() *sd.Client {
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.Retryer = x.NoOpRetryer{}
+	c := sd.New(cfg)
+	c.Handlers.Sign.Clear()
+	c.Handlers.Send.Clear()
+	c.Handlers.Send.PushBack(f.send)
+	c.Handlers.UnmarshalMeta.Clear()
+	c.Handlers.ValidateResponse.Clear()
+	c.Handlers.Unmarshal.Clear()
+	c.Handlers.UnmarshalError.Clear()
+	return c
+}
+
+func newTestAWS(f *fakeCloudMap) *aws {
+	client := f.client()
+	operations := newOperationTracker(client, hclog.NewNullLogger())
+	operations.pollInterval = time.Millisecond
+	operations.maxPollInterval = time.Millisecond
+	operations.timeout = 100 * time.Millisecond
+	return &aws{
+		client:      client,
+		log:         hclog.NewNullLogger(),
+		namespace:   namespace{id: "ns-1", name: "example.local"},
+		services:    map[string]service{},
+		dnsTTL:      60,
+		operations:  operations,
+		concurrency: 2,
+		metrics:     nopMetrics{},
+		tracer:      trace.NoopTracer{},
+		auditor:     nopAuditor{},
+		notifier:    nopNotifier{},
+		fetched:     true,
+	}
 }
 
 func TestAWSTransformNodes(t *testing.T) {
@@ -29,6 +116,8 @@ func TestAWSTransformNodes(t *testing.T) {
 		{Id: x.String("three"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.3"}},
 		{Id: x.String("four"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.1", "AWS_INSTANCE_PORT": "2"}},
 		{Id: x.String("five"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.4", "AWS_INSTANCE_PORT": "4", "custom": "aha"}},
+		{Id: x.String("six"), Attributes: map[string]string{"AWS_INSTANCE_IPV6": "2001:db8::1", "AWS_INSTANCE_PORT": "6"}},
+		{Id: x.String("seven"), Attributes: map[string]string{"AWS_INSTANCE_CNAME": "web.example.com"}},
 	}
 	expected := map[string]map[int]node{
 		"1.1.1.1": {
@@ -44,19 +133,280 @@ func TestAWSTransformNodes(t *testing.T) {
 		"1.1.1.4": {
 			4: {port: 4, host: "1.1.1.4", awsID: "five", attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.4", "AWS_INSTANCE_PORT": "4", "custom": "aha"}},
 		},
+		"2001:db8::1": {
+			6: {port: 6, host: "2001:db8::1", awsID: "six", attributes: map[string]string{"AWS_INSTANCE_IPV6": "2001:db8::1", "AWS_INSTANCE_PORT": "6"}},
+		},
+		"web.example.com": {
+			0: {port: 0, host: "web.example.com", awsID: "seven", attributes: map[string]string{"AWS_INSTANCE_CNAME": "web.example.com"}},
+		},
 	}
 	require.Equal(t, expected, a.transformNodes(nodes))
 }
 
+func TestAWSTransformInstanceInfo(t *testing.T) {
+	type variant struct {
+		name     string
+		config   *ServicesConfig
+		node     node
+		health   health
+		expected *_e.InstanceInfo
+	}
+	variants := []variant{
+		{
+			name:   "web",
+			node:   node{port: 8080, host: "1.1.1.1", awsID: "i-1", attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.1", "AWS_INSTANCE_PORT": "8080"}},
+			health: up,
+			expected: &_e.InstanceInfo{
+				App:            "AWS_WEB",
+				HostName:       "1.1.1.1",
+				IpAddr:         "1.1.1.1",
+				InstanceID:     "i-1",
+				Status:         "UP",
+				VipAddress:     "web",
+				HomePageUrl:    "http://1.1.1.1:8080/",
+				StatusPageUrl:  "http://1.1.1.1:8080/info",
+				HealthCheckUrl: "http://1.1.1.1:8080/health",
+				Port:           &_e.Port{Port: 8080, Enabled: true},
+				DataCenterInfo: &_e.DataCenterInfo{Name: "MyOwn", Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"},
+			},
+		},
+		{
+			name:   "web",
+			node:   node{port: 80, host: "", awsID: "i-2", attributes: map[string]string{"AWS_INSTANCE_IPV6": "::1", "AWS_INSTANCE_PORT": "80"}},
+			health: unhealthy,
+			expected: &_e.InstanceInfo{
+				App:            "AWS_WEB",
+				HostName:       "::1",
+				IpAddr:         "::1",
+				InstanceID:     "i-2",
+				Status:         "DOWN",
+				VipAddress:     "web",
+				HomePageUrl:    "http://[::1]:80/",
+				StatusPageUrl:  "http://[::1]:80/info",
+				HealthCheckUrl: "http://[::1]:80/health",
+				Port:           &_e.Port{Port: 80, Enabled: true},
+				DataCenterInfo: &_e.DataCenterInfo{Name: "MyOwn", Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"},
+			},
+		},
+		{
+			name: "api",
+			node: node{port: 9000, host: "10.0.0.1", awsID: "i-3", attributes: map[string]string{
+				"AWS_INSTANCE_IPV4":      "10.0.0.1",
+				"AWS_INSTANCE_PORT":      "9000",
+				"AWS_INIT_HEALTH_STATUS": "HEALTHY",
+				"ECS_CLUSTER_NAME":       "main",
+				"AVAILABILITY_ZONE":      "us-east-1a",
+				"version":                "1.2.3",
+				"secret":                 "hidden",
+			}},
+			health: unknown,
+			config: &ServicesConfig{
+				Defaults: ServiceConfig{Mapping: &InstanceMapping{HealthCheckURL: "http://{{.IP}}:{{.Port}}/ping"}},
+				Services: map[string]ServiceConfig{
+					"api": {Mapping: &InstanceMapping{
+						VIPAddress:        "{{.Name}}.{{index .Attributes \"ECS_CLUSTER_NAME\"}}",
+						HomePageURL:       "https://{{.Host}}/",
+						ExcludeAttributes: []string{"secret"},
+					}},
+				},
+			},
+			expected: &_e.InstanceInfo{
+				App:            "AWS_API",
+				HostName:       "10.0.0.1",
+				IpAddr:         "10.0.0.1",
+				InstanceID:     "i-3",
+				Status:         "UNKNOWN",
+				VipAddress:     "api.main",
+				HomePageUrl:    "https://10.0.0.1/",
+				StatusPageUrl:  "http://10.0.0.1:9000/info",
+				HealthCheckUrl: "http://10.0.0.1:9000/ping",
+				Port:           &_e.Port{Port: 9000, Enabled: true},
+				DataCenterInfo: &_e.DataCenterInfo{
+					Name:  "Amazon",
+					Class: "com.netflix.appinfo.AmazonInfo",
+					Metadata: &_e.DataCenterMetadata{
+						InstanceId:       "i-3",
+						AvailabilityZone: "us-east-1a",
+						LocalIpv4:        "10.0.0.1",
+					},
+				},
+				Metadata: &_e.MetaData{Map: map[string]string{"ecs-cluster-name": "main", "version": "1.2.3"}},
+			},
+		},
+		{
+			name: "s1",
+			node: node{port: 1, host: "1.1.1.1", awsID: "i-4", attributes: map[string]string{
+				"AWS_INSTANCE_IPV4": "1.1.1.1",
+				"AWS_INSTANCE_PORT": "1",
+				"local-ipv4":        "1.1.1.1",
+				"public-ipv4":       "9.9.9.9",
+				"local-hostname":    "s1-private-hostname",
+				"public-hostname":   "s1-public-hostname",
+				"availability-zone": "us-east-1e",
+				"healthCheckUrl":    "s1-healthcheckUrl",
+			}},
+			health: out_of_service,
+			expected: &_e.InstanceInfo{
+				App:            "AWS_S1",
+				HostName:       "s1-private-hostname",
+				IpAddr:         "1.1.1.1",
+				InstanceID:     "i-4",
+				Status:         "OUT_OF_SERVICE",
+				VipAddress:     "s1",
+				HomePageUrl:    "http://s1-private-hostname:1/",
+				StatusPageUrl:  "http://s1-private-hostname:1/info",
+				HealthCheckUrl: "http://s1-private-hostname:1/health",
+				Port:           &_e.Port{Port: 1, Enabled: true},
+				DataCenterInfo: &_e.DataCenterInfo{
+					Name:  "Amazon",
+					Class: "com.netflix.appinfo.AmazonInfo",
+					Metadata: &_e.DataCenterMetadata{
+						InstanceId:       "i-4",
+						AvailabilityZone: "us-east-1e",
+						LocalIpv4:        "1.1.1.1",
+						PublicIpv4:       "9.9.9.9",
+						LocalHostname:    "s1-private-hostname",
+						PublicHostname:   "s1-public-hostname",
+					},
+				},
+			},
+		},
+	}
+
+	for _, v := range variants {
+		a := aws{awsPrefix: "aws_", config: v.config}
+		info, err := a.transformInstanceInfo(v.name, v.node, v.health)
+		require.NoError(t, err)
+		require.Equal(t, v.expected, info)
+	}
+}
+
+func TestAWSInstanceAttributes(t *testing.T) {
+	type variant struct {
+		isHTTP   bool
+		node     node
+		expected map[string]string
+	}
+	variants := []variant{
+		{
+			node:     node{host: "1.1.1.1", port: 80, attributes: map[string]string{"custom": "x"}},
+			expected: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.1", "AWS_INSTANCE_PORT": "80", "custom": "x"},
+		},
+		{
+			node:     node{host: "1.1.1.1", port: 80, attributes: map[string]string{"local-ipv4": "10.0.0.1"}},
+			expected: map[string]string{"AWS_INSTANCE_IPV4": "10.0.0.1", "AWS_INSTANCE_PORT": "80", "local-ipv4": "10.0.0.1"},
+		},
+		{
+			node:     node{host: "2001:db8::1", port: 80},
+			expected: map[string]string{"AWS_INSTANCE_IPV6": "2001:db8::1", "AWS_INSTANCE_PORT": "80"},
+		},
+		{
+			node:     node{host: "web.example.com"},
+			expected: map[string]string{"AWS_INSTANCE_CNAME": "web.example.com"},
+		},
+		{
+			isHTTP:   true,
+			node:     node{host: "web.example.com", port: 80},
+			expected: map[string]string{"hostname": "web.example.com", "AWS_INSTANCE_PORT": "80"},
+		},
+	}
+
+	for _, v := range variants {
+		a := aws{namespace: namespace{isHTTP: v.isHTTP}}
+		require.Equal(t, v.expected, a.instanceAttributes(v.node))
+	}
+
+	// the node's own attributes must not be modified
+	n := node{host: "1.1.1.1", port: 80, attributes: map[string]string{}}
+	(&aws{}).instanceAttributes(n)
+	require.Empty(t, n.attributes)
+}
+
+func TestAWSInstanceAttributesRoundTrip(t *testing.T) {
+	for _, isHTTP := range []bool{false, true} {
+		a := aws{namespace: namespace{isHTTP: isHTTP}}
+		for _, host := range []string{"1.1.1.1", "2001:db8::1", "web.example.com"} {
+			n := node{host: host, port: 80, instanceID: "web-1"}
+			nodes := a.transformNodes([]sd.InstanceSummary{{Id: x.String("web-1"), Attributes: a.instanceAttributes(n)}})
+			require.Contains(t, nodes, host, "http: %v", isHTTP)
+			require.Equal(t, host, nodes[host][80].host)
+
+			// an instance read back is in sync with the one it was registered from
+			eurekaServices := map[string]service{"web": {name: "web", nodes: map[string]map[int]node{host: {80: n}}}}
+			awsServices := map[string]service{"web": {name: "web", nodes: nodes}}
+			require.Empty(t, a.diffToAWS(eurekaServices, awsServices)["web"].nodes, "http: %v, host: %s", isHTTP, host)
+		}
+	}
+}
+
+func TestDNSRecordTypes(t *testing.T) {
+	type variant struct {
+		nodes    map[string]map[int]node
+		expected []sd.RecordType
+	}
+	variants := []variant{
+		{
+			nodes:    map[string]map[int]node{"1.1.1.1": {80: {}}, "1.1.1.2": {80: {}}},
+			expected: []sd.RecordType{sd.RecordTypeSrv},
+		},
+		{
+			nodes:    map[string]map[int]node{"2001:db8::1": {80: {}}},
+			expected: []sd.RecordType{sd.RecordTypeSrv},
+		},
+		{
+			nodes:    map[string]map[int]node{"1.1.1.1": {0: {}}},
+			expected: []sd.RecordType{sd.RecordTypeA},
+		},
+		{
+			nodes:    map[string]map[int]node{"2001:db8::1": {0: {}}},
+			expected: []sd.RecordType{sd.RecordTypeAaaa},
+		},
+		{
+			nodes:    map[string]map[int]node{"web.example.com": {0: {}}, "api.example.com": {443: {}}},
+			expected: []sd.RecordType{sd.RecordTypeCname},
+		},
+		{
+			nodes:    map[string]map[int]node{"1.1.1.1": {0: {}}, "2001:db8::1": {0: {}}},
+			expected: []sd.RecordType{sd.RecordTypeA, sd.RecordTypeAaaa},
+		},
+		{
+			nodes:    map[string]map[int]node{"1.1.1.1": {80: {}}, "2001:db8::1": {0: {}}},
+			expected: []sd.RecordType{sd.RecordTypeA, sd.RecordTypeAaaa},
+		},
+		{
+			nodes:    map[string]map[int]node{"1.1.1.1": {80: {}}, "2001:db8::1": {80: {}}},
+			expected: []sd.RecordType{sd.RecordTypeSrv},
+		},
+	}
+
+	for _, v := range variants {
+		types, err := dnsRecordTypes(v.nodes)
+		require.NoError(t, err)
+		require.Equal(t, v.expected, types)
+	}
+
+	// hostnames and IP addresses can't be mixed, whatever the ports
+	for _, nodes := range []map[string]map[int]node{
+		{"web.example.com": {0: {}}, "1.1.1.1": {0: {}}},
+		{"web.example.com": {80: {}}, "2001:db8::1": {80: {}}},
+	} {
+		_, err := dnsRecordTypes(nodes)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "mixes hostnames and IP addresses")
+	}
+}
+
 func TestAWSTransformServices(t *testing.T) {
 	a := aws{}
 	services := []sd.ServiceSummary{
 		{Id: x.String("one"), Name: x.String("web"), Description: &awsServiceDescription},
 		{Id: x.String("two"), Name: x.String("redis")},
+		{Id: x.String("three"), Name: x.String("api"), Description: x.String("Imported from Eureka: backend")},
 	}
 	expected := map[string]service{
-		"web":   {id: "one", name: "web", awsID: "one", fromEureka: true},
+		"web":   {id: "one", name: "web", awsID: "one", fromEureka: true, description: awsServiceDescription},
 		"redis": {id: "two", name: "redis", awsID: "two", fromEureka: false},
+		"api":   {id: "three", name: "api", awsID: "three", fromEureka: true, description: "Imported from Eureka: backend"},
 	}
 	require.Equal(t, expected, a.transformServices(services))
 }
@@ -68,7 +418,7 @@ func TestAWSTransformNamespace(t *testing.T) {
 		expected  namespace
 	}
 	variants := []variant{
-		{namespace: sd.Namespace{Name: x.String("A"), Id: x.String("1"), Type: sd.NamespaceTypeDnsPublic}, expected: namespace{name: "A", id: "1", isHTTP: false}},
+		{namespace: sd.Namespace{Name: x.String("A"), Id: x.String("1"), Type: sd.NamespaceTypeDnsPublic}, expected: namespace{name: "A", id: "1", isHTTP: false, isPublic: true}},
 		{namespace: sd.Namespace{Name: x.String("B"), Id: x.String("2"), Type: sd.NamespaceTypeHttp}, expected: namespace{name: "B", id: "2", isHTTP: true}},
 	}
 
@@ -76,3 +426,256 @@ func TestAWSTransformNamespace(t *testing.T) {
 		require.Equal(t, v.expected, a.transformNamespace(&v.namespace))
 	}
 }
+
+func TestAWSRemove(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	n1 := node{host: "1.1.1.1", port: 80, awsID: "i-1"}
+	n2 := node{host: "1.1.1.2", port: 80, awsID: "i-2"}
+	n3 := node{host: "1.1.1.3", port: 80, awsID: "i-3"}
+	a.services = map[string]service{
+		"web":   {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.1": {80: n1}, "1.1.1.2": {80: n2}}, healths: map[string]health{"i-1": up, "i-2": up}},
+		"db":    {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.3": {80: n3}}},
+		"redis": {name: "redis", awsID: "srv-3", nodes: map[string]map[int]node{"1.1.1.4": {80: {host: "1.1.1.4", port: 80, awsID: "i-4"}}}},
+	}
+	eurekaServices := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "i-1"}}}},
+	}
+
+	remove := a.diffFromAWS(a.getServices(), eurekaServices)
+	result := a.remove(context.Background(), remove, eurekaServices)
+	require.Equal(t, 1, result.count(opDeleteService))
+	require.Equal(t, 2, result.count(opDeregister))
+	require.Empty(t, result.errors)
+
+	deregistered := []string{}
+	for _, i := range f.inputs("DeregisterInstance") {
+		deregistered = append(deregistered, *i.(*sd.DeregisterInstanceInput).InstanceId)
+	}
+	require.ElementsMatch(t, []string{"i-2", "i-3"}, deregistered)
+	deleted := f.inputs("DeleteService")
+	require.Len(t, deleted, 1)
+	require.Equal(t, "srv-2", *deleted[0].(*sd.DeleteServiceInput).Id)
+
+	web, ok := a.getService("web")
+	require.True(t, ok)
+	require.Equal(t, map[string]map[int]node{"1.1.1.1": {80: n1}}, web.nodes)
+	require.Equal(t, map[string]health{"i-1": up}, web.healths)
+	_, ok = a.getService("db")
+	require.False(t, ok)
+	_, ok = a.getService("redis")
+	require.True(t, ok)
+
+	// nothing is left to remove in the next cycle
+	remove = a.diffFromAWS(a.getServices(), eurekaServices)
+	result = a.remove(context.Background(), remove, eurekaServices)
+	require.Equal(t, 0, result.count(opDeleteService))
+	require.Len(t, f.inputs("DeregisterInstance"), 2)
+}
+
+func TestAWSDiffFromAWS(t *testing.T) {
+	a := newTestAWS(newFakeCloudMap())
+	moved := node{host: "1.1.1.1", port: 80, awsID: "i-1"}
+	replaced := node{host: "1.1.1.2", port: 80, awsID: "i-2"}
+	db := service{name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "i-3"}}}}
+	awsServices := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true,
+			nodes:   map[string]map[int]node{"1.1.1.1": {80: moved}, "1.1.1.2": {80: replaced}},
+			healths: map[string]health{"i-1": healthy, "i-2": healthy}},
+		"db": db,
+	}
+	eurekaServices := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			// i-1 moved to another address, i-4 took over the address of i-2
+			"10.0.0.1": {80: {host: "10.0.0.1", port: 80, instanceID: "i-1"}},
+			"1.1.1.2":  {80: {host: "1.1.1.2", port: 80, instanceID: "i-4"}},
+		}},
+	}
+
+	diff := a.diffFromAWS(awsServices, eurekaServices)
+	require.Equal(t, map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.2": {80: replaced}}},
+		"db":  db,
+	}, diff)
+
+	// nothing is removed once both sides have the same instances
+	eurekaServices["web"].nodes["1.1.1.2"][80] = node{host: "1.1.1.2", port: 80, instanceID: "i-2"}
+	eurekaServices["db"] = service{name: "db", nodes: map[string]map[int]node{"1.1.1.3": {80: {host: "1.1.1.3", port: 80, instanceID: "i-3"}}}}
+	require.Empty(t, a.diffFromAWS(awsServices, eurekaServices))
+}
+
+func TestAWSRemoveKeepsServiceOnFailure(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.services = map[string]service{
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "i-3"}}}},
+	}
+	f.handle("DeregisterInstance", func(input interface{}) (interface{}, error) {
+		return nil, awserr.New(sd.ErrCodeInstanceNotFound, "not found", nil)
+	})
+
+	result := a.remove(context.Background(), a.getServices(), map[string]service{})
+	require.Equal(t, 0, result.count(opDeleteService))
+	require.Len(t, result.errors, 1)
+	require.Equal(t, opDeregister, result.errors[0].kind)
+	require.Equal(t, "i-3", result.errors[0].instance)
+	require.Empty(t, f.inputs("DeleteService"))
+	db, ok := a.getService("db")
+	require.True(t, ok)
+	require.Len(t, db.nodes, 1)
+}
+
+func TestAWSRemoveWaitsForDeregistration(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.services = map[string]service{
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "i-3"}},
+			"1.1.1.4": {80: {host: "1.1.1.4", port: 80, awsID: "i-4"}},
+		}},
+	}
+	f.handle("DeregisterInstance", func(input interface{}) (interface{}, error) {
+		return &sd.DeregisterInstanceOutput{OperationId: x.String("op-" + *input.(*sd.DeregisterInstanceInput).InstanceId)}, nil
+	})
+	status := map[string]sd.OperationStatus{"op-i-3": sd.OperationStatusSuccess, "op-i-4": sd.OperationStatusFail}
+	f.handle("GetOperation", func(input interface{}) (interface{}, error) {
+		id := *input.(*sd.GetOperationInput).OperationId
+		return &sd.GetOperationOutput{Operation: &sd.Operation{Id: &id, Status: status[id]}}, nil
+	})
+
+	result := a.remove(context.Background(), a.getServices(), map[string]service{})
+	require.Equal(t, 0, result.count(opDeleteService))
+	require.Equal(t, 1, result.count(opDeregister))
+	require.Empty(t, f.inputs("DeleteService"))
+	db, _ := a.getService("db")
+	require.Equal(t, map[string]map[int]node{"1.1.1.4": {80: {host: "1.1.1.4", port: 80, awsID: "i-4"}}}, db.nodes)
+
+	status["op-i-4"] = sd.OperationStatusSuccess
+	result = a.remove(context.Background(), a.getServices(), map[string]service{})
+	require.Equal(t, 1, result.count(opDeleteService))
+	require.Len(t, f.inputs("DeleteService"), 1)
+}
+
+func TestAWSCreate(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.services = map[string]service{
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, customHealth: &sd.HealthCheckCustomConfig{}},
+	}
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		name := *input.(*sd.CreateServiceInput).Name
+		if name == "broken" {
+			return nil, awserr.New(sd.ErrCodeInvalidInput, "invalid", nil)
+		}
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: x.String("srv-" + name)}}, nil
+	})
+	var lock sync.Mutex
+	registered := map[string]bool{}
+	f.handle("RegisterInstance", func(input interface{}) (interface{}, error) {
+		i := input.(*sd.RegisterInstanceInput)
+		if *i.InstanceId == "db-2" {
+			return nil, awserr.New(sd.ErrCodeResourceInUse, "in use", nil)
+		}
+		lock.Lock()
+		registered[*i.InstanceId] = true
+		lock.Unlock()
+		return &sd.RegisterInstanceOutput{}, nil
+	})
+	f.handle("UpdateInstanceCustomHealthStatus", func(input interface{}) (interface{}, error) {
+		i := input.(*sd.UpdateInstanceCustomHealthStatusInput)
+		lock.Lock()
+		defer lock.Unlock()
+		if !registered[*i.InstanceId] {
+			return nil, awserr.New(sd.ErrCodeInstanceNotFound, "not found", nil)
+		}
+		return &sd.UpdateInstanceCustomHealthStatusOutput{}, nil
+	})
+
+	services := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+			"1.1.1.2": {80: {host: "1.1.1.2", port: 80, instanceID: "web-2"}},
+			"1.1.1.3": {80: {host: "1.1.1.3", port: 80, instanceID: "web-3"}},
+		}, healths: map[string]health{"web-1": up, "web-2": up, "web-3": out_of_service}},
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.4": {80: {host: "1.1.1.4", port: 80, instanceID: "db-1"}},
+			"1.1.1.5": {80: {host: "1.1.1.5", port: 80, instanceID: "db-2"}},
+		}, healths: map[string]health{"db-1": up}},
+		"broken": {name: "broken", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.6": {80: {host: "1.1.1.6", port: 80, instanceID: "broken-1"}},
+		}},
+		"mixed": {name: "mixed", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.7":           {80: {host: "1.1.1.7", port: 80, instanceID: "mixed-1"}},
+			"mixed.example.com": {80: {host: "mixed.example.com", port: 80, instanceID: "mixed-2"}},
+		}},
+	}
+	result := a.create(context.Background(), services)
+
+	require.Equal(t, 1, result.count(opCreateService))
+	require.Equal(t, 4, result.count(opRegister))
+	require.Equal(t, 4, result.count(opUpdateHealth))
+	require.Len(t, result.errors, 3)
+	require.True(t, result.failed(opCreateService, "broken"))
+	// a service mixing hostnames and IP addresses isn't created
+	require.True(t, result.failed(opCreateService, "mixed"))
+	require.Len(t, f.inputs("CreateService"), 2)
+	require.True(t, result.failed(opRegister, "db"))
+	require.Len(t, f.inputs("RegisterInstance"), 5)
+}
+
+func TestAWSDiffToAWS(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	web1 := node{host: "10.0.0.1", port: 80, instanceID: "web-1", attributes: map[string]string{"local-ipv4": "1.1.1.1"}}
+	web2 := node{host: "10.0.0.2", port: 80, instanceID: "web-2", attributes: map[string]string{"local-ipv4": "1.1.1.2"}}
+	web3 := node{host: "10.0.0.3", port: 80, instanceID: "web-3"}
+	eurekaServices := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"10.0.0.1": {80: web1}, "10.0.0.2": {80: web2}, "10.0.0.3": {80: web3},
+		}, healths: map[string]health{"web-1": healthy, "web-2": unhealthy, "web-3": healthy}},
+		"db": {name: "db", fromEureka: true, nodes: map[string]map[int]node{
+			"10.0.0.4": {80: {host: "10.0.0.4", port: 80, instanceID: "db-1"}},
+		}},
+	}
+	// CloudMap keys the instances by their local-ipv4 and reports healths
+	// of its own
+	changed := a.instanceAttributes(web2)
+	changed["homePageUrl"] = "http://old"
+	a.services = map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, customHealth: &sd.HealthCheckCustomConfig{},
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1", attributes: a.instanceAttributes(web1)}},
+				"1.1.1.2": {80: {host: "1.1.1.2", port: 80, awsID: "web-2", attributes: changed}},
+			}, healths: map[string]health{"web-1": up, "web-2": up}},
+	}
+
+	diff := a.diffToAWS(eurekaServices, a.getServices())
+	require.Equal(t, eurekaServices["db"], diff["db"])
+	web := diff["web"]
+	require.Equal(t, "srv-1", web.awsID)
+	require.Equal(t, map[string]map[int]node{"10.0.0.2": {80: web2}, "10.0.0.3": {80: web3}}, web.nodes)
+	require.Equal(t, map[string]health{"web-2": unhealthy, "web-3": healthy}, web.healths)
+
+	// a health-only change is only a health update
+	a.services["web"].nodes["1.1.1.2"][80] = node{host: "1.1.1.2", port: 80, awsID: "web-2", attributes: a.instanceAttributes(web2)}
+	a.services["web"].nodes["10.0.0.3"] = map[int]node{80: {host: "10.0.0.3", port: 80, awsID: "web-3", attributes: a.instanceAttributes(web3)}}
+	a.services["web"].healths["web-3"] = healthy
+	diff = a.diffToAWS(eurekaServices, a.getServices())
+	require.Nil(t, diff["web"].nodes)
+	require.Equal(t, map[string]health{"web-2": unhealthy}, diff["web"].healths)
+
+	result := a.create(context.Background(), map[string]service{"web": diff["web"]})
+	require.Equal(t, 1, result.count(opUpdateHealth))
+	require.Empty(t, f.inputs("CreateService"))
+	require.Empty(t, f.inputs("RegisterInstance"))
+	require.Len(t, f.inputs("UpdateInstanceCustomHealthStatus"), 1)
+
+	// nothing is left to do once the health was updated
+	diff = a.diffToAWS(eurekaServices, a.getServices())
+	require.NotContains(t, diff, "web")
+
+	// services without custom health never get health updates
+	a.services["web"] = service{name: "web", awsID: "srv-1", fromEureka: true, nodes: a.services["web"].nodes}
+	diff = a.diffToAWS(map[string]service{"web": eurekaServices["web"]}, a.getServices())
+	require.Empty(t, diff)
+}
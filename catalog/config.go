@@ -0,0 +1,394 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+)
+
+// ServicesConfig holds per-service settings for eureka-aws. Settings in
+// Defaults apply to every service that has no entry in Services, and to
+// every field an entry in Services leaves empty.
+type ServicesConfig struct {
+	Defaults ServiceConfig            `json:"defaults"`
+	Services map[string]ServiceConfig `json:"services"`
+
+	// mappings caches the merged and compiled instance mapping per entry in
+	// Services, or for the defaults under "".
+	lock     sync.Mutex
+	mappings map[string]*InstanceMapping
+}
+
+// ServiceConfig holds the settings for a single service. Services are keyed
+// by their name without any prefix in lower case, names are matched
+// regardless of their case.
+type ServiceConfig struct {
+	Description string           `json:"description,omitempty"`
+	Mapping     *InstanceMapping `json:"mapping,omitempty"`
+	DNS         *DNSConfig       `json:"dns,omitempty"`
+	Health      *HealthConfig    `json:"health,omitempty"`
+
+	// Recreate allows deleting and recreating a service whose settings
+	// drifted in a way UpdateService can't fix, such as the health check
+	// type. All its instances are deregistered in the process.
+	Recreate *bool `json:"recreate,omitempty"`
+}
+
+// DNSConfig controls the DNS records of services eureka-aws creates in DNS
+// namespaces. Without RecordTypes the record types are picked from the
+// addresses of the instances, and existing services keep theirs. TTL
+// defaults to -aws-dns-ttl.
+type DNSConfig struct {
+	RecordTypes   []string `json:"recordTypes,omitempty"`
+	RoutingPolicy string   `json:"routingPolicy,omitempty"`
+	TTL           *int64   `json:"ttl,omitempty"`
+}
+
+// Health check modes for services created in CloudMap.
+const (
+	HealthModeCustom  = "custom"
+	HealthModeRoute53 = "route53"
+	HealthModeNone    = "none"
+)
+
+// HealthConfig selects how CloudMap checks the health of a service. The
+// custom mode, which is the default, propagates the Eureka status. The
+// route53 mode lets Route 53 check the instances, which is only possible in
+// public DNS namespaces; Type and ResourcePath are derived from the Eureka
+// healthCheckUrl unless they are set.
+type HealthConfig struct {
+	Mode             string `json:"mode,omitempty"`
+	Type             string `json:"type,omitempty"`
+	ResourcePath     string `json:"resourcePath,omitempty"`
+	FailureThreshold *int64 `json:"failureThreshold,omitempty"`
+}
+
+// InstanceMapping controls how CloudMap instances are translated into
+// Eureka InstanceInfo. The URL fields are text/template strings which are
+// rendered with instanceTemplateData.
+type InstanceMapping struct {
+	VIPAddress        string   `json:"vipAddress,omitempty"`
+	HomePageURL       string   `json:"homePageUrl,omitempty"`
+	StatusPageURL     string   `json:"statusPageUrl,omitempty"`
+	HealthCheckURL    string   `json:"healthCheckUrl,omitempty"`
+	ExcludeAttributes []string `json:"excludeAttributes,omitempty"`
+
+	templates map[string]*template.Template
+}
+
+// instanceTemplateData is passed to the InstanceMapping templates. HostPort
+// is Host and Port joined for URLs, with IPv6 addresses in brackets.
+type instanceTemplateData struct {
+	Name       string
+	App        string
+	IP         string
+	Host       string
+	Port       int
+	HostPort   string
+	InstanceID string
+	Attributes map[string]string
+}
+
+const (
+	defaultVIPAddressTemplate     = "{{.Name}}"
+	defaultHomePageURLTemplate    = "http://{{.HostPort}}/"
+	defaultStatusPageURLTemplate  = "http://{{.HostPort}}/info"
+	defaultHealthCheckURLTemplate = "http://{{.HostPort}}/health"
+)
+
+// LoadServicesConfig reads a JSON services config from path.
+func LoadServicesConfig(path string) (*ServicesConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c ServicesConfig
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("cannot parse services config %s: %s", path, err)
+	}
+	if err := c.normalize(); err != nil {
+		return nil, fmt.Errorf("invalid services config %s: %s", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid services config %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// normalize lower-cases the names of the services.
+func (c *ServicesConfig) normalize() error {
+	services := make(map[string]ServiceConfig, len(c.Services))
+	for name, s := range c.Services {
+		key := strings.ToLower(name)
+		if _, ok := services[key]; ok {
+			return fmt.Errorf("service %s is configured more than once", key)
+		}
+		services[key] = s
+	}
+	c.Services = services
+	return nil
+}
+
+func (c *ServicesConfig) validate() error {
+	if err := c.Defaults.validate(); err != nil {
+		return fmt.Errorf("defaults: %s", err)
+	}
+	for name, s := range c.Services {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (s ServiceConfig) validate() error {
+	if s.Mapping != nil {
+		if _, err := s.Mapping.compile(); err != nil {
+			return err
+		}
+	}
+	if s.DNS != nil {
+		if err := s.DNS.validate(); err != nil {
+			return fmt.Errorf("dns: %s", err)
+		}
+	}
+	if s.Health != nil {
+		if err := s.Health.validate(); err != nil {
+			return fmt.Errorf("health: %s", err)
+		}
+	}
+	return nil
+}
+
+func (h *HealthConfig) validate() error {
+	switch h.Mode {
+	case "", HealthModeCustom, HealthModeRoute53, HealthModeNone:
+	default:
+		return fmt.Errorf("unknown mode %q", h.Mode)
+	}
+	switch sd.HealthCheckType(h.Type) {
+	case "", sd.HealthCheckTypeHttp, sd.HealthCheckTypeHttps, sd.HealthCheckTypeTcp:
+	default:
+		return fmt.Errorf("unknown type %q", h.Type)
+	}
+	if len(h.ResourcePath) > 0 && !strings.HasPrefix(h.ResourcePath, "/") {
+		return fmt.Errorf("resourcePath must start with /")
+	}
+	if h.FailureThreshold != nil && (*h.FailureThreshold < 1 || *h.FailureThreshold > 10) {
+		return fmt.Errorf("failureThreshold must be between 1 and 10")
+	}
+	return nil
+}
+
+func (d *DNSConfig) validate() error {
+	cname := false
+	for _, t := range d.RecordTypes {
+		switch sd.RecordType(t) {
+		case sd.RecordTypeA, sd.RecordTypeAaaa, sd.RecordTypeSrv:
+		case sd.RecordTypeCname:
+			cname = true
+		default:
+			return fmt.Errorf("unknown record type %q", t)
+		}
+	}
+	if cname && len(d.RecordTypes) > 1 {
+		return fmt.Errorf("CNAME records can't be combined with other record types")
+	}
+	switch sd.RoutingPolicy(d.RoutingPolicy) {
+	case "", sd.RoutingPolicyWeighted:
+	case sd.RoutingPolicyMultivalue:
+		if cname {
+			return fmt.Errorf("CNAME records require the WEIGHTED routing policy")
+		}
+	default:
+		return fmt.Errorf("unknown routing policy %q", d.RoutingPolicy)
+	}
+	if d.TTL != nil && *d.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	return nil
+}
+
+// forService returns the settings for the named service with the defaults
+// filled in. It is safe to call on a nil config.
+func (c *ServicesConfig) forService(name string) ServiceConfig {
+	if c == nil {
+		return ServiceConfig{Mapping: builtinInstanceMapping, DNS: &DNSConfig{}, Health: mergeHealthConfig(nil, nil)}
+	}
+	key := strings.ToLower(name)
+	s, ok := c.Services[key]
+	if !ok {
+		key = ""
+	}
+	if len(s.Description) == 0 {
+		s.Description = c.Defaults.Description
+	}
+	if s.Recreate == nil {
+		s.Recreate = c.Defaults.Recreate
+	}
+	s.Mapping = c.instanceMapping(key, s.Mapping)
+	s.DNS = mergeDNSConfig(s.DNS, c.Defaults.DNS)
+	s.Health = mergeHealthConfig(s.Health, c.Defaults.Health)
+	return s
+}
+
+func mergeHealthConfig(h, defaults *HealthConfig) *HealthConfig {
+	result := &HealthConfig{Mode: HealthModeCustom}
+	for _, src := range []*HealthConfig{defaults, h} {
+		if src == nil {
+			continue
+		}
+		if len(src.Mode) > 0 {
+			result.Mode = src.Mode
+		}
+		if len(src.Type) > 0 {
+			result.Type = src.Type
+		}
+		if len(src.ResourcePath) > 0 {
+			result.ResourcePath = src.ResourcePath
+		}
+		if src.FailureThreshold != nil {
+			result.FailureThreshold = src.FailureThreshold
+		}
+	}
+	return result
+}
+
+func mergeDNSConfig(d, defaults *DNSConfig) *DNSConfig {
+	result := &DNSConfig{}
+	for _, src := range []*DNSConfig{defaults, d} {
+		if src == nil {
+			continue
+		}
+		if len(src.RecordTypes) > 0 {
+			result.RecordTypes = src.RecordTypes
+		}
+		if len(src.RoutingPolicy) > 0 {
+			result.RoutingPolicy = src.RoutingPolicy
+		}
+		if src.TTL != nil {
+			result.TTL = src.TTL
+		}
+	}
+	return result
+}
+
+// instanceMapping returns the mapping m merged with the defaults, which is
+// merged and compiled once per key so the templates aren't parsed for every
+// instance.
+func (c *ServicesConfig) instanceMapping(key string, m *InstanceMapping) *InstanceMapping {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached, ok := c.mappings[key]; ok {
+		return cached
+	}
+	merged := mergeInstanceMapping(m, c.Defaults.Mapping)
+	// invalid templates are reported by render
+	merged.compile()
+	if c.mappings == nil {
+		c.mappings = map[string]*InstanceMapping{}
+	}
+	c.mappings[key] = merged
+	return merged
+}
+
+// builtinInstanceMapping is the compiled mapping of services without config.
+var builtinInstanceMapping = func() *InstanceMapping {
+	m := defaultInstanceMapping()
+	m.compile()
+	return m
+}()
+
+func defaultInstanceMapping() *InstanceMapping {
+	return &InstanceMapping{
+		VIPAddress:     defaultVIPAddressTemplate,
+		HomePageURL:    defaultHomePageURLTemplate,
+		StatusPageURL:  defaultStatusPageURLTemplate,
+		HealthCheckURL: defaultHealthCheckURLTemplate,
+	}
+}
+
+// mergeInstanceMapping fills the empty fields of m from defaults and then
+// from the built-in defaults.
+func mergeInstanceMapping(m, defaults *InstanceMapping) *InstanceMapping {
+	result := defaultInstanceMapping()
+	for _, src := range []*InstanceMapping{defaults, m} {
+		if src == nil {
+			continue
+		}
+		if len(src.VIPAddress) > 0 {
+			result.VIPAddress = src.VIPAddress
+		}
+		if len(src.HomePageURL) > 0 {
+			result.HomePageURL = src.HomePageURL
+		}
+		if len(src.StatusPageURL) > 0 {
+			result.StatusPageURL = src.StatusPageURL
+		}
+		if len(src.HealthCheckURL) > 0 {
+			result.HealthCheckURL = src.HealthCheckURL
+		}
+		if src.ExcludeAttributes != nil {
+			result.ExcludeAttributes = src.ExcludeAttributes
+		}
+	}
+	return result
+}
+
+func (m *InstanceMapping) compile() (map[string]*template.Template, error) {
+	if m.templates != nil {
+		return m.templates, nil
+	}
+	templates := map[string]*template.Template{}
+	for k, v := range map[string]string{
+		"vipAddress":     m.VIPAddress,
+		"homePageUrl":    m.HomePageURL,
+		"statusPageUrl":  m.StatusPageURL,
+		"healthCheckUrl": m.HealthCheckURL,
+	} {
+		if len(v) == 0 {
+			continue
+		}
+		t, err := template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s template: %s", k, err)
+		}
+		templates[k] = t
+	}
+	m.templates = templates
+	return templates, nil
+}
+
+func (m *InstanceMapping) render(key string, data instanceTemplateData) (string, error) {
+	templates, err := m.compile()
+	if err != nil {
+		return "", err
+	}
+	t, ok := templates[key]
+	if !ok {
+		return "", nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot render %s: %s", key, err)
+	}
+	return b.String(), nil
+}
+
+func (m *InstanceMapping) excludes(attribute string) bool {
+	for _, a := range m.ExcludeAttributes {
+		if a == attribute {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "services-config")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestLoadServicesConfig(t *testing.T) {
+	type variant struct {
+		content string
+		err     bool
+	}
+	variants := []variant{
+		{content: `{}`},
+		{content: `{"defaults": {"mapping": {"vipAddress": "{{.Name}}"}}, "services": {"web": {"mapping": {"homePageUrl": "https://{{.Host}}/"}}}}`},
+		{content: `{"defaults": {"mapping": {"vipAddress": "{{.Name"}}}`, err: true},
+		{content: `{"unknown": true}`, err: true},
+		{content: `{"defaults": {"dns": {"recordTypes": ["A", "SRV"], "routingPolicy": "WEIGHTED", "ttl": 10}}}`},
+		{content: `{"defaults": {"dns": {"recordTypes": ["MX"]}}}`, err: true},
+		{content: `{"defaults": {"dns": {"recordTypes": ["CNAME", "A"]}}}`, err: true},
+		{content: `{"defaults": {"dns": {"recordTypes": ["CNAME"], "routingPolicy": "MULTIVALUE"}}}`, err: true},
+		{content: `{"defaults": {"dns": {"routingPolicy": "RANDOM"}}}`, err: true},
+		{content: `{"defaults": {"dns": {"ttl": -1}}}`, err: true},
+		{content: `{"services": {"web": {"health": {"mode": "route53", "type": "HTTPS", "resourcePath": "/health", "failureThreshold": 3}}}}`},
+		{content: `{"services": {"web": {"health": {"mode": "dns"}}}}`, err: true},
+		{content: `{"services": {"web": {"health": {"type": "UDP"}}}}`, err: true},
+		{content: `{"services": {"web": {"health": {"resourcePath": "health"}}}}`, err: true},
+		{content: `{"services": {"web": {"health": {"failureThreshold": 11}}}}`, err: true},
+		{content: `{"defaults": {"description": "synced", "recreate": true}}`},
+		{content: `{"services": {"web": {"description": "one"}, "WEB": {"description": "two"}}}`, err: true},
+		{content: `{`, err: true},
+	}
+
+	for _, v := range variants {
+		path := writeConfig(t, v.content)
+		defer os.Remove(path)
+		_, err := LoadServicesConfig(path)
+		if v.err {
+			require.Error(t, err, v.content)
+		} else {
+			require.NoError(t, err, v.content)
+		}
+	}
+}
+
+func TestServicesConfigForService(t *testing.T) {
+	var c *ServicesConfig
+	m := c.forService("web").Mapping
+	require.Equal(t, defaultHomePageURLTemplate, m.HomePageURL)
+	require.NotNil(t, m.templates)
+
+	path := writeConfig(t, `{"defaults": {"mapping": {"vipAddress": "default"}}, "services": {"Web": {"mapping": {"homePageUrl": "web"}}}}`)
+	defer os.Remove(path)
+	c, err := LoadServicesConfig(path)
+	require.NoError(t, err)
+	require.Contains(t, c.Services, "web")
+
+	m = c.forService("WEB").Mapping
+	require.Equal(t, "default", m.VIPAddress)
+	require.Equal(t, "web", m.HomePageURL)
+	require.Equal(t, defaultHealthCheckURLTemplate, m.HealthCheckURL)
+	// the compiled mapping is reused
+	require.NotNil(t, m.templates)
+	require.True(t, m == c.forService("web").Mapping)
+
+	m = c.forService("other").Mapping
+	require.Equal(t, "default", m.VIPAddress)
+	require.Equal(t, defaultHomePageURLTemplate, m.HomePageURL)
+	require.True(t, m == c.forService("another").Mapping)
+}
@@ -0,0 +1,113 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Directions of the sync.
+const (
+	DirectionToAWS    = "to-aws"
+	DirectionToEureka = "to-eureka"
+)
+
+// maxQueuedReconciles is the number of forced reconciles that can wait for
+// the sync to AWS.
+const maxQueuedReconciles = 16
+
+var (
+	// ErrPaused is returned when forcing a reconcile of a paused direction.
+	ErrPaused = errors.New("sync is paused")
+	// ErrBusy is returned when too many reconciles are queued already.
+	ErrBusy = errors.New("too many reconciles queued")
+)
+
+// Control pauses, resumes and forces fetches and reconciles of a running
+// Sync. It is safe for concurrent use.
+type Control struct {
+	lock      sync.RWMutex
+	paused    map[string]bool
+	fetch     map[string]chan struct{}
+	reconcile chan string
+}
+
+// NewControl returns a Control to pass to WithControl.
+func NewControl() *Control {
+	return &Control{
+		paused: map[string]bool{},
+		fetch: map[string]chan struct{}{
+			SideAWS:    make(chan struct{}, 1),
+			SideEureka: make(chan struct{}, 1),
+		},
+		reconcile: make(chan string, maxQueuedReconciles),
+	}
+}
+
+func checkDirection(direction string) error {
+	switch direction {
+	case DirectionToAWS, DirectionToEureka:
+		return nil
+	}
+	return fmt.Errorf("unknown direction %q", direction)
+}
+
+// Pause stops syncing in direction until it is resumed. Fetching goes on.
+func (c *Control) Pause(direction string) error {
+	return c.setPaused(direction, true)
+}
+
+// Resume continues syncing in direction.
+func (c *Control) Resume(direction string) error {
+	return c.setPaused(direction, false)
+}
+
+func (c *Control) setPaused(direction string, paused bool) error {
+	if err := checkDirection(direction); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused[direction] = paused
+	return nil
+}
+
+// Paused reports whether direction is paused.
+func (c *Control) Paused(direction string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.paused[direction]
+}
+
+// PausedDirections returns the pause state of both directions.
+func (c *Control) PausedDirections() map[string]bool {
+	return map[string]bool{
+		DirectionToAWS:    c.Paused(DirectionToAWS),
+		DirectionToEureka: c.Paused(DirectionToEureka),
+	}
+}
+
+// Fetch fetches both sides right away instead of waiting for the poll
+// interval. A sync follows every successful fetch as usual.
+func (c *Control) Fetch() {
+	for _, ch := range c.fetch {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Reconcile syncs service, or all services if it is empty, to AWS right away
+// using the last fetched state of both sides.
+func (c *Control) Reconcile(service string) error {
+	if c.Paused(DirectionToAWS) {
+		return ErrPaused
+	}
+	select {
+	case c.reconcile <- service:
+		return nil
+	default:
+		return ErrBusy
+	}
+}
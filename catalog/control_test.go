@@ -0,0 +1,29 @@
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControl(t *testing.T) {
+	c := NewControl()
+	require.Error(t, c.Pause("sideways"))
+	require.NoError(t, c.Pause(DirectionToEureka))
+	require.Equal(t, map[string]bool{DirectionToAWS: false, DirectionToEureka: true}, c.PausedDirections())
+	require.NoError(t, c.Resume(DirectionToEureka))
+	require.False(t, c.Paused(DirectionToEureka))
+
+	// forced fetches are coalesced and never block
+	c.Fetch()
+	c.Fetch()
+	require.Len(t, c.fetch[SideAWS], 1)
+	require.Len(t, c.fetch[SideEureka], 1)
+
+	for i := 0; i < maxQueuedReconciles; i++ {
+		require.NoError(t, c.Reconcile("web"))
+	}
+	require.Equal(t, ErrBusy, c.Reconcile(""))
+	require.NoError(t, c.Pause(DirectionToAWS))
+	require.Equal(t, ErrPaused, c.Reconcile(""))
+}
@@ -0,0 +1,64 @@
+package catalog
+
+import (
+	"fmt"
+)
+
+// deletionGuard holds back the removals of a sync that would delete more
+// owned services than allowed, for example because Eureka returned only part
+// of its services. It is only used by the sync to AWS. A nil deletionGuard
+// allows every deletion.
+type deletionGuard struct {
+	// max is the number and fraction of the owned services a sync may
+	// delete, 0 for no limit.
+	max      int
+	fraction float64
+	// held is set while removals are held back, so that they are only
+	// notified once.
+	held bool
+}
+
+func newDeletionGuard(max int, fraction float64) *deletionGuard {
+	if max <= 0 && fraction <= 0 {
+		return nil
+	}
+	return &deletionGuard{max: max, fraction: fraction}
+}
+
+// check returns why remove and recreate must be held back, or an empty
+// string if they may run, and whether they are held back for the first time
+// in a row. Recreated services are deleted first, so they count as
+// deletions. owned are all services in CloudMap, of which the ones imported
+// from Eureka count as owned.
+func (g *deletionGuard) check(remove map[string]service, recreate map[string]string, eurekaServices, owned map[string]service) (string, bool) {
+	if g == nil {
+		return "", false
+	}
+	deletions := 0
+	for k, s := range remove {
+		if _, ok := eurekaServices[k]; !ok && s.fromEureka && len(s.awsID) > 0 {
+			deletions++
+		}
+	}
+	for k := range recreate {
+		if s, ok := owned[k]; ok && s.fromEureka && len(s.awsID) > 0 {
+			deletions++
+		}
+	}
+	total := 0
+	for _, s := range owned {
+		if s.fromEureka && len(s.awsID) > 0 {
+			total++
+		}
+	}
+	reason := ""
+	switch {
+	case g.max > 0 && deletions > g.max:
+		reason = fmt.Sprintf("%d of %d owned services would be deleted, more than %d", deletions, total, g.max)
+	case g.fraction > 0 && float64(deletions) > g.fraction*float64(total):
+		reason = fmt.Sprintf("%d of %d owned services would be deleted, more than %g%%", deletions, total, g.fraction*100)
+	}
+	first := len(reason) > 0 && !g.held
+	g.held = len(reason) > 0
+	return reason, first
+}
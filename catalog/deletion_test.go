@@ -0,0 +1,45 @@
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletionGuard(t *testing.T) {
+	owned := map[string]service{
+		"api": {name: "api", fromEureka: true, awsID: "srv-api"},
+		"db":  {name: "db", fromEureka: true, awsID: "srv-db"},
+		"web": {name: "web", fromEureka: true, awsID: "srv-web"},
+		"ext": {name: "ext", awsID: "srv-ext"},
+	}
+	eurekaServices := map[string]service{"api": owned["api"]}
+	remove := map[string]service{"db": owned["db"], "web": owned["web"], "ext": owned["ext"]}
+
+	require.Nil(t, newDeletionGuard(0, 0))
+	reason, first := (*deletionGuard)(nil).check(remove, nil, eurekaServices, owned)
+	require.Empty(t, reason)
+	require.False(t, first)
+
+	// services that aren't owned don't count
+	g := newDeletionGuard(2, 0)
+	reason, _ = g.check(remove, nil, eurekaServices, owned)
+	require.Empty(t, reason)
+
+	g = newDeletionGuard(1, 0)
+	reason, first = g.check(remove, nil, eurekaServices, owned)
+	require.Equal(t, "2 of 3 owned services would be deleted, more than 1", reason)
+	require.True(t, first)
+	_, first = g.check(remove, nil, eurekaServices, owned)
+	require.False(t, first)
+
+	// removing instances of services still in Eureka is not a deletion
+	g = newDeletionGuard(0, 0.1)
+	reason, _ = g.check(map[string]service{"api": owned["api"]}, nil, eurekaServices, owned)
+	require.Empty(t, reason)
+
+	// recreating a service deletes it first
+	g = newDeletionGuard(1, 0)
+	reason, _ = g.check(map[string]service{"db": owned["db"]}, map[string]string{"api": "drift"}, eurekaServices, owned)
+	require.Equal(t, "2 of 3 owned services would be deleted, more than 1", reason)
+}
@@ -0,0 +1,95 @@
+package catalog
+
+import (
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+)
+
+// dnsConfig returns the DnsConfig to create the named service with.
+func (a *aws) dnsConfig(name string, nodes map[string]map[int]node) (*sd.DnsConfig, error) {
+	c := a.config.forService(name).DNS
+	types, err := dnsRecordTypes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.RecordTypes) > 0 {
+		types = nil
+		for _, t := range c.RecordTypes {
+			types = append(types, sd.RecordType(t))
+		}
+	}
+
+	dns := &sd.DnsConfig{
+		DnsRecords:    a.dnsRecords(c, types),
+		RoutingPolicy: sd.RoutingPolicy(c.RoutingPolicy),
+	}
+	if len(dns.RoutingPolicy) == 0 && len(types) == 1 && types[0] == sd.RecordTypeCname {
+		dns.RoutingPolicy = sd.RoutingPolicyWeighted
+	}
+	return dns, nil
+}
+
+func (a *aws) dnsRecords(c *DNSConfig, types []sd.RecordType) []sd.DnsRecord {
+	ttl := a.dnsTTL
+	if c.TTL != nil {
+		ttl = *c.TTL
+	}
+	records := make([]sd.DnsRecord, 0, len(types))
+	for _, t := range types {
+		records = append(records, sd.DnsRecord{TTL: &ttl, Type: t})
+	}
+	return records
+}
+
+// dnsConfigChange compares the DnsConfig of an existing service with the
+// configured one. Record types are only compared when they are configured,
+// otherwise the service keeps its records and only the TTL is updated. The
+// routing policy can't be changed with UpdateService, so a drifted policy is
+// reported separately.
+func (a *aws) dnsConfigChange(name string, current *sd.DnsConfig) (change *sd.DnsConfigChange, policyDrift bool) {
+	if current == nil {
+		return nil, false
+	}
+	c := a.config.forService(name).DNS
+
+	var types []sd.RecordType
+	if len(c.RecordTypes) > 0 {
+		for _, t := range c.RecordTypes {
+			types = append(types, sd.RecordType(t))
+		}
+	} else {
+		for _, r := range current.DnsRecords {
+			types = append(types, r.Type)
+		}
+	}
+	desired := a.dnsRecords(c, types)
+
+	policyDrift = len(c.RoutingPolicy) > 0 && sd.RoutingPolicy(c.RoutingPolicy) != current.RoutingPolicy
+	if dnsRecordsEqual(desired, current.DnsRecords) {
+		return nil, policyDrift
+	}
+	return &sd.DnsConfigChange{DnsRecords: desired}, policyDrift
+}
+
+func dnsRecordsEqual(a, b []sd.DnsRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ttls := map[sd.RecordType]int64{}
+	for _, r := range a {
+		ttls[r.Type] = recordTTL(r)
+	}
+	for _, r := range b {
+		ttl, ok := ttls[r.Type]
+		if !ok || ttl != recordTTL(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func recordTTL(r sd.DnsRecord) int64 {
+	if r.TTL == nil {
+		return 0
+	}
+	return *r.TTL
+}
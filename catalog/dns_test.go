@@ -0,0 +1,99 @@
+package catalog
+
+import (
+	"testing"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSDNSConfig(t *testing.T) {
+	type variant struct {
+		config   *ServicesConfig
+		nodes    map[string]map[int]node
+		expected *sd.DnsConfig
+	}
+	variants := []variant{
+		{
+			nodes: map[string]map[int]node{"1.1.1.1": {80: {}}},
+			expected: &sd.DnsConfig{
+				DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}},
+			},
+		},
+		{
+			nodes: map[string]map[int]node{"web.example.com": {80: {}}},
+			expected: &sd.DnsConfig{
+				DnsRecords:    []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeCname}},
+				RoutingPolicy: sd.RoutingPolicyWeighted,
+			},
+		},
+		{
+			config: &ServicesConfig{
+				Defaults: ServiceConfig{DNS: &DNSConfig{RecordTypes: []string{"A", "SRV"}, TTL: x.Int64(10)}},
+			},
+			nodes: map[string]map[int]node{"1.1.1.1": {80: {}}},
+			expected: &sd.DnsConfig{
+				DnsRecords: []sd.DnsRecord{{TTL: x.Int64(10), Type: sd.RecordTypeA}, {TTL: x.Int64(10), Type: sd.RecordTypeSrv}},
+			},
+		},
+		{
+			config: &ServicesConfig{
+				Defaults: ServiceConfig{DNS: &DNSConfig{RecordTypes: []string{"A"}, TTL: x.Int64(10)}},
+				Services: map[string]ServiceConfig{"web": {DNS: &DNSConfig{RoutingPolicy: "WEIGHTED"}}},
+			},
+			nodes: map[string]map[int]node{"1.1.1.1": {80: {}}},
+			expected: &sd.DnsConfig{
+				DnsRecords:    []sd.DnsRecord{{TTL: x.Int64(10), Type: sd.RecordTypeA}},
+				RoutingPolicy: sd.RoutingPolicyWeighted,
+			},
+		},
+	}
+
+	for _, v := range variants {
+		a := aws{dnsTTL: 60, config: v.config}
+		dns, err := a.dnsConfig("web", v.nodes)
+		require.NoError(t, err)
+		require.Equal(t, v.expected, dns)
+	}
+
+	// hostnames and IP addresses can't be served by one service
+	a := aws{dnsTTL: 60}
+	_, err := a.dnsConfig("web", map[string]map[int]node{"web.example.com": {80: {}}, "1.1.1.1": {80: {}}})
+	require.EqualError(t, err, "service mixes hostnames and IP addresses, such as web.example.com and 1.1.1.1, which CloudMap can't serve with one record type")
+}
+
+func TestAWSDNSConfigChange(t *testing.T) {
+	type variant struct {
+		config      *ServicesConfig
+		current     *sd.DnsConfig
+		expected    *sd.DnsConfigChange
+		policyDrift bool
+	}
+	srv60 := &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}, RoutingPolicy: sd.RoutingPolicyMultivalue}
+	variants := []variant{
+		{current: nil},
+		{current: srv60},
+		{
+			current:  &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(300), Type: sd.RecordTypeSrv}}},
+			expected: &sd.DnsConfigChange{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}},
+		},
+		{
+			config:   &ServicesConfig{Defaults: ServiceConfig{DNS: &DNSConfig{RecordTypes: []string{"A", "SRV"}}}},
+			current:  srv60,
+			expected: &sd.DnsConfigChange{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeA}, {TTL: x.Int64(60), Type: sd.RecordTypeSrv}}},
+		},
+		{
+			config:      &ServicesConfig{Services: map[string]ServiceConfig{"web": {DNS: &DNSConfig{RoutingPolicy: "WEIGHTED"}}}},
+			current:     srv60,
+			policyDrift: true,
+		},
+	}
+
+	for _, v := range variants {
+		a := aws{dnsTTL: 60, config: v.config}
+		change, policyDrift := a.dnsConfigChange("web", v.current)
+		require.Equal(t, v.expected, change)
+		require.Equal(t, v.policyDrift, policyDrift)
+	}
+}
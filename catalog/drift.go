@@ -0,0 +1,265 @@
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// serviceDrift is the difference between an existing CloudMap service and
+// its configuration. change holds the update for the fields UpdateService
+// can modify, immutable names the fields that require recreating the
+// service.
+type serviceDrift struct {
+	change    *sd.ServiceChange
+	immutable []string
+}
+
+func (d serviceDrift) empty() bool {
+	return d.change == nil && len(d.immutable) == 0
+}
+
+// serviceDescription returns the description for the named service. It
+// always starts with awsServiceDescription which marks services owned by
+// eureka-aws.
+func (a *aws) serviceDescription(name string) string {
+	if d := a.config.forService(name).Description; len(d) > 0 {
+		return awsServiceDescription + ": " + d
+	}
+	return awsServiceDescription
+}
+
+// detectDrift compares current with the configuration of the named service.
+// UpdateService replaces the DNS records and the Route 53 health check, so
+// the change carries the current values of everything that didn't drift.
+// Services in HTTP namespaces have no DnsConfig, which UpdateService
+// requires, so only immutable drift is reported for them.
+func (a *aws) detectDrift(name string, current *sd.Service, nodes map[string]map[int]node) serviceDrift {
+	d := serviceDrift{}
+	changed := false
+	change := &sd.ServiceChange{
+		Description:       current.Description,
+		HealthCheckConfig: current.HealthCheckConfig,
+	}
+
+	if desc := a.serviceDescription(name); x.StringValue(current.Description) != desc {
+		change.Description = &desc
+		changed = true
+	}
+
+	if current.DnsConfig != nil {
+		dnsChange, policyDrift := a.dnsConfigChange(name, current.DnsConfig)
+		if policyDrift {
+			d.immutable = append(d.immutable, "routing policy")
+		}
+		if dnsChange != nil {
+			change.DnsConfig = dnsChange
+			changed = true
+		} else {
+			change.DnsConfig = &sd.DnsConfigChange{DnsRecords: current.DnsConfig.DnsRecords}
+		}
+	}
+
+	hc, custom := a.healthCheckConfig(name, nodes, current.DnsConfig)
+	// The failure threshold of custom health checks is deprecated, CloudMap
+	// returns 1 whatever it was created with, so only their presence counts.
+	switch {
+	case (custom != nil) != (current.HealthCheckCustomConfig != nil):
+		d.immutable = append(d.immutable, "health check type")
+	case custom == nil && !healthCheckConfigEqual(hc, current.HealthCheckConfig):
+		change.HealthCheckConfig = hc
+		changed = true
+	}
+
+	if changed && change.DnsConfig != nil {
+		d.change = change
+	}
+	return d
+}
+
+// healthCheckConfigEqual compares Route 53 health checks. Fields left empty in
+// desired fall back to CloudMap defaults and aren't compared.
+func healthCheckConfigEqual(desired, current *sd.HealthCheckConfig) bool {
+	if desired == nil || current == nil {
+		return desired == nil && current == nil
+	}
+	if desired.Type != current.Type {
+		return false
+	}
+	if desired.ResourcePath != nil && *desired.ResourcePath != x.StringValue(current.ResourcePath) {
+		return false
+	}
+	if desired.FailureThreshold != nil && *desired.FailureThreshold != x.Int64Value(current.FailureThreshold) {
+		return false
+	}
+	return true
+}
+
+func (a *aws) fetchService(ctx context.Context, id string) (*sd.Service, error) {
+	var resp *sd.GetServiceResponse
+	err := a.retry(ctx, "GetService", func(ctx context.Context) (err error) {
+		req := a.client.GetServiceRequest(&sd.GetServiceInput{Id: &id})
+		resp, err = req.Send(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Service, nil
+}
+
+// reconcile brings existing services imported from Eureka in line with their
+// configuration. Drift is detected on the cached ListServices output first
+// and confirmed with GetService before anything is changed. Services cached
+// without their configuration wait for the next fetch. Updated services are
+// counted as opUpdateService. Services that can only be fixed by recreating
+// them are returned with the reason instead, as recreating deletes them and
+// has to pass the same checks as other deletions.
+func (a *aws) reconcile(ctx context.Context, services map[string]service) (result syncResult, recreate map[string]string) {
+	ctx, span := a.tracer.Start(ctx, "aws.reconcile", trace.WithAttributes(kv.Int("services", len(services))))
+	spans := newServiceSpans(ctx, a.tracer, "aws.reconcile.service")
+	defer func() {
+		spans.end(result)
+		span.End()
+	}()
+	result = newSyncResult()
+	recreate = map[string]string{}
+	names := make([]string, 0, len(services))
+	for k := range services {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		s, ok := a.getService(k)
+		if !ok || !s.fromEureka || s.partial || len(s.awsID) == 0 {
+			continue
+		}
+		cached := &sd.Service{
+			Description:             x.String(s.description),
+			DnsConfig:               s.dnsConfig,
+			HealthCheckConfig:       s.healthCheck,
+			HealthCheckCustomConfig: s.customHealth,
+		}
+		if a.detectDrift(k, cached, services[k].nodes).empty() {
+			continue
+		}
+		ctx := spans.start(k)
+
+		current, err := a.fetchService(ctx, s.awsID)
+		if err != nil {
+			result.record(opUpdateService, k, "", err)
+			a.log.Error("cannot get service", "name", k, "id", s.awsID, "error", err)
+			continue
+		}
+		d := a.detectDrift(k, current, services[k].nodes)
+
+		if len(d.immutable) > 0 {
+			fields := strings.Join(d.immutable, ", ")
+			if r := a.config.forService(k).Recreate; r != nil && *r {
+				recreate[k] = "service differs from config in fields that can't be updated: " + fields
+				continue
+			}
+			a.warnOnce("immutable-drift/"+k+"/"+fields,
+				"service differs from config in fields that can't be updated, enable recreate to fix",
+				"name", k, "id", s.awsID, "fields", fields)
+		}
+		if d.change == nil {
+			continue
+		}
+
+		var resp *sd.UpdateServiceResponse
+		err = a.retry(ctx, "UpdateService", func(ctx context.Context) (err error) {
+			req := a.client.UpdateServiceRequest(&sd.UpdateServiceInput{
+				Id:      &s.awsID,
+				Service: d.change,
+			})
+			resp, err = req.Send(ctx)
+			return err
+		})
+		if err == nil {
+			err = a.operations.track(ctx, "update", s.awsID, "", resp.OperationId)
+		}
+		a.audit("UpdateService", k, s.awsID, "", nil, "service differs from config", err)
+		result.record(opUpdateService, k, "", err)
+		if err != nil {
+			a.log.Error("cannot update service", "name", k, "id", s.awsID, "error", err)
+			continue
+		}
+		a.log.Info("Updated service", "name", k, "id", s.awsID)
+		a.updateService(k, func(s *service) {
+			s.description = x.StringValue(d.change.Description)
+			s.dnsConfig = &sd.DnsConfig{DnsRecords: d.change.DnsConfig.DnsRecords, RoutingPolicy: current.DnsConfig.RoutingPolicy}
+			s.healthCheck = d.change.HealthCheckConfig
+		})
+	}
+	return result, recreate
+}
+
+// recreateAll recreates the services in recreate, which maps their names to
+// the reason. Each recreation counts as opUpdateService.
+func (a *aws) recreateAll(ctx context.Context, recreate map[string]string) syncResult {
+	result := newSyncResult()
+	names := make([]string, 0, len(recreate))
+	for k := range recreate {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		s, ok := a.getService(k)
+		if !ok {
+			continue
+		}
+		err := a.recreate(ctx, k, s.awsID, recreate[k])
+		result.record(opUpdateService, k, "", err)
+		if err != nil {
+			a.log.Error("cannot recreate service", "name", k, "id", s.awsID, "error", err)
+		}
+	}
+	return result
+}
+
+// recreate deregisters all instances of a service and deletes it. The next
+// sync creates it again with the current configuration.
+func (a *aws) recreate(ctx context.Context, name, id, reason string) error {
+	a.log.Warn("recreating service", "name", name, "id", id)
+	instances, err := a.fetchNodes(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		var resp *sd.DeregisterInstanceResponse
+		err := a.retry(ctx, "DeregisterInstance", func(ctx context.Context) (err error) {
+			req := a.client.DeregisterInstanceRequest(&sd.DeregisterInstanceInput{
+				ServiceId:  &id,
+				InstanceId: i.Id,
+			})
+			resp, err = req.Send(ctx)
+			return err
+		})
+		if err == nil {
+			err = a.operations.track(ctx, "deregister", id, *i.Id, resp.OperationId)
+		}
+		a.audit("DeregisterInstance", name, id, *i.Id, nil, reason, err)
+		if err != nil {
+			return err
+		}
+	}
+	err = a.retry(ctx, "DeleteService", func(ctx context.Context) error {
+		req := a.client.DeleteServiceRequest(&sd.DeleteServiceInput{Id: &id})
+		_, err := req.Send(ctx)
+		return err
+	})
+	a.audit("DeleteService", name, id, "", nil, reason, err)
+	if err != nil {
+		return err
+	}
+	a.deleteService(name)
+	a.notifier.Notify(Event{Type: EventServiceRemoved, Service: name, ServiceID: id, Reason: reason})
+	return nil
+}
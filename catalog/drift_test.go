@@ -0,0 +1,175 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSDetectDrift(t *testing.T) {
+	type variant struct {
+		config    *ServicesConfig
+		namespace namespace
+		current   *sd.Service
+		expected  serviceDrift
+	}
+	srv60 := &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}}
+	custom5 := &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)}
+	route53 := func(mode string) *ServicesConfig {
+		return &ServicesConfig{Defaults: ServiceConfig{Health: &HealthConfig{Mode: mode, ResourcePath: "/health"}}}
+	}
+	variants := []variant{
+		{
+			current:  &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckCustomConfig: custom5},
+			expected: serviceDrift{},
+		},
+		{
+			current: &sd.Service{Description: &awsServiceDescription, DnsConfig: &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(10), Type: sd.RecordTypeSrv}}}, HealthCheckCustomConfig: custom5},
+			expected: serviceDrift{change: &sd.ServiceChange{
+				Description: &awsServiceDescription,
+				DnsConfig:   &sd.DnsConfigChange{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}},
+			}},
+		},
+		{
+			config:  &ServicesConfig{Services: map[string]ServiceConfig{"web": {Description: "frontend"}}},
+			current: &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckCustomConfig: custom5},
+			expected: serviceDrift{change: &sd.ServiceChange{
+				Description: x.String("Imported from Eureka: frontend"),
+				DnsConfig:   &sd.DnsConfigChange{DnsRecords: srv60.DnsRecords},
+			}},
+		},
+		{
+			current:  &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckCustomConfig: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(1)}},
+			expected: serviceDrift{},
+		},
+		{
+			config:   &ServicesConfig{Defaults: ServiceConfig{Health: &HealthConfig{FailureThreshold: x.Int64(2)}}},
+			current:  &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckCustomConfig: custom5},
+			expected: serviceDrift{},
+		},
+		{
+			config:    route53(HealthModeRoute53),
+			namespace: namespace{isPublic: true},
+			current:   &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckCustomConfig: custom5},
+			expected:  serviceDrift{immutable: []string{"health check type"}},
+		},
+		{
+			config:    route53(HealthModeRoute53),
+			namespace: namespace{isPublic: true},
+			current:   &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60},
+			expected: serviceDrift{change: &sd.ServiceChange{
+				Description:       &awsServiceDescription,
+				DnsConfig:         &sd.DnsConfigChange{DnsRecords: srv60.DnsRecords},
+				HealthCheckConfig: &sd.HealthCheckConfig{Type: sd.HealthCheckTypeTcp},
+			}},
+		},
+		{
+			config:    route53(HealthModeNone),
+			namespace: namespace{isPublic: true},
+			current:   &sd.Service{Description: &awsServiceDescription, DnsConfig: srv60, HealthCheckConfig: &sd.HealthCheckConfig{Type: sd.HealthCheckTypeTcp}},
+			expected: serviceDrift{change: &sd.ServiceChange{
+				Description: &awsServiceDescription,
+				DnsConfig:   &sd.DnsConfigChange{DnsRecords: srv60.DnsRecords},
+			}},
+		},
+		{
+			config:   &ServicesConfig{Defaults: ServiceConfig{Description: "http"}},
+			current:  &sd.Service{Description: &awsServiceDescription, HealthCheckCustomConfig: custom5},
+			expected: serviceDrift{},
+		},
+	}
+
+	for _, v := range variants {
+		a := newTestAWS(newFakeCloudMap())
+		a.config = v.config
+		a.namespace = v.namespace
+		require.Equal(t, v.expected, a.detectDrift("web", v.current, nil))
+	}
+}
+
+func TestAWSReconcile(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	stale := &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(300), Type: sd.RecordTypeSrv}}}
+	current := &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}}
+	custom := &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)}
+	a.services = map[string]service{
+		"web":   {name: "web", awsID: "srv-1", fromEureka: true, description: awsServiceDescription, dnsConfig: stale, customHealth: custom},
+		"db":    {name: "db", awsID: "srv-2", fromEureka: true, description: awsServiceDescription, dnsConfig: current, customHealth: custom},
+		"redis": {name: "redis", awsID: "srv-3", description: "manual", dnsConfig: stale},
+	}
+	f.handle("GetService", func(input interface{}) (interface{}, error) {
+		id := *input.(*sd.GetServiceInput).Id
+		return &sd.GetServiceOutput{Service: &sd.Service{Id: &id, Description: &awsServiceDescription, DnsConfig: stale, HealthCheckCustomConfig: custom}}, nil
+	})
+	eurekaServices := map[string]service{"web": {}, "db": {}, "redis": {}}
+
+	require.Equal(t, 1, reconciled(a, eurekaServices).count(opUpdateService))
+	require.Len(t, f.inputs("GetService"), 1)
+	inputs := f.inputs("UpdateService")
+	require.Len(t, inputs, 1)
+	input := inputs[0].(*sd.UpdateServiceInput)
+	require.Equal(t, "srv-1", *input.Id)
+	require.Equal(t, current.DnsRecords, input.Service.DnsConfig.DnsRecords)
+
+	// the cache is updated so the next cycle doesn't update again
+	require.Equal(t, 0, reconciled(a, eurekaServices).count(opUpdateService))
+	require.Len(t, f.inputs("GetService"), 1)
+	require.Len(t, f.inputs("UpdateService"), 1)
+}
+
+func TestAWSReconcileRecreate(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.namespace.isPublic = true
+	custom := &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)}
+	dns := &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{TTL: x.Int64(60), Type: sd.RecordTypeSrv}}}
+	a.services = map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, description: awsServiceDescription, dnsConfig: dns, customHealth: custom},
+	}
+	f.handle("GetService", func(input interface{}) (interface{}, error) {
+		return &sd.GetServiceOutput{Service: &sd.Service{Id: x.String("srv-1"), Description: &awsServiceDescription, DnsConfig: dns, HealthCheckCustomConfig: custom}}, nil
+	})
+	f.handle("ListInstances", func(input interface{}) (interface{}, error) {
+		return &sd.ListInstancesOutput{Instances: []sd.InstanceSummary{{Id: x.String("i-1")}, {Id: x.String("i-2")}}}, nil
+	})
+	eurekaServices := map[string]service{"web": {}}
+
+	a.config = &ServicesConfig{Defaults: ServiceConfig{Health: &HealthConfig{Mode: HealthModeRoute53}}}
+	var logs bytes.Buffer
+	a.log = hclog.New(&hclog.LoggerOptions{Output: &logs, Level: hclog.Warn})
+	require.Equal(t, 0, reconciled(a, eurekaServices).count(opUpdateService))
+	require.Empty(t, f.inputs("UpdateService"))
+	require.Empty(t, f.inputs("DeleteService"))
+	// the warning isn't repeated every cycle
+	require.Equal(t, 0, reconciled(a, eurekaServices).count(opUpdateService))
+	require.Equal(t, 1, strings.Count(logs.String(), "enable recreate to fix"))
+
+	recreate := true
+	a.config.Defaults.Recreate = &recreate
+	result, recreated := a.reconcile(context.Background(), eurekaServices)
+	require.Equal(t, 0, result.count(opUpdateService))
+	require.Equal(t, map[string]string{"web": "service differs from config in fields that can't be updated: health check type"}, recreated)
+	require.Empty(t, f.inputs("DeleteService"))
+
+	require.Equal(t, 1, a.recreateAll(context.Background(), recreated).count(opUpdateService))
+	require.Len(t, f.inputs("DeregisterInstance"), 2)
+	require.Len(t, f.inputs("DeleteService"), 1)
+	_, ok := a.getService("web")
+	require.False(t, ok)
+}
+
+// reconciled reconciles services and fails if a recreation is pending.
+func reconciled(a *aws, services map[string]service) syncResult {
+	result, recreate := a.reconcile(context.Background(), services)
+	if len(recreate) > 0 {
+		panic("unexpected recreation")
+	}
+	return result
+}
@@ -1,17 +1,15 @@
 package catalog
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"runtime"
-	"runtime/debug"
-	"runtime/pprof"
 	"sync"
 	"time"
 
 	_e "github.com/ArthurHlt/go-eureka-client/eureka"
-	"github.com/DataDog/datadog-go/statsd"
 	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
 const (
@@ -24,7 +22,7 @@ const (
 type eureka struct {
 	client       *_e.Client
 	log          hclog.Logger
-	dd           *statsd.Client
+	metrics      Metrics
 	eurekaPrefix string
 	awsPrefix    string
 	services     map[string]service
@@ -33,6 +31,10 @@ type eureka struct {
 	stale        bool
 	lock         sync.RWMutex
 	pullInterval time.Duration
+	tracer       trace.Tracer
+	leader       *leader
+	damper       *healthDamper
+	deletions    *deletionGuard
 }
 
 func (e *eureka) getServices() map[string]service {
@@ -115,27 +117,32 @@ func (e *eureka) setNode(k, h string, p int, n node) {
 	e.lock.Unlock()
 }
 
-func (e *eureka) sync(aws *aws, stop, stopped chan struct{}) {
-	defer close(stopped)
+func (e *eureka) sync(ctx context.Context, aws *aws, status *Status, control *Control, stop <-chan struct{}) {
 	for {
 		select {
 		case <-e.trigger:
 			if !e.toAWS {
 				continue
 			}
-			create := onlyInFirst(e.getServices(), aws.getServices())
-			count := aws.create(create)
-			if count > 0 {
-				count := 0
-				e.log.Info("created", "count", fmt.Sprintf("%d", count))
+			if control.Paused(DirectionToAWS) {
+				e.log.Info("sync to aws is paused")
+				continue
 			}
-
-			remove := onlyInFirst(aws.getServices(), e.getServices())
-			//e.log.Info("sync()", "aws", aws.getServices(), "eureka", e.getServices())
-			count = aws.remove(remove)
-			if count > 0 {
-				e.log.Info("removed", "count", fmt.Sprintf("%d", count))
+			if !e.leader.isLeader() {
+				e.log.Debug("standby, not syncing to aws")
+				continue
+			}
+			if !aws.known() {
+				e.log.Info("waiting for the first fetch of aws")
+				continue
+			}
+			e.syncToAWS(ctx, aws, status, "")
+		case name := <-control.reconcile:
+			if !e.toAWS || control.Paused(DirectionToAWS) || !e.leader.isLeader() || !aws.known() {
+				continue
 			}
+			e.log.Info("forced reconcile", "service", name)
+			e.syncToAWS(ctx, aws, status, name)
 		case <-stop:
 			e.log.Info("sync()", "stopped", 1)
 			return
@@ -143,17 +150,77 @@ func (e *eureka) sync(aws *aws, stop, stopped chan struct{}) {
 	}
 }
 
+// syncToAWS creates, updates and removes the services in AWS that differ
+// from Eureka and returns what it did. If only is set, only that service is
+// synced.
+func (e *eureka) syncToAWS(ctx context.Context, aws *aws, status *Status, only string) ReconcileStatus {
+	start := time.Now()
+	ctx, span := e.tracer.Start(ctx, "sync.to-aws")
+	defer span.End()
+	if len(only) > 0 {
+		span.SetAttributes(kv.String("service", only))
+	}
+	eurekaServices := onlyService(e.getServices(), only)
+	_, diff := e.tracer.Start(ctx, "diff", trace.WithAttributes(kv.String("action", "create")))
+	create := aws.diffToAWS(eurekaServices, onlyService(aws.getServices(), only))
+	diff.End()
+	e.metrics.Gauge("eureka_aws.sync.aws.diff.services", float64(len(create)), []string{"action:create"})
+	e.metrics.Gauge("eureka_aws.sync.aws.diff.instances", float64(countNodes(create)), []string{"action:create"})
+	created := aws.create(ctx, create)
+	if created.count(opCreateService) > 0 || created.count(opRegister) > 0 {
+		e.log.Info("created", "services", created.count(opCreateService), "instances", created.count(opRegister))
+	}
+	if len(created.errors) > 0 {
+		e.log.Warn("create failed", "errors", len(created.errors))
+	}
+
+	updated, recreate := aws.reconcile(ctx, eurekaServices)
+	if count := updated.count(opUpdateService); count > 0 {
+		e.log.Info("updated", "count", fmt.Sprintf("%d", count))
+	}
+	if len(updated.errors) > 0 {
+		e.log.Warn("update failed", "errors", len(updated.errors))
+	}
+
+	_, diff = e.tracer.Start(ctx, "diff", trace.WithAttributes(kv.String("action", "remove")))
+	remove := aws.diffFromAWS(onlyService(aws.getServices(), only), eurekaServices)
+	diff.End()
+	e.metrics.Gauge("eureka_aws.sync.aws.diff.services", float64(len(remove)), []string{"action:remove"})
+	e.metrics.Gauge("eureka_aws.sync.aws.diff.instances", float64(countNodes(remove)), []string{"action:remove"})
+	if !aws.ready() {
+		e.log.Info("holding back removals until the first fetch of aws")
+		remove, recreate = nil, nil
+	}
+	if reason, first := e.deletions.check(remove, recreate, eurekaServices, aws.getServices()); len(reason) > 0 {
+		e.log.Warn("holding back removals", "reason", reason)
+		if first {
+			aws.notifier.Notify(Event{Type: EventMassDeletion, Reason: reason})
+		}
+		remove, recreate = nil, nil
+	}
+	recreated := aws.recreateAll(ctx, recreate)
+	updated.succeeded[opUpdateService] += recreated.count(opUpdateService)
+	updated.errors = append(updated.errors, recreated.errors...)
+	//e.log.Info("sync()", "aws", aws.getServices(), "eureka", e.getServices())
+	removed := aws.remove(ctx, remove, eurekaServices)
+	aws.saveState()
+	r := status.reconciled(start, e.getServices(), aws.getServices(), created, updated, removed)
+	if removed.count(opDeleteService) > 0 || removed.count(opDeregister) > 0 {
+		e.log.Info("removed", "services", removed.count(opDeleteService), "instances", removed.count(opDeregister))
+	}
+	if len(removed.errors) > 0 {
+		e.log.Warn("remove failed", "errors", len(removed.errors))
+	}
+	e.metrics.Timing("eureka_aws.sync.aws.reconcile.duration", time.Since(start), []string{})
+	return r
+}
+
 func (e *eureka) transformNodes(cnodes []_e.InstanceInfo) map[string]map[int]node {
 	nodes := map[string]map[int]node{}
-	attributes := make(map[string]string)
 
 	for _, n := range cnodes {
-		address := n.IpAddr
-		if len(address) == 0 {
-			address = n.HostName
-		}
-
-		instanceID := address
+		attributes := make(map[string]string)
+		address, instanceID := instanceKeys(n)
 		if nodes[address] == nil {
 			nodes[address] = map[int]node{}
 		}
@@ -166,7 +233,6 @@ func (e *eureka) transformNodes(cnodes []_e.InstanceInfo) map[string]map[int]nod
 			attributes["public-hostname"] = n.DataCenterInfo.Metadata.PublicHostname
 			attributes["local-hostname"] = n.DataCenterInfo.Metadata.LocalHostname
 			attributes["availability-zone"] = n.DataCenterInfo.Metadata.AvailabilityZone
-			instanceID = n.DataCenterInfo.Metadata.InstanceId
 		}
 		attributes["homePageUrl"] = n.HomePageUrl
 		attributes["statusPageUrl"] = n.StatusPageUrl
@@ -179,6 +245,20 @@ func (e *eureka) transformNodes(cnodes []_e.InstanceInfo) map[string]map[int]nod
 	return nodes
 }
 
+// instanceKeys returns the address a Eureka instance is keyed by, its IP or
+// else its hostname, and its instance ID, which is the one of its Amazon
+// metadata or else the address.
+func instanceKeys(n _e.InstanceInfo) (string, string) {
+	address := n.IpAddr
+	if len(address) == 0 {
+		address = n.HostName
+	}
+	if n.DataCenterInfo != nil && n.DataCenterInfo.Metadata != nil {
+		return address, n.DataCenterInfo.Metadata.InstanceId
+	}
+	return address, address
+}
+
 // read nodes from eureka
 func (e *eureka) fetchNodes(service string) ([]_e.InstanceInfo, error) {
 	app, err := e.client.GetApplication(service)
@@ -192,20 +272,14 @@ func (e *eureka) transformHealth(ehealths []_e.InstanceInfo) map[string]health {
 	healths := map[string]health{}
 
 	for _, h := range ehealths {
-		instanceId := h.IpAddr
-
-		if h.DataCenterInfo.Metadata != nil {
-			instanceId = h.DataCenterInfo.Metadata.InstanceId
-		}
+		_, instanceId := instanceKeys(h)
 
 		//e.log.Info("transformHealth()", "instanceID", instanceId, "status", h.Status)
 
 		switch h.Status {
 		case "UP":
 			healths[instanceId] = "HEALTHY"
-		case "DOWN":
-		case "STARTING":
-		case "OUT_OF_SERVICE":
+		case "DOWN", "STARTING", "OUT_OF_SERVICE":
 			healths[instanceId] = "UNHEALTHY"
 		default:
 			healths[instanceId] = "UNKNOWN"
@@ -226,32 +300,46 @@ func (c *eureka) fetchHealth(name string) (api.HealthChecks, error) {
 }
 */
 
-func (e *eureka) fetchServices() (*_e.Applications, error) {
+func (e *eureka) fetchServices(ctx context.Context) (*_e.Applications, error) {
+	ctx, span := e.tracer.Start(ctx, "eureka.GetApplications")
 	apps, err := e.client.GetApplications()
+	endSpan(ctx, span, err)
 	if err != nil {
 		return apps, err
 	}
 	e.log.Info("fetch()", "count", len(apps.Applications))
 
-	err = e.dd.Gauge("eureka_aws.sync.eureka.services.count",
+	e.metrics.Gauge("eureka_aws.sync.eureka.services.count",
 		float64(len(apps.Applications)),
-		[]string{}, 1)
-
-	if err != nil {
-		e.log.Error("Unable to post to statsd", "error", err)
-	}
+		[]string{})
 
 	return apps, nil
 }
 
-func (e *eureka) fetch() error {
-	apps, err := e.fetchServices()
+func (e *eureka) fetch(ctx context.Context) (err error) {
+	start := time.Now()
+	ctx, span := e.tracer.Start(ctx, "eureka.fetch")
+	defer func() {
+		e.metrics.Timing("eureka_aws.sync.eureka.fetch.duration", time.Since(start), []string{})
+		endSpan(ctx, span, err)
+	}()
+	apps, err := e.fetchServices(ctx)
 	if err != nil {
 		return fmt.Errorf("error fetching services: %s", err)
 	}
 
 	services := e.transformServices(apps)
+	for k, n := range e.damper.damp(services) {
+		if n > 0 {
+			e.metrics.Count("eureka_aws.sync.eureka.health.flaps", int64(n), []string{"service:" + k})
+		}
+	}
 	e.setServices(services)
+	for k, s := range services {
+		e.metrics.Gauge("eureka_aws.sync.eureka.instances.count",
+			float64(countNodes(map[string]service{k: s})),
+			[]string{"service:" + k})
+	}
 	return nil
 }
 
@@ -269,8 +357,18 @@ func (e *eureka) transformServices(apps *_e.Applications) map[string]service {
 		*/
 
 		//e.log.Info("transformServices()", "serviceName", v.Name, "nodes", len(v.Instances))
-		s.nodes = e.transformNodes(v.Instances)
-		s.healths = e.transformHealth(v.Instances)
+		instances := make([]_e.InstanceInfo, 0, len(v.Instances))
+		for _, i := range v.Instances {
+			if !registeredFromAWS(i) {
+				instances = append(instances, i)
+			}
+		}
+		if len(instances) == 0 && len(v.Instances) > 0 {
+			// only holds instances registered by the sync to eureka
+			continue
+		}
+		s.nodes = e.transformNodes(instances)
+		s.healths = e.transformHealth(instances)
 
 		services[s.name] = s
 		count++
@@ -289,33 +387,12 @@ func (e *eureka) rekeyHealths(name string, healths map[string]health) map[string
 	return rekeyed
 }
 
-func countGoRoutines() int {
-	return runtime.NumGoroutine()
-}
-
-func getStackTraceHandler() {
-	stack := debug.Stack()
-	os.Stdout.Write(stack)
-	pprof.Lookup("goroutine").WriteTo(os.Stdout, 2)
-}
-
-func (e *eureka) fetchIndefinetely(stop, stopped chan struct{}) {
-	defer close(stopped)
-
-	for {
-		err := e.fetch()
-		if err != nil {
-			e.log.Error("error fetching", "error", err)
-		} else {
-			e.trigger <- true
+func (e *eureka) fetchIndefinetely(ctx context.Context, status *Status, force <-chan struct{}, stop <-chan struct{}) {
+	fetchLoop(WorkerEurekaFetch, e.log, status, e.pullInterval, e.trigger, force, func() error {
+		if err := e.fetch(ctx); err != nil {
+			return err
 		}
-		select {
-		case <-stop:
-			return
-		case <-time.After(e.pullInterval):
-			e.log.Info("goroutine", "count", countGoRoutines())
-			//getStackTraceHandler()
-			continue
-		}
-	}
+		status.fetched(SideEureka, e.getServices())
+		return nil
+	}, stop)
 }
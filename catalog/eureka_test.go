@@ -1,10 +1,16 @@
 package catalog
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
 func TestEurekaRekeyHealths(t *testing.T) {
@@ -110,6 +116,18 @@ func TestEurekaTransformServices(t *testing.T) {
 		},
 	}
 	//services := map[string][]string{"s1": {"abc"}, "aws_s2": {EurekaAWSTag}}
+	// instances registered by the sync to eureka aren't imported back
+	services.Applications = append(services.Applications, _e.Application{
+		Name: "AWS_S3",
+		Instances: []_e.InstanceInfo{{
+			App:            "AWS_S3",
+			IpAddr:         "1.1.1.3",
+			Status:         "UP",
+			Port:           &_e.Port{Port: 3, Enabled: true},
+			DataCenterInfo: &_e.DataCenterInfo{},
+			Metadata:       &_e.MetaData{Map: map[string]string{EurekaSourceKey: EurekaAWSTag}},
+		}},
+	})
 
 	attributes_s1 := map[string]string{
 		"local-ipv4":        "1.1.1.1",
@@ -151,3 +169,182 @@ func TestEurekaTransformServices(t *testing.T) {
 	}
 	require.Equal(t, expected, e.transformServices(&services))
 }
+
+func TestEurekaTransformNodes(t *testing.T) {
+	e := eureka{}
+	instances := []_e.InstanceInfo{
+		{App: "s1", IpAddr: "2001:db8::1", HealthCheckUrl: "one", Port: &_e.Port{Port: 1}, DataCenterInfo: &_e.DataCenterInfo{}},
+		{App: "s1", HostName: "s1.example.com", HealthCheckUrl: "two", Port: &_e.Port{Port: 2}, DataCenterInfo: &_e.DataCenterInfo{}},
+	}
+	expected := map[string]map[int]node{
+		"2001:db8::1": {1: {port: 1, host: "2001:db8::1", awsID: "s1", eurekaID: "s1", instanceID: "2001:db8::1",
+			attributes: map[string]string{"homePageUrl": "", "statusPageUrl": "", "healthCheckUrl": "one"}}},
+		"s1.example.com": {2: {port: 2, host: "s1.example.com", awsID: "s1", eurekaID: "s1", instanceID: "s1.example.com",
+			attributes: map[string]string{"homePageUrl": "", "statusPageUrl": "", "healthCheckUrl": "two"}}},
+	}
+	require.Equal(t, expected, e.transformNodes(instances))
+}
+
+func TestEurekaTransformHealth(t *testing.T) {
+	e := eureka{}
+	instances := []_e.InstanceInfo{
+		{IpAddr: "1.1.1.1", Status: "UP", DataCenterInfo: &_e.DataCenterInfo{}},
+		{IpAddr: "1.1.1.2", Status: "DOWN", DataCenterInfo: &_e.DataCenterInfo{}},
+		{IpAddr: "1.1.1.3", Status: "STARTING", DataCenterInfo: &_e.DataCenterInfo{}},
+		{IpAddr: "1.1.1.4", Status: "OUT_OF_SERVICE", DataCenterInfo: &_e.DataCenterInfo{}},
+		{IpAddr: "1.1.1.5", Status: "UNKNOWN", DataCenterInfo: &_e.DataCenterInfo{}},
+	}
+	expected := map[string]health{
+		"1.1.1.1": healthy, "1.1.1.2": unhealthy, "1.1.1.3": unhealthy, "1.1.1.4": unhealthy, "1.1.1.5": "UNKNOWN",
+	}
+	require.Equal(t, expected, e.transformHealth(instances))
+}
+
+func TestEurekaTransformHealthKeys(t *testing.T) {
+	e := eureka{}
+	instances := []_e.InstanceInfo{
+		{HostName: "s1.example.com", Status: "UP", Port: &_e.Port{Port: 1}, DataCenterInfo: &_e.DataCenterInfo{}},
+		{HostName: "s2.example.com", Status: "UNKNOWN", Port: &_e.Port{Port: 1}, DataCenterInfo: &_e.DataCenterInfo{}},
+		{IpAddr: "1.1.1.1", Status: "UP", Port: &_e.Port{Port: 1},
+			DataCenterInfo: &_e.DataCenterInfo{Metadata: &_e.DataCenterMetadata{InstanceId: "i-1"}}},
+	}
+	healths := e.transformHealth(instances)
+	require.Equal(t, map[string]health{"s1.example.com": healthy, "s2.example.com": "UNKNOWN", "i-1": healthy}, healths)
+
+	// healths are keyed like the instances
+	for _, nodes := range e.transformNodes(instances) {
+		for _, n := range nodes {
+			require.Contains(t, healths, n.instanceID)
+		}
+	}
+}
+
+func TestEurekaSyncControl(t *testing.T) {
+	f := newFakeCloudMap()
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: input.(*sd.CreateServiceInput).CreatorRequestId}}, nil
+	})
+	a := newTestAWS(f)
+	a.services = map[string]service{
+		"api": {name: "api", fromEureka: true, awsID: "srv-api", nodes: map[string]map[int]node{
+			"2.2.2.2": {80: {host: "2.2.2.2", port: 80, awsID: "api-1"}},
+		}},
+	}
+	e := &eureka{
+		log:     hclog.NewNullLogger(),
+		trigger: make(chan bool, 1),
+		toAWS:   true,
+		metrics: nopMetrics{},
+		tracer:  trace.NoopTracer{},
+		services: map[string]service{
+			"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+			}},
+		},
+	}
+	control := NewControl()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.sync(context.Background(), a, NewStatus(), control, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// a forced reconcile of a single service leaves the others alone
+	require.NoError(t, control.Reconcile("web"))
+	require.Eventually(t, func() bool { return len(f.inputs("RegisterInstance")) == 1 }, time.Second, time.Millisecond)
+	require.Empty(t, f.inputs("DeregisterInstance"))
+
+	// nothing is synced while paused
+	require.NoError(t, control.Pause(DirectionToAWS))
+	require.Equal(t, ErrPaused, control.Reconcile(""))
+	e.trigger <- true
+	require.Eventually(t, func() bool { return len(e.trigger) == 0 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, f.inputs("DeregisterInstance"))
+}
+
+func TestEurekaSyncToAWSHoldsMassDeletion(t *testing.T) {
+	f := newFakeCloudMap()
+	n := &recordingNotifier{}
+	a := newTestAWS(f)
+	a.notifier = n
+	a.services = map[string]service{}
+	eurekaServices := map[string]service{}
+	for _, k := range []string{"api", "db", "web"} {
+		a.services[k] = service{name: k, fromEureka: true, awsID: "srv-" + k, description: awsServiceDescription,
+			customHealth: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(defaultCustomHealthFailureThreshold)},
+			nodes:        map[string]map[int]node{}}
+		eurekaServices[k] = service{name: k, fromEureka: true, nodes: map[string]map[int]node{}}
+	}
+	e := &eureka{
+		log:       hclog.NewNullLogger(),
+		metrics:   nopMetrics{},
+		tracer:    trace.NoopTracer{},
+		deletions: newDeletionGuard(0, 0.5),
+	}
+
+	// two of three services vanishing from Eureka is held back
+	e.services = map[string]service{"api": eurekaServices["api"]}
+	for i := 0; i < 2; i++ {
+		r := e.syncToAWS(context.Background(), a, NewStatus(), "")
+		require.Equal(t, 0, r.RemovedServices)
+	}
+	require.Empty(t, f.inputs("DeleteService"))
+	require.Len(t, n.events, 1)
+	require.Equal(t, EventMassDeletion, n.events[0].Type)
+	require.Equal(t, "2 of 3 owned services would be deleted, more than 50%", n.events[0].Reason)
+
+	// one of three is not
+	e.services = map[string]service{"api": eurekaServices["api"], "db": eurekaServices["db"]}
+	r := e.syncToAWS(context.Background(), a, NewStatus(), "")
+	require.Equal(t, 1, r.RemovedServices)
+	require.Len(t, f.inputs("DeleteService"), 1)
+}
+
+func TestEurekaSyncToAWSHoldsRecreations(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.namespace.isPublic = true
+	recreate := true
+	a.config = &ServicesConfig{Defaults: ServiceConfig{Recreate: &recreate, Health: &HealthConfig{Mode: HealthModeRoute53}}}
+	custom := &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(defaultCustomHealthFailureThreshold)}
+	a.services = map[string]service{}
+	eurekaServices := map[string]service{}
+	for _, k := range []string{"api", "db", "web"} {
+		a.services[k] = service{name: k, fromEureka: true, awsID: "srv-" + k, description: awsServiceDescription,
+			customHealth: custom, nodes: map[string]map[int]node{}}
+		eurekaServices[k] = service{name: k, fromEureka: true, nodes: map[string]map[int]node{}}
+	}
+	f.handle("GetService", func(input interface{}) (interface{}, error) {
+		id := *input.(*sd.GetServiceInput).Id
+		return &sd.GetServiceOutput{Service: &sd.Service{Id: &id, Description: &awsServiceDescription, HealthCheckCustomConfig: custom}}, nil
+	})
+	e := &eureka{
+		log:       hclog.NewNullLogger(),
+		metrics:   nopMetrics{},
+		tracer:    trace.NoopTracer{},
+		services:  eurekaServices,
+		deletions: newDeletionGuard(0, 0.5),
+	}
+
+	// recreations wait for the first fetch like removals
+	a.fetched = false
+	e.syncToAWS(context.Background(), a, NewStatus(), "")
+	require.Empty(t, f.inputs("DeleteService"))
+
+	// and recreating all services counts as a mass deletion
+	a.fetched = true
+	r := e.syncToAWS(context.Background(), a, NewStatus(), "")
+	require.Equal(t, 0, r.UpdatedServices)
+	require.Empty(t, f.inputs("DeleteService"))
+
+	e.deletions = nil
+	r = e.syncToAWS(context.Background(), a, NewStatus(), "")
+	require.Equal(t, 3, r.UpdatedServices)
+	require.Len(t, f.inputs("DeleteService"), 3)
+}
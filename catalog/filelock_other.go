@@ -0,0 +1,18 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("file locks are not supported on %s", runtime.GOOS)
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package catalog
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+)
+
+const defaultCustomHealthFailureThreshold = 5
+
+// healthCheckConfig returns the health check settings to create the named
+// service with. At most one of the results is set. Route 53 health checks
+// fall back to custom ones where CloudMap doesn't support them, i.e. outside
+// of public DNS namespaces and for CNAME records, which is logged once per
+// service as it is called on every sync.
+func (a *aws) healthCheckConfig(name string, nodes map[string]map[int]node, dns *sd.DnsConfig) (*sd.HealthCheckConfig, *sd.HealthCheckCustomConfig) {
+	c := a.config.forService(name).Health
+	mode := c.Mode
+	if mode == HealthModeRoute53 && !a.namespace.isPublic {
+		a.warnOnce("route53-private/"+name,
+			"route53 health checks require a public DNS namespace, using custom health checks", "name", name)
+		mode = HealthModeCustom
+	}
+	if mode == HealthModeRoute53 && dns != nil {
+		for _, r := range dns.DnsRecords {
+			if r.Type == sd.RecordTypeCname {
+				a.warnOnce("route53-cname/"+name,
+					"route53 health checks can't be used with CNAME records, using custom health checks", "name", name)
+				mode = HealthModeCustom
+				break
+			}
+		}
+	}
+
+	switch mode {
+	case HealthModeNone:
+		return nil, nil
+	case HealthModeRoute53:
+		return route53HealthCheck(c, nodes), nil
+	default:
+		threshold := x.Int64(defaultCustomHealthFailureThreshold)
+		if c.FailureThreshold != nil {
+			threshold = c.FailureThreshold
+		}
+		return nil, &sd.HealthCheckCustomConfig{FailureThreshold: threshold}
+	}
+}
+
+// route53HealthCheck builds a Route 53 health check. Without a configured type
+// and resource path they are taken from the healthCheckUrl Eureka reports for
+// the instances.
+func route53HealthCheck(c *HealthConfig, nodes map[string]map[int]node) *sd.HealthCheckConfig {
+	hc := &sd.HealthCheckConfig{
+		Type:             sd.HealthCheckType(c.Type),
+		FailureThreshold: c.FailureThreshold,
+	}
+	if len(c.ResourcePath) > 0 {
+		hc.ResourcePath = x.String(c.ResourcePath)
+	}
+
+	if u := healthCheckURL(nodes); u != nil {
+		if len(hc.Type) == 0 {
+			switch strings.ToLower(u.Scheme) {
+			case "https":
+				hc.Type = sd.HealthCheckTypeHttps
+			default:
+				hc.Type = sd.HealthCheckTypeHttp
+			}
+		}
+		if hc.ResourcePath == nil && hc.Type != sd.HealthCheckTypeTcp {
+			path := u.EscapedPath()
+			if len(path) == 0 {
+				path = "/"
+			}
+			if len(u.RawQuery) > 0 {
+				path += "?" + u.RawQuery
+			}
+			hc.ResourcePath = x.String(path)
+		}
+	}
+	if len(hc.Type) == 0 {
+		hc.Type = sd.HealthCheckTypeTcp
+	}
+	if hc.Type == sd.HealthCheckTypeTcp {
+		hc.ResourcePath = nil
+	}
+	return hc
+}
+
+// healthCheckURL returns the first parseable healthCheckUrl of nodes, in
+// host and port order so the result is stable.
+func healthCheckURL(nodes map[string]map[int]node) *url.URL {
+	hosts := make([]string, 0, len(nodes))
+	for h := range nodes {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		ports := make([]int, 0, len(nodes[h]))
+		for p := range nodes[h] {
+			ports = append(ports, p)
+		}
+		sort.Ints(ports)
+		for _, p := range ports {
+			raw := nodes[h][p].attributes["healthCheckUrl"]
+			if len(raw) == 0 {
+				continue
+			}
+			if u, err := url.Parse(raw); err == nil && len(u.Scheme) > 0 {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+// usesCustomHealth reports whether the health of the named existing
+// service's instances is set through UpdateInstanceCustomHealthStatus.
+func (a *aws) usesCustomHealth(name string) bool {
+	s, ok := a.getService(name)
+	return !ok || s.customHealth != nil
+}
@@ -0,0 +1,119 @@
+package catalog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSHealthCheckConfig(t *testing.T) {
+	type variant struct {
+		health         *HealthConfig
+		namespace      namespace
+		nodes          map[string]map[int]node
+		dns            *sd.DnsConfig
+		expected       *sd.HealthCheckConfig
+		expectedCustom *sd.HealthCheckCustomConfig
+	}
+	public := namespace{isPublic: true}
+	nodes := map[string]map[int]node{
+		"1.1.1.2": {8443: {attributes: map[string]string{"healthCheckUrl": "https://1.1.1.2:8443/other"}}},
+		"1.1.1.1": {8443: {attributes: map[string]string{"healthCheckUrl": "https://1.1.1.1:8443/actuator/health?deep=true"}}},
+	}
+	variants := []variant{
+		{
+			expectedCustom: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)},
+		},
+		{
+			health:         &HealthConfig{FailureThreshold: x.Int64(2)},
+			expectedCustom: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(2)},
+		},
+		{
+			health: &HealthConfig{Mode: HealthModeNone},
+		},
+		{
+			health:         &HealthConfig{Mode: HealthModeRoute53},
+			namespace:      namespace{},
+			nodes:          nodes,
+			expectedCustom: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)},
+		},
+		{
+			health:         &HealthConfig{Mode: HealthModeRoute53},
+			namespace:      public,
+			nodes:          nodes,
+			dns:            &sd.DnsConfig{DnsRecords: []sd.DnsRecord{{Type: sd.RecordTypeCname}}},
+			expectedCustom: &sd.HealthCheckCustomConfig{FailureThreshold: x.Int64(5)},
+		},
+		{
+			health:    &HealthConfig{Mode: HealthModeRoute53},
+			namespace: public,
+			nodes:     nodes,
+			expected:  &sd.HealthCheckConfig{Type: sd.HealthCheckTypeHttps, ResourcePath: x.String("/actuator/health?deep=true")},
+		},
+		{
+			health:    &HealthConfig{Mode: HealthModeRoute53, Type: "HTTP", ResourcePath: "/ping", FailureThreshold: x.Int64(3)},
+			namespace: public,
+			nodes:     nodes,
+			expected:  &sd.HealthCheckConfig{Type: sd.HealthCheckTypeHttp, ResourcePath: x.String("/ping"), FailureThreshold: x.Int64(3)},
+		},
+		{
+			health:    &HealthConfig{Mode: HealthModeRoute53, Type: "TCP"},
+			namespace: public,
+			nodes:     nodes,
+			expected:  &sd.HealthCheckConfig{Type: sd.HealthCheckTypeTcp},
+		},
+		{
+			health:    &HealthConfig{Mode: HealthModeRoute53},
+			namespace: public,
+			nodes:     map[string]map[int]node{"1.1.1.1": {80: {attributes: map[string]string{"healthCheckUrl": "http://1.1.1.1"}}}},
+			expected:  &sd.HealthCheckConfig{Type: sd.HealthCheckTypeHttp, ResourcePath: x.String("/")},
+		},
+		{
+			health:    &HealthConfig{Mode: HealthModeRoute53},
+			namespace: public,
+			nodes:     map[string]map[int]node{"1.1.1.1": {80: {}}},
+			expected:  &sd.HealthCheckConfig{Type: sd.HealthCheckTypeTcp},
+		},
+	}
+
+	for _, v := range variants {
+		a := aws{
+			log:       hclog.NewNullLogger(),
+			namespace: v.namespace,
+			config:    &ServicesConfig{Services: map[string]ServiceConfig{"web": {Health: v.health}}},
+		}
+		hc, custom := a.healthCheckConfig("web", v.nodes, v.dns)
+		require.Equal(t, v.expected, hc)
+		require.Equal(t, v.expectedCustom, custom)
+	}
+}
+
+func TestAWSHealthCheckConfigWarnsOnce(t *testing.T) {
+	var logs bytes.Buffer
+	a := aws{
+		log:    hclog.New(&hclog.LoggerOptions{Output: &logs, Level: hclog.Warn}),
+		config: &ServicesConfig{Defaults: ServiceConfig{Health: &HealthConfig{Mode: HealthModeRoute53}}},
+	}
+	for i := 0; i < 3; i++ {
+		a.healthCheckConfig("web", nil, nil)
+	}
+	a.healthCheckConfig("api", nil, nil)
+	require.Equal(t, 2, strings.Count(logs.String(), "route53 health checks require a public DNS namespace"))
+}
+
+func TestAWSUsesCustomHealth(t *testing.T) {
+	a := aws{services: map[string]service{
+		"custom":  {awsID: "1", customHealth: &sd.HealthCheckCustomConfig{}},
+		"route53": {awsID: "2", healthCheck: &sd.HealthCheckConfig{}},
+		"none":    {awsID: "3"},
+	}}
+	require.True(t, a.usesCustomHealth("custom"))
+	require.False(t, a.usesCustomHealth("route53"))
+	require.False(t, a.usesCustomHealth("none"))
+	require.True(t, a.usesCustomHealth("unknown"))
+}
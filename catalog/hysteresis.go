@@ -0,0 +1,90 @@
+package catalog
+
+import (
+	"time"
+)
+
+// instanceHealth is what a healthDamper knows about the health of one
+// instance.
+type instanceHealth struct {
+	// stable is the health that is propagated, since changed.
+	stable  health
+	changed time.Time
+	// observed is the health seen last and candidate the one that differs
+	// from stable, seen count times in a row.
+	observed  health
+	candidate health
+	count     int
+}
+
+// healthDamper keeps instances flapping between healths from changing
+// CloudMap on every cycle: a new health is only propagated once it was
+// observed a number of times in a row and the previous one lasted for the
+// minimum dwell time. It is only used by the Eureka fetch loop. A nil
+// healthDamper propagates every health right away.
+type healthDamper struct {
+	observations int
+	minDwell     time.Duration
+	now          func() time.Time
+	// instances are keyed by service and instance ID.
+	instances map[string]map[string]*instanceHealth
+}
+
+func newHealthDamper(observations int, minDwell time.Duration) *healthDamper {
+	if observations < 1 {
+		observations = 1
+	}
+	return &healthDamper{
+		observations: observations,
+		minDwell:     minDwell,
+		now:          time.Now,
+		instances:    map[string]map[string]*instanceHealth{},
+	}
+}
+
+// damp replaces the healths of services with the ones to propagate and
+// returns how often the observed health of the instances of each service
+// changed since the last call. Instances that are seen for the first time
+// take their health right away; instances that are gone are forgotten.
+func (d *healthDamper) damp(services map[string]service) map[string]int {
+	flaps := map[string]int{}
+	if d == nil {
+		return flaps
+	}
+	now := d.now()
+	instances := make(map[string]map[string]*instanceHealth, len(services))
+	for k, s := range services {
+		known := d.instances[k]
+		current := make(map[string]*instanceHealth, len(s.healths))
+		healths := make(map[string]health, len(s.healths))
+		for id, h := range s.healths {
+			i, ok := known[id]
+			if !ok {
+				i = &instanceHealth{stable: h, changed: now, observed: h}
+			}
+			if i.observed != h {
+				flaps[k]++
+			}
+			i.observed = h
+			switch {
+			case h == i.stable:
+				i.candidate, i.count = unknown, 0
+			case h == i.candidate:
+				i.count++
+			default:
+				i.candidate, i.count = h, 1
+			}
+			if i.count >= d.observations && now.Sub(i.changed) >= d.minDwell {
+				i.stable, i.changed = h, now
+				i.candidate, i.count = unknown, 0
+			}
+			current[id] = i
+			healths[id] = i.stable
+		}
+		s.healths = healths
+		services[k] = s
+		instances[k] = current
+	}
+	d.instances = instances
+	return flaps
+}
@@ -0,0 +1,70 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthDamper(t *testing.T) {
+	now := time.Now()
+	d := newHealthDamper(3, time.Minute)
+	d.now = func() time.Time { return now }
+	observe := func(h health) (health, int) {
+		services := map[string]service{"web": {name: "web", healths: map[string]health{"web-1": h}}}
+		flaps := d.damp(services)
+		return services["web"].healths["web-1"], flaps["web"]
+	}
+
+	// new instances take their health right away
+	h, flaps := observe(healthy)
+	require.Equal(t, healthy, h)
+	require.Equal(t, 0, flaps)
+
+	// flapping never reaches the observations
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		h, flaps = observe(unhealthy)
+		require.Equal(t, healthy, h)
+		require.Equal(t, 1, flaps)
+		now = now.Add(time.Minute)
+		h, _ = observe(healthy)
+		require.Equal(t, healthy, h)
+	}
+
+	// a change is propagated after three observations in a row
+	h, _ = observe(unhealthy)
+	require.Equal(t, healthy, h)
+	h, _ = observe(unhealthy)
+	require.Equal(t, healthy, h)
+	h, flaps = observe(unhealthy)
+	require.Equal(t, unhealthy, h)
+	require.Equal(t, 0, flaps)
+
+	// but only once the previous health lasted for the minimum dwell time
+	for i := 0; i < 3; i++ {
+		h, _ = observe(healthy)
+		require.Equal(t, unhealthy, h)
+	}
+	now = now.Add(time.Minute)
+	h, _ = observe(healthy)
+	require.Equal(t, healthy, h)
+
+	// gone instances are forgotten
+	d.damp(map[string]service{"web": {name: "web"}})
+	h, _ = observe(unhealthy)
+	require.Equal(t, unhealthy, h)
+}
+
+func TestHealthDamperDisabled(t *testing.T) {
+	services := map[string]service{"web": {name: "web", healths: map[string]health{"web-1": healthy}}}
+	require.Empty(t, (*healthDamper)(nil).damp(services))
+	require.Equal(t, healthy, services["web"].healths["web-1"])
+
+	d := newHealthDamper(0, 0)
+	d.damp(services)
+	services = map[string]service{"web": {name: "web", healths: map[string]health{"web-1": unhealthy}}}
+	require.Equal(t, map[string]int{"web": 1}, d.damp(services))
+	require.Equal(t, unhealthy, services["web"].healths["web-1"])
+}
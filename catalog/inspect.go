@@ -0,0 +1,215 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Differences of an instance between Eureka and CloudMap, named after what
+// the next sync to AWS does about them.
+const (
+	DiffRegister   = "register"
+	DiffReregister = "reregister"
+	DiffDeregister = "deregister"
+	DiffHealth     = "health"
+	// DiffPendingGuard is an instance the sync would deregister but holds
+	// back, see CatalogService.Held.
+	DiffPendingGuard = "pending guard"
+)
+
+// CatalogService is a service as seen in Eureka and CloudMap side by side.
+type CatalogService struct {
+	Name     string `json:"name"`
+	InEureka bool   `json:"inEureka"`
+	// CloudMapID is empty for services missing in CloudMap.
+	CloudMapID string `json:"cloudMapId,omitempty"`
+	// Owned is set for CloudMap services imported from Eureka by eureka-aws.
+	Owned     bool              `json:"owned"`
+	Instances []CatalogInstance `json:"instances"`
+	Diff      CatalogDiff       `json:"diff"`
+	// Held is why the removals of the service are held back, if they are.
+	Held string `json:"held,omitempty"`
+}
+
+// CatalogInstance is an instance of a CatalogService.
+type CatalogInstance struct {
+	ID             string `json:"id"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	InEureka       bool   `json:"inEureka"`
+	EurekaHealth   string `json:"eurekaHealth,omitempty"`
+	InCloudMap     bool   `json:"inCloudMap"`
+	CloudMapHealth string `json:"cloudMapHealth,omitempty"`
+	// Diff is one of the Diff constants or empty if the instance is in sync.
+	Diff string `json:"diff,omitempty"`
+}
+
+// CatalogDiff counts what the next sync to AWS does to a service.
+type CatalogDiff struct {
+	CreateService bool `json:"createService,omitempty"`
+	DeleteService bool `json:"deleteService,omitempty"`
+	Register      int  `json:"register,omitempty"`
+	Reregister    int  `json:"reregister,omitempty"`
+	Deregister    int  `json:"deregister,omitempty"`
+	Health        int  `json:"health,omitempty"`
+	// PendingGuard counts the deregistrations and the deletion of the
+	// service that are held back.
+	PendingGuard int `json:"pendingGuard,omitempty"`
+}
+
+// InSync reports whether there is nothing to do.
+func (d CatalogDiff) InSync() bool {
+	return d == CatalogDiff{}
+}
+
+func (d CatalogDiff) String() string {
+	var parts []string
+	if d.CreateService {
+		parts = append(parts, "create service")
+	}
+	if d.DeleteService {
+		parts = append(parts, "delete service")
+	}
+	for _, c := range []struct {
+		name  string
+		count int
+	}{{DiffRegister, d.Register}, {DiffReregister, d.Reregister}, {DiffDeregister, d.Deregister}, {DiffHealth, d.Health},
+		{DiffPendingGuard, d.PendingGuard}} {
+		if c.count > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", c.name, c.count))
+		}
+	}
+	if len(parts) == 0 {
+		return "in sync"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Inspect fetches AWS and Eureka once and returns their services side by
+// side, sorted by name, without changing anything.
+func Inspect(ctx context.Context, namespaceID, eurekaPrefix, awsPrefix string, stale bool, awsClient *sd.Client, eurekaClient *_e.Client, opts ...Option) ([]CatalogService, error) {
+	o := newOptions(hclog.Default().Named("inspect"), opts)
+	eureka, aws := newSyncers(o, true, false, eurekaPrefix, awsPrefix, 0, 0, stale, awsClient, eurekaClient)
+	if err := aws.setupNamespace(ctx, namespaceID); err != nil {
+		return nil, fmt.Errorf("cannot setup namespace %s: %s", namespaceID, err)
+	}
+	if err := aws.fetch(ctx); err != nil {
+		return nil, fmt.Errorf("cannot fetch aws: %s", err)
+	}
+	if err := eureka.fetch(ctx); err != nil {
+		return nil, fmt.Errorf("cannot fetch eureka: %s", err)
+	}
+	return aws.inspect(eureka.getServices(), aws.getServices(), eureka.deletions), nil
+}
+
+// inspect merges the services of both sides. What a sync would register or
+// update comes from diffToAWS; instances and services are only deregistered
+// and deleted if they are owned, and labelled pending guard instead when the
+// sync would hold the removals back, before the first fetch of CloudMap or
+// because of deletions.
+func (a *aws) inspect(eurekaServices, awsServices map[string]service, deletions *deletionGuard) []CatalogService {
+	create := a.diffToAWS(eurekaServices, awsServices)
+	held := "waiting for the first fetch of CloudMap"
+	if a.ready() {
+		held, _ = deletions.check(a.diffFromAWS(awsServices, eurekaServices), nil, eurekaServices, awsServices)
+	}
+	names := map[string]bool{}
+	for k := range eurekaServices {
+		names[k] = true
+	}
+	for k := range awsServices {
+		names[k] = true
+	}
+
+	result := make([]CatalogService, 0, len(names))
+	for k := range names {
+		es, inEureka := eurekaServices[k]
+		as, inAWS := awsServices[k]
+		cs := CatalogService{Name: k, InEureka: inEureka, CloudMapID: as.awsID, Owned: inAWS && as.fromEureka}
+
+		instances := map[string]*CatalogInstance{}
+		for _, nodes := range as.nodes {
+			for _, n := range nodes {
+				instances[n.awsID] = &CatalogInstance{ID: n.awsID, Host: n.host, Port: n.port,
+					InCloudMap: true, CloudMapHealth: displayHealth(as.healths, n.awsID)}
+			}
+		}
+		for _, nodes := range es.nodes {
+			for _, n := range nodes {
+				i, ok := instances[n.instanceID]
+				if !ok {
+					i = &CatalogInstance{ID: n.instanceID}
+					instances[n.instanceID] = i
+				}
+				i.Host, i.Port = n.host, n.port
+				i.InEureka = true
+				i.EurekaHealth = displayHealth(es.healths, n.instanceID)
+			}
+		}
+
+		cs.Instances = make([]CatalogInstance, 0, len(instances))
+		changed := map[string]bool{}
+		for _, nodes := range create[k].nodes {
+			for _, n := range nodes {
+				changed[n.instanceID] = true
+			}
+		}
+		for id, i := range instances {
+			_, health := create[k].healths[id]
+			switch {
+			case i.InEureka && !i.InCloudMap:
+				i.Diff = DiffRegister
+				cs.Diff.Register++
+			case changed[id]:
+				i.Diff = DiffReregister
+				cs.Diff.Reregister++
+			case !i.InEureka && cs.Owned && len(held) > 0:
+				i.Diff = DiffPendingGuard
+				cs.Diff.PendingGuard++
+			case !i.InEureka && cs.Owned:
+				i.Diff = DiffDeregister
+				cs.Diff.Deregister++
+			case health:
+				i.Diff = DiffHealth
+				cs.Diff.Health++
+			}
+			cs.Instances = append(cs.Instances, *i)
+		}
+		sort.Slice(cs.Instances, func(i, j int) bool { return cs.Instances[i].ID < cs.Instances[j].ID })
+		cs.Diff.CreateService = inEureka && !inAWS
+		cs.Diff.DeleteService = cs.Owned && !inEureka
+		if cs.Diff.DeleteService && len(held) > 0 {
+			cs.Diff.DeleteService = false
+			cs.Diff.PendingGuard++
+		}
+		if cs.Diff.PendingGuard > 0 {
+			cs.Held = held
+		}
+		result = append(result, cs)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// displayHealth returns the health of instance id the same way for both
+// sides, or nothing if it has none.
+func displayHealth(healths map[string]health, id string) string {
+	h, ok := healths[id]
+	if !ok {
+		return ""
+	}
+	switch h {
+	case up, healthy:
+		return string(healthy)
+	case unhealthy, out_of_service:
+		return string(unhealthy)
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,103 @@
+package catalog
+
+import (
+	"testing"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSInspect(t *testing.T) {
+	a := newTestAWS(newFakeCloudMap())
+	web1 := node{host: "1.1.1.1", port: 80, instanceID: "web-1"}
+	web2 := node{host: "1.1.1.2", port: 80, instanceID: "web-2", attributes: map[string]string{"homePageUrl": "new"}}
+	web3 := node{host: "1.1.1.3", port: 80, instanceID: "web-3"}
+	eurekaServices := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: web1}, "1.1.1.2": {80: web2}, "1.1.1.3": {80: web3},
+		}, healths: map[string]health{"web-1": unhealthy, "web-2": healthy, "web-3": healthy}},
+		"db": {name: "db", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.5": {80: {host: "1.1.1.5", port: 80, instanceID: "db-1"}},
+		}},
+	}
+	awsServices := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, customHealth: &sd.HealthCheckCustomConfig{},
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1", attributes: a.instanceAttributes(web1)}},
+				"1.1.1.2": {80: {host: "1.1.1.2", port: 80, awsID: "web-2"}},
+				"1.1.1.4": {80: {host: "1.1.1.4", port: 80, awsID: "web-4"}},
+			}, healths: map[string]health{"web-1": up, "web-2": up, "web-4": unknown}},
+		"legacy": {name: "legacy", awsID: "srv-2", nodes: map[string]map[int]node{
+			"1.1.1.6": {80: {host: "1.1.1.6", port: 80, awsID: "legacy-1"}},
+		}},
+		"old": {name: "old", awsID: "srv-3", fromEureka: true},
+	}
+	a.services = awsServices
+
+	services := a.inspect(eurekaServices, awsServices, nil)
+	require.Len(t, services, 4)
+	db, legacy, old, web := services[0], services[1], services[2], services[3]
+
+	require.Equal(t, "db", db.Name)
+	require.True(t, db.Diff.CreateService)
+	require.Equal(t, []CatalogInstance{{ID: "db-1", Host: "1.1.1.5", Port: 80, InEureka: true, Diff: DiffRegister}}, db.Instances)
+
+	// services not owned are never changed
+	require.False(t, legacy.Owned)
+	require.True(t, legacy.Diff.InSync())
+	require.Equal(t, "in sync", legacy.Diff.String())
+	require.True(t, old.Owned)
+	require.Equal(t, CatalogDiff{DeleteService: true}, old.Diff)
+	require.Empty(t, old.Instances)
+
+	require.True(t, web.Owned)
+	require.Equal(t, "srv-1", web.CloudMapID)
+	require.Equal(t, []CatalogInstance{
+		{ID: "web-1", Host: "1.1.1.1", Port: 80, InEureka: true, EurekaHealth: "UNHEALTHY", InCloudMap: true, CloudMapHealth: "HEALTHY", Diff: DiffHealth},
+		{ID: "web-2", Host: "1.1.1.2", Port: 80, InEureka: true, EurekaHealth: "HEALTHY", InCloudMap: true, CloudMapHealth: "HEALTHY", Diff: DiffReregister},
+		{ID: "web-3", Host: "1.1.1.3", Port: 80, InEureka: true, EurekaHealth: "HEALTHY", Diff: DiffRegister},
+		{ID: "web-4", Host: "1.1.1.4", Port: 80, InCloudMap: true, CloudMapHealth: "UNKNOWN", Diff: DiffDeregister},
+	}, web.Instances)
+	require.Equal(t, "register 1, reregister 1, deregister 1, health 1", web.Diff.String())
+}
+
+func TestAWSInspectPendingGuard(t *testing.T) {
+	a := newTestAWS(newFakeCloudMap())
+	web1 := node{host: "1.1.1.1", port: 80, instanceID: "web-1"}
+	eurekaServices := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.1": {80: web1}}},
+	}
+	awsServices := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1", attributes: a.instanceAttributes(web1)}},
+			"1.1.1.2": {80: {host: "1.1.1.2", port: 80, awsID: "web-2"}},
+		}},
+		"old": {name: "old", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "old-1"}},
+		}},
+	}
+	a.services = awsServices
+
+	// removals are shown like the sync does them below the threshold
+	services := a.inspect(eurekaServices, awsServices, newDeletionGuard(1, 0))
+	old, web := services[0], services[1]
+	require.Equal(t, CatalogDiff{DeleteService: true, Deregister: 1}, old.Diff)
+	require.Empty(t, old.Held)
+	require.Equal(t, DiffDeregister, web.Instances[1].Diff)
+
+	// and as pending when the sync would hold them back
+	a.fetched = false
+	services = a.inspect(eurekaServices, awsServices, nil)
+	old, web = services[0], services[1]
+	require.Equal(t, CatalogDiff{PendingGuard: 2}, old.Diff)
+	require.Equal(t, "pending guard 2", old.Diff.String())
+	require.Equal(t, "waiting for the first fetch of CloudMap", old.Held)
+	require.Equal(t, DiffPendingGuard, web.Instances[1].Diff)
+	require.Equal(t, CatalogDiff{PendingGuard: 1}, web.Diff)
+
+	a.fetched = true
+	services = a.inspect(eurekaServices, awsServices, newDeletionGuard(0, 0.4))
+	old = services[0]
+	require.Equal(t, CatalogDiff{PendingGuard: 2}, old.Diff)
+	require.Equal(t, "1 of 2 owned services would be deleted, more than 40%", old.Held)
+}
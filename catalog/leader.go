@@ -0,0 +1,133 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Roles of a Sync reported by Status.
+const (
+	RoleLeader  = "leader"
+	RoleStandby = "standby"
+)
+
+// ErrNotLeader is returned when forcing a reconcile on a standby.
+var ErrNotLeader = errors.New("not the leader")
+
+// LeaderLock is held by at most one of several replicas of Sync. Only the
+// holder changes CloudMap; the others keep fetching so they can take over
+// with warm caches.
+type LeaderLock interface {
+	// Acquire takes the lock, or renews it if it is held already, and
+	// reports whether it is held.
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives up the lock if it is held.
+	Release(ctx context.Context) error
+}
+
+// leader campaigns for a LeaderLock. A nil leader is always the leader, so
+// Sync without leader election mutates as usual.
+type leader struct {
+	lock          LeaderLock
+	renewInterval time.Duration
+	log           hclog.Logger
+	status        *Status
+	held          int32
+}
+
+func (l *leader) isLeader() bool {
+	return l == nil || atomic.LoadInt32(&l.held) == 1
+}
+
+// run acquires or renews the lock every renewInterval until stop is closed
+// and releases it then. Failing to renew it steps down right away, since the
+// lock may expire before the next attempt.
+func (l *leader) run(ctx context.Context, stop <-chan struct{}) {
+	for {
+		held, err := l.lock.Acquire(ctx)
+		if err != nil {
+			l.log.Error("cannot acquire leader lock", "error", err)
+		}
+		l.set(held && err == nil)
+		select {
+		case <-stop:
+			if l.isLeader() {
+				if err := l.lock.Release(ctx); err != nil {
+					l.log.Error("cannot release leader lock", "error", err)
+				}
+			}
+			l.set(false)
+			return
+		case <-time.After(l.renewInterval):
+		}
+	}
+}
+
+func (l *leader) set(held bool) {
+	v := int32(0)
+	role := RoleStandby
+	if held {
+		v = 1
+		role = RoleLeader
+	}
+	if atomic.SwapInt32(&l.held, v) != v {
+		l.log.Info("changed role", "role", role)
+	}
+	l.status.setRole(role)
+}
+
+// FileLock is a LeaderLock for replicas on the same host: the leader holds
+// an exclusive lock on a file. The operating system releases it when the
+// leader exits, even if it crashed. It isn't supported on all platforms.
+type FileLock struct {
+	path string
+	lock sync.Mutex
+	f    *os.File
+}
+
+// NewFileLock returns a FileLock on the file at path, which is created if it
+// doesn't exist.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Acquire implements LeaderLock.
+func (l *FileLock) Acquire(context.Context) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.f != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		f.Close()
+		return false, err
+	}
+	l.f = f
+	return true, nil
+}
+
+// Release implements LeaderLock.
+func (l *FileLock) Release(context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
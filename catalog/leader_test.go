@@ -0,0 +1,304 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eureka-aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lock")
+	a, b := NewFileLock(path), NewFileLock(path)
+	ctx := context.Background()
+
+	held, err := a.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	held, err = a.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	held, err = b.Acquire(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	require.NoError(t, a.Release(ctx))
+	require.NoError(t, a.Release(ctx))
+	held, err = b.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	require.NoError(t, b.Release(ctx))
+}
+
+// fakeLock is held as long as held is set.
+type fakeLock struct {
+	lock     sync.Mutex
+	held     bool
+	err      error
+	released int
+}
+
+func (l *fakeLock) set(held bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.held, l.err = held, err
+}
+
+func (l *fakeLock) Acquire(context.Context) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.held, l.err
+}
+
+func (l *fakeLock) Release(context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.released++
+	return nil
+}
+
+func TestLeaderRun(t *testing.T) {
+	require.True(t, (*leader)(nil).isLeader())
+
+	lock := &fakeLock{}
+	status := NewStatus()
+	l := &leader{lock: lock, renewInterval: time.Millisecond, log: hclog.NewNullLogger(), status: status}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.run(context.Background(), stop)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return status.Role() == RoleStandby }, time.Second, time.Millisecond)
+	require.False(t, l.isLeader())
+	lock.set(true, nil)
+	require.Eventually(t, l.isLeader, time.Second, time.Millisecond)
+	require.Equal(t, RoleLeader, status.Role())
+
+	// failing to renew steps down
+	lock.set(true, errors.New("timeout"))
+	require.Eventually(t, func() bool { return !l.isLeader() }, time.Second, time.Millisecond)
+	lock.set(true, nil)
+	require.Eventually(t, l.isLeader, time.Second, time.Millisecond)
+
+	close(stop)
+	<-done
+	require.Equal(t, 1, lock.released)
+	require.Equal(t, RoleStandby, status.Role())
+}
+
+func TestEurekaSyncStandby(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	e := &eureka{
+		log:     hclog.NewNullLogger(),
+		trigger: make(chan bool, 1),
+		toAWS:   true,
+		metrics: nopMetrics{},
+		tracer:  trace.NoopTracer{},
+		leader:  &leader{},
+		services: map[string]service{
+			"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+			}},
+		},
+	}
+	control := NewControl()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.sync(context.Background(), a, NewStatus(), control, stop)
+		close(done)
+	}()
+
+	e.trigger <- true
+	require.NoError(t, control.Reconcile(""))
+	require.Eventually(t, func() bool { return len(e.trigger) == 0 && len(control.reconcile) == 0 },
+		time.Second, time.Millisecond)
+	close(stop)
+	<-done
+	require.Empty(t, f.inputs("CreateService"))
+}
+
+// fakeLeaseCloudMap keeps the services and instances of a fakeCloudMap.
+// Creating a service whose name is taken fails like in CloudMap.
+func fakeLeaseCloudMap() *fakeCloudMap {
+	f := newFakeCloudMap()
+	var lock sync.Mutex
+	services := []sd.ServiceSummary{}
+	instances := map[string]map[string]string{}
+	f.handle("ListServices", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return &sd.ListServicesOutput{Services: append([]sd.ServiceSummary(nil), services...)}, nil
+	})
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		in := input.(*sd.CreateServiceInput)
+		for _, s := range services {
+			if *s.Name == *in.Name {
+				return nil, awserr.New(sd.ErrCodeServiceAlreadyExists, "exists", nil)
+			}
+		}
+		id := x.String("srv-" + *in.Name)
+		services = append(services, sd.ServiceSummary{Id: id, Name: in.Name, Description: in.Description})
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: id}}, nil
+	})
+	f.handle("DeleteService", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		id := *input.(*sd.DeleteServiceInput).Id
+		for i, s := range services {
+			if *s.Id == id {
+				services = append(services[:i], services[i+1:]...)
+				break
+			}
+		}
+		return &sd.DeleteServiceOutput{}, nil
+	})
+	f.handle("RegisterInstance", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		in := input.(*sd.RegisterInstanceInput)
+		instances[*in.ServiceId+"/"+*in.InstanceId] = in.Attributes
+		return nil, nil
+	})
+	f.handle("DeregisterInstance", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		in := input.(*sd.DeregisterInstanceInput)
+		delete(instances, *in.ServiceId+"/"+*in.InstanceId)
+		return nil, nil
+	})
+	f.handle("GetInstance", func(input interface{}) (interface{}, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		in := input.(*sd.GetInstanceInput)
+		attributes, ok := instances[*in.ServiceId+"/"+*in.InstanceId]
+		if !ok {
+			return nil, awserr.New(sd.ErrCodeInstanceNotFound, "not found", nil)
+		}
+		return &sd.GetInstanceOutput{Instance: &sd.Instance{Id: in.InstanceId, Attributes: attributes}}, nil
+	})
+	return f
+}
+
+func TestCloudMapLease(t *testing.T) {
+	f := fakeLeaseCloudMap()
+	a := newTestAWS(f)
+	now := time.Now()
+	one := a.newLease("eureka-aws-leader", "one", time.Minute)
+	one.now = func() time.Time { return now }
+	two := a.newLease("eureka-aws-leader", "two", time.Minute)
+	two.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	held, err := one.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	held, err = two.Acquire(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+	require.Len(t, f.inputs("CreateService"), 1)
+	require.Equal(t, "eureka-aws-leader-1", *f.inputs("CreateService")[0].(*sd.CreateServiceInput).Name)
+	register := f.inputs("RegisterInstance")[0].(*sd.RegisterInstanceInput)
+	require.Equal(t, "leader", *register.InstanceId)
+	require.Equal(t, "one", register.Attributes["holder"])
+	require.Equal(t, "127.0.0.1", register.Attributes[awsInstanceIPv4])
+
+	// renewing stays in the epoch
+	held, err = one.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	require.Len(t, f.inputs("CreateService"), 1)
+
+	// the lease is taken over once it expired, in the next epoch
+	two.now = func() time.Time { return now.Add(2 * time.Minute) }
+	held, err = two.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	require.Equal(t, "eureka-aws-leader-2", *f.inputs("CreateService")[1].(*sd.CreateServiceInput).Name)
+	require.Equal(t, "srv-eureka-aws-leader-1", *f.inputs("DeleteService")[0].(*sd.DeleteServiceInput).Id)
+	held, err = one.Acquire(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	// releasing a lease of someone else doesn't change it
+	deregistered := len(f.inputs("DeregisterInstance"))
+	require.NoError(t, one.Release(ctx))
+	require.Len(t, f.inputs("DeregisterInstance"), deregistered)
+	require.NoError(t, two.Release(ctx))
+	require.Len(t, f.inputs("DeregisterInstance"), deregistered+1)
+	held, err = one.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+}
+
+func TestCloudMapLeaseRace(t *testing.T) {
+	f := fakeLeaseCloudMap()
+	a := newTestAWS(f)
+	ctx := context.Background()
+
+	// of replicas taking an expired lease at the same time only one wins
+	leases := make([]*cloudMapLease, 5)
+	for i := range leases {
+		leases[i] = a.newLease("eureka-aws-leader", fmt.Sprintf("replica-%d", i), time.Minute)
+	}
+	var wg sync.WaitGroup
+	held := make([]bool, len(leases))
+	for i, l := range leases {
+		i, l := i, l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			held[i], err = l.Acquire(ctx)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	leaders := 0
+	for _, h := range held {
+		if h {
+			leaders++
+		}
+	}
+	require.Equal(t, 1, leaders)
+}
+
+func TestAWSFetchSkipsLease(t *testing.T) {
+	f := fakeLeaseCloudMap()
+	a := newTestAWS(f)
+	ctx := context.Background()
+	held, err := a.newLease("eureka-aws-leader", "one", time.Minute).Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+	_, err = a.client.CreateServiceRequest(&sd.CreateServiceInput{Name: x.String("web"), Description: &awsServiceDescription}).Send(ctx)
+	require.NoError(t, err)
+
+	// the lease is in the namespace but neither synced nor inspected
+	require.NoError(t, a.fetch(ctx))
+	services := a.getServices()
+	require.Len(t, services, 1)
+	require.Contains(t, services, "web")
+	inspected := a.inspect(map[string]service{}, services, nil)
+	require.Len(t, inspected, 1)
+	require.Equal(t, "web", inspected[0].Name)
+}
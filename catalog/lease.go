@@ -0,0 +1,271 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+)
+
+const (
+	// leaseInstanceID is the well-known instance whose attributes hold the
+	// lease.
+	leaseInstanceID = "leader"
+	leaseHolder     = "holder"
+	leaseExpires    = "expires"
+
+	leaseServiceDescription = "Leader lease of eureka-aws"
+)
+
+// cloudMapLease is a LeaderLock for replicas on different hosts. CloudMap has
+// no compare-and-swap on instances, but creating a service whose name is
+// taken fails, so the lease is held in epochs: the service <service>-<epoch>
+// belongs to the replica that created it, and the attributes of its
+// well-known instance hold the expiry, which only that replica renews.
+// Standbys take over an expired or released lease by creating the service of
+// the next epoch, which only one of them succeeds at, and remove the ones
+// before. Clocks of the replicas should be synchronized well within the lease
+// ttl.
+type cloudMapLease struct {
+	aws     *aws
+	service string
+	holder  string
+	ttl     time.Duration
+	now     func() time.Time
+
+	lock sync.Mutex
+	// epoch is the epoch held and serviceID its service, 0 and empty
+	// while none is held.
+	epoch     int
+	serviceID string
+}
+
+func (a *aws) newLease(service, holder string, ttl time.Duration) *cloudMapLease {
+	return &cloudMapLease{aws: a, service: service, holder: holder, ttl: ttl, now: time.Now}
+}
+
+// isLeaseService reports whether s holds a leader lease, whatever the lease
+// service is called.
+func isLeaseService(s sd.ServiceSummary) bool {
+	return x.StringValue(s.Description) == leaseServiceDescription
+}
+
+// Acquire implements LeaderLock.
+func (l *cloudMapLease) Acquire(ctx context.Context) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	epoch, id, older, err := l.latest(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := l.now()
+	if epoch == 0 || epoch != l.epoch {
+		l.epoch, l.serviceID = 0, ""
+		holder := ""
+		if epoch > 0 {
+			var expires time.Time
+			holder, expires, err = l.current(ctx, id)
+			if err != nil {
+				return false, err
+			}
+			if holder == l.holder {
+				// held by this replica before it restarted
+				l.epoch, l.serviceID = epoch, id
+			} else if len(holder) > 0 && now.Before(expires) {
+				return false, nil
+			}
+		}
+		if l.epoch == 0 {
+			next, err := l.createEpoch(ctx, epoch+1)
+			if err != nil || len(next) == 0 {
+				return false, err
+			}
+			l.aws.log.Info("took over leader lease", "service", l.service, "epoch", epoch+1, "previous", holder)
+			l.epoch, l.serviceID = epoch+1, next
+			if epoch > 0 {
+				older = append(older, id)
+			}
+		}
+	}
+
+	if err := l.renew(ctx, now); err != nil {
+		return false, err
+	}
+	for _, id := range older {
+		l.removeEpoch(ctx, id)
+	}
+	return true, nil
+}
+
+// Release implements LeaderLock.
+func (l *cloudMapLease) Release(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.epoch == 0 {
+		return nil
+	}
+	id := l.serviceID
+	l.epoch, l.serviceID = 0, ""
+	return l.deregister(ctx, id)
+}
+
+// latest returns the latest epoch and its service ID, 0 if there is none,
+// and the IDs of the services of the epochs before it.
+func (l *cloudMapLease) latest(ctx context.Context) (int, string, []string, error) {
+	services, err := l.aws.fetchServices(ctx)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	epoch, id := 0, ""
+	var older []string
+	for _, s := range services {
+		name := x.StringValue(s.Name)
+		if !isLeaseService(s) || !strings.HasPrefix(name, l.service+"-") {
+			continue
+		}
+		e, err := strconv.Atoi(strings.TrimPrefix(name, l.service+"-"))
+		if err != nil || e <= 0 {
+			continue
+		}
+		if e > epoch {
+			if epoch > 0 {
+				older = append(older, id)
+			}
+			epoch, id = e, x.StringValue(s.Id)
+		} else {
+			older = append(older, x.StringValue(s.Id))
+		}
+	}
+	return epoch, id, older, nil
+}
+
+// createEpoch creates the service of epoch and returns its ID, or an empty
+// ID if another replica created it first.
+func (l *cloudMapLease) createEpoch(ctx context.Context, epoch int) (string, error) {
+	input := sd.CreateServiceInput{
+		Name:             x.String(fmt.Sprintf("%s-%d", l.service, epoch)),
+		NamespaceId:      &l.aws.namespace.id,
+		CreatorRequestId: creatorRequestID(),
+		Description:      x.String(leaseServiceDescription),
+	}
+	if !l.aws.namespace.isHTTP {
+		input.DnsConfig = &sd.DnsConfig{
+			DnsRecords: []sd.DnsRecord{{Type: sd.RecordTypeA, TTL: x.Int64(l.aws.dnsTTL)}},
+		}
+	}
+	var resp *sd.CreateServiceResponse
+	err := l.aws.retry(ctx, "CreateService", func(ctx context.Context) (err error) {
+		req := l.aws.client.CreateServiceRequest(&input)
+		resp, err = req.Send(ctx)
+		return err
+	})
+	if err, ok := err.(awserr.Error); ok && err.Code() == sd.ErrCodeServiceAlreadyExists {
+		l.aws.log.Debug("leader lease taken by another replica", "service", *input.Name)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot create lease service %s: %s", *input.Name, err)
+	}
+	return x.StringValue(resp.Service.Id), nil
+}
+
+// renew registers the lease instance of the epoch held, expiring ttl after
+// now.
+func (l *cloudMapLease) renew(ctx context.Context, now time.Time) error {
+	attributes := map[string]string{
+		leaseHolder:  l.holder,
+		leaseExpires: now.Add(l.ttl).UTC().Format(time.RFC3339),
+	}
+	if !l.aws.namespace.isHTTP {
+		// DNS namespaces require an address; the lease service is only
+		// looked up through the API.
+		attributes[awsInstanceIPv4] = "127.0.0.1"
+	}
+	input := sd.RegisterInstanceInput{
+		ServiceId:        &l.serviceID,
+		InstanceId:       x.String(leaseInstanceID),
+		CreatorRequestId: creatorRequestID(),
+		Attributes:       attributes,
+	}
+	var resp *sd.RegisterInstanceResponse
+	err := l.aws.retry(ctx, "RegisterInstance", func(ctx context.Context) (err error) {
+		req := l.aws.client.RegisterInstanceRequest(&input)
+		resp, err = req.Send(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return l.aws.operations.track(ctx, "register", l.serviceID, leaseInstanceID, resp.OperationId)
+}
+
+func (l *cloudMapLease) deregister(ctx context.Context, id string) error {
+	var resp *sd.DeregisterInstanceResponse
+	err := l.aws.retry(ctx, "DeregisterInstance", func(ctx context.Context) (err error) {
+		req := l.aws.client.DeregisterInstanceRequest(&sd.DeregisterInstanceInput{
+			ServiceId:  &id,
+			InstanceId: x.String(leaseInstanceID),
+		})
+		resp, err = req.Send(ctx)
+		return err
+	})
+	if err, ok := err.(awserr.Error); ok && err.Code() == sd.ErrCodeInstanceNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return l.aws.operations.track(ctx, "deregister", id, leaseInstanceID, resp.OperationId)
+}
+
+// removeEpoch deletes the service of a previous epoch. Failures are only
+// logged, the next renewal tries again.
+func (l *cloudMapLease) removeEpoch(ctx context.Context, id string) {
+	err := l.deregister(ctx, id)
+	if err == nil {
+		err = l.aws.retry(ctx, "DeleteService", func(ctx context.Context) error {
+			req := l.aws.client.DeleteServiceRequest(&sd.DeleteServiceInput{Id: &id})
+			_, err := req.Send(ctx)
+			return err
+		})
+	}
+	if err != nil {
+		l.aws.log.Warn("cannot remove previous leader lease", "id", id, "error", err)
+	}
+}
+
+// current returns the holder and expiry of the lease. The holder is empty if
+// nobody holds it.
+func (l *cloudMapLease) current(ctx context.Context, id string) (string, time.Time, error) {
+	var resp *sd.GetInstanceResponse
+	err := l.aws.retry(ctx, "GetInstance", func(ctx context.Context) (err error) {
+		req := l.aws.client.GetInstanceRequest(&sd.GetInstanceInput{
+			ServiceId:  &id,
+			InstanceId: x.String(leaseInstanceID),
+		})
+		resp, err = req.Send(ctx)
+		return err
+	})
+	if err, ok := err.(awserr.Error); ok && err.Code() == sd.ErrCodeInstanceNotFound {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.Instance == nil {
+		return "", time.Time{}, nil
+	}
+	attributes := resp.Instance.Attributes
+	expires, err := time.Parse(time.RFC3339, attributes[leaseExpires])
+	if err != nil {
+		// a lease that can't be read is taken over
+		return "", time.Time{}, nil
+	}
+	return attributes[leaseHolder], expires, nil
+}
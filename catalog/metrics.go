@@ -0,0 +1,234 @@
+package catalog
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives the metrics of the sync. Names are dot separated, tags
+// are key:value pairs as in statsd.
+type Metrics interface {
+	Count(name string, value int64, tags []string)
+	Gauge(name string, value float64, tags []string)
+	Timing(name string, value time.Duration, tags []string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Count(string, int64, []string)          {}
+func (nopMetrics) Gauge(string, float64, []string)        {}
+func (nopMetrics) Timing(string, time.Duration, []string) {}
+
+type multiMetrics []Metrics
+
+// MultiMetrics sends metrics to all sinks.
+func MultiMetrics(sinks ...Metrics) Metrics {
+	return multiMetrics(sinks)
+}
+
+func (m multiMetrics) Count(name string, value int64, tags []string) {
+	for _, s := range m {
+		s.Count(name, value, tags)
+	}
+}
+
+func (m multiMetrics) Gauge(name string, value float64, tags []string) {
+	for _, s := range m {
+		s.Gauge(name, value, tags)
+	}
+}
+
+func (m multiMetrics) Timing(name string, value time.Duration, tags []string) {
+	for _, s := range m {
+		s.Timing(name, value, tags)
+	}
+}
+
+type taggedMetrics struct {
+	sink Metrics
+	tags []string
+}
+
+// TaggedMetrics adds tags to every metric sent to sink.
+func TaggedMetrics(sink Metrics, tags ...string) Metrics {
+	if len(tags) == 0 {
+		return sink
+	}
+	return &taggedMetrics{sink: sink, tags: tags}
+}
+
+func (m *taggedMetrics) with(tags []string) []string {
+	result := make([]string, 0, len(m.tags)+len(tags))
+	result = append(result, m.tags...)
+	return append(result, tags...)
+}
+
+func (m *taggedMetrics) Count(name string, value int64, tags []string) {
+	m.sink.Count(name, value, m.with(tags))
+}
+
+func (m *taggedMetrics) Gauge(name string, value float64, tags []string) {
+	m.sink.Gauge(name, value, m.with(tags))
+}
+
+func (m *taggedMetrics) Timing(name string, value time.Duration, tags []string) {
+	m.sink.Timing(name, value, m.with(tags))
+}
+
+type statsdMetrics struct {
+	client *statsd.Client
+	log    hclog.Logger
+}
+
+// NewStatsdMetrics sends metrics to the statsd or DogStatsD agent at addr.
+func NewStatsdMetrics(addr string, log hclog.Logger) (Metrics, error) {
+	client, err := statsd.New(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{client: client, log: log}, nil
+}
+
+func (m *statsdMetrics) Count(name string, value int64, tags []string) {
+	if err := m.client.Count(name, value, tags, 1); err != nil {
+		m.log.Error("Unable to post to statsd", "error", err)
+	}
+}
+
+func (m *statsdMetrics) Gauge(name string, value float64, tags []string) {
+	if err := m.client.Gauge(name, value, tags, 1); err != nil {
+		m.log.Error("Unable to post to statsd", "error", err)
+	}
+}
+
+func (m *statsdMetrics) Timing(name string, value time.Duration, tags []string) {
+	if err := m.client.Timing(name, value, tags, 1); err != nil {
+		m.log.Error("Unable to post to statsd", "error", err)
+	}
+}
+
+// prometheusMetrics registers a collector for every metric on first use.
+// Dots in names become underscores, counters get a _total and timings a
+// _seconds suffix. A metric must always be sent with the same tag keys.
+type prometheusMetrics struct {
+	registerer prometheus.Registerer
+	log        hclog.Logger
+
+	lock       sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// NewPrometheusMetrics registers metrics with r, for example
+// prometheus.DefaultRegisterer, to be served on /metrics.
+func NewPrometheusMetrics(r prometheus.Registerer, log hclog.Logger) Metrics {
+	return &prometheusMetrics{
+		registerer: r,
+		log:        log,
+		counters:   map[string]*prometheus.CounterVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+	}
+}
+
+func prometheusName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// prometheusLabels splits statsd tags into label names and values.
+func prometheusLabels(tags []string) ([]string, prometheus.Labels) {
+	names := make([]string, 0, len(tags))
+	labels := prometheus.Labels{}
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		k := prometheusName(kv[0])
+		if _, ok := labels[k]; !ok {
+			names = append(names, k)
+		}
+		if len(kv) == 2 {
+			labels[k] = kv[1]
+		} else {
+			labels[k] = ""
+		}
+	}
+	return names, labels
+}
+
+func (m *prometheusMetrics) register(c prometheus.Collector) prometheus.Collector {
+	if err := m.registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		m.log.Error("cannot register metric", "error", err)
+	}
+	return c
+}
+
+func (m *prometheusMetrics) Count(name string, value int64, tags []string) {
+	if value < 0 {
+		return
+	}
+	names, labels := prometheusLabels(tags)
+	m.lock.Lock()
+	c, ok := m.counters[name]
+	if !ok {
+		c = m.register(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheusName(name) + "_total",
+			Help: name,
+		}, names)).(*prometheus.CounterVec)
+		m.counters[name] = c
+	}
+	m.lock.Unlock()
+	counter, err := c.GetMetricWith(labels)
+	if err != nil {
+		m.log.Error("cannot update metric", "name", name, "error", err)
+		return
+	}
+	counter.Add(float64(value))
+}
+
+func (m *prometheusMetrics) Gauge(name string, value float64, tags []string) {
+	names, labels := prometheusLabels(tags)
+	m.lock.Lock()
+	g, ok := m.gauges[name]
+	if !ok {
+		g = m.register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prometheusName(name),
+			Help: name,
+		}, names)).(*prometheus.GaugeVec)
+		m.gauges[name] = g
+	}
+	m.lock.Unlock()
+	gauge, err := g.GetMetricWith(labels)
+	if err != nil {
+		m.log.Error("cannot update metric", "name", name, "error", err)
+		return
+	}
+	gauge.Set(value)
+}
+
+func (m *prometheusMetrics) Timing(name string, value time.Duration, tags []string) {
+	names, labels := prometheusLabels(tags)
+	m.lock.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = m.register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: prometheusName(name) + "_seconds",
+			Help: name,
+		}, names)).(*prometheus.HistogramVec)
+		m.histograms[name] = h
+	}
+	m.lock.Unlock()
+	histogram, err := h.GetMetricWith(labels)
+	if err != nil {
+		m.log.Error("cannot update metric", "name", name, "error", err)
+		return
+	}
+	histogram.Observe(value.Seconds())
+}
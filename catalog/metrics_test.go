@@ -0,0 +1,115 @@
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics keeps the counters it receives as "name tags" keys.
+type recordingMetrics struct {
+	nopMetrics
+	lock   sync.Mutex
+	counts map[string]int64
+	gauges map[string]float64
+}
+
+func (m *recordingMetrics) Count(name string, value int64, tags []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.counts == nil {
+		m.counts = map[string]int64{}
+	}
+	m.counts[name+" "+strings.Join(tags, ",")] += value
+}
+
+func (m *recordingMetrics) Gauge(name string, value float64, tags []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.gauges == nil {
+		m.gauges = map[string]float64{}
+	}
+	m.gauges[name+" "+strings.Join(tags, ",")] = value
+}
+
+func TestTaggedMetrics(t *testing.T) {
+	m := &recordingMetrics{}
+	require.Equal(t, m, TaggedMetrics(m))
+
+	tagged := TaggedMetrics(m, "environment:prod", "region:eu-west-1")
+	tags := []string{"service:web"}
+	tagged.Count("eureka_aws.sync.aws.services.updated_count", 1, tags)
+	tagged.Gauge("eureka_aws.sync.aws.instances.count", 3, tags)
+	tagged.Gauge("eureka_aws.sync.aws.services.count", 1, nil)
+	require.Equal(t, []string{"service:web"}, tags)
+	require.Equal(t, map[string]int64{
+		"eureka_aws.sync.aws.services.updated_count environment:prod,region:eu-west-1,service:web": 1,
+	}, m.counts)
+	require.Equal(t, map[string]float64{
+		"eureka_aws.sync.aws.instances.count environment:prod,region:eu-west-1,service:web": 3,
+		"eureka_aws.sync.aws.services.count environment:prod,region:eu-west-1":              1,
+	}, m.gauges)
+}
+
+func TestAWSRetryMetrics(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	m := &recordingMetrics{}
+	a.metrics = m
+	a.retries = RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, ThrottleDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	calls := 0
+	err := a.retry(context.Background(), "GetService", func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return awserr.New("ThrottlingException", "slow down", nil)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{
+		"eureka_aws.sync.aws.api.calls operation:GetService,result:throttled": 1,
+		"eureka_aws.sync.aws.api.calls operation:GetService,result:success":   1,
+	}, m.counts)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := NewPrometheusMetrics(r, hclog.NewNullLogger())
+	m.Count("eureka_aws.sync.aws.api.calls", 2, []string{"operation:GetService", "result:success"})
+	m.Count("eureka_aws.sync.aws.api.calls", 1, []string{"operation:GetService", "result:success"})
+	m.Gauge("eureka_aws.sync.aws.services.count", 4, []string{"environment:test"})
+	m.Timing("eureka_aws.sync.aws.fetch.duration", time.Second, []string{})
+	// inconsistent tags are dropped instead of panicking
+	m.Gauge("eureka_aws.sync.aws.services.count", 4, []string{"other:test"})
+
+	families, err := r.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range families {
+		names = append(names, f.GetName())
+		switch f.GetName() {
+		case "eureka_aws_sync_aws_api_calls_total":
+			require.Equal(t, 3.0, f.GetMetric()[0].GetCounter().GetValue())
+		case "eureka_aws_sync_aws_services_count":
+			require.Equal(t, "environment", f.GetMetric()[0].GetLabel()[0].GetName())
+			require.Equal(t, 4.0, f.GetMetric()[0].GetGauge().GetValue())
+		case "eureka_aws_sync_aws_fetch_duration_seconds":
+			require.Equal(t, uint64(1), f.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{
+		"eureka_aws_sync_aws_api_calls_total",
+		"eureka_aws_sync_aws_fetch_duration_seconds",
+		"eureka_aws_sync_aws_services_count",
+	}, names)
+}
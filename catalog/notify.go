@@ -0,0 +1,277 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Types of Event.
+const (
+	EventServiceCreated = "service.created"
+	EventServiceRemoved = "service.removed"
+	EventWorkerFailing  = "worker.failing"
+	EventMassDeletion   = "deletion.mass"
+)
+
+// maxQueuedEvents is the number of events a WebhookNotifier buffers before
+// it drops new ones.
+const maxQueuedEvents = 1000
+
+// Event is a change or failure of Sync worth telling a human about.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	SyncID    string    `json:"syncId,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	ServiceID string    `json:"serviceId,omitempty"`
+	Worker    string    `json:"worker,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// text describes e in a line for chat messages.
+func (e Event) text() string {
+	var s string
+	switch e.Type {
+	case EventServiceCreated:
+		s = fmt.Sprintf("Created service %s in CloudMap", e.Service)
+	case EventServiceRemoved:
+		s = fmt.Sprintf("Removed service %s from CloudMap", e.Service)
+	case EventWorkerFailing:
+		s = fmt.Sprintf("Worker %s failed %d times in a row", e.Worker, unhealthyFailures)
+	case EventMassDeletion:
+		s = "Holding back removals from CloudMap"
+	default:
+		s = e.Type
+	}
+	if len(e.Reason) > 0 {
+		s += ": " + e.Reason
+	}
+	if len(e.Error) > 0 {
+		s += ": " + e.Error
+	}
+	if len(e.SyncID) > 0 {
+		s = "[" + e.SyncID + "] " + s
+	}
+	return s
+}
+
+// Notifier receives the events of Sync. Notify must not block.
+type Notifier interface {
+	Notify(e Event)
+}
+
+type nopNotifier struct{}
+
+func (nopNotifier) Notify(Event) {}
+
+// WebhookConfig controls where and how a WebhookNotifier posts events.
+// Events are posted in batches of up to BatchSize, at the latest
+// BatchInterval after the first event of the batch. Failed posts are retried
+// up to MaxAttempts times with delays growing exponentially from RetryDelay.
+// Only the event types in Events are posted, or all if it is empty.
+type WebhookConfig struct {
+	URLs          []string
+	Events        []string
+	BatchSize     int
+	BatchInterval time.Duration
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	Timeout       time.Duration
+}
+
+// DefaultWebhookConfig returns the webhook settings used unless configured.
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		BatchSize:     20,
+		BatchInterval: 10 * time.Second,
+		MaxAttempts:   5,
+		RetryDelay:    1 * time.Second,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// webhookPayload is the body of a webhook post. Text makes it usable as a
+// Slack incoming webhook as is.
+type webhookPayload struct {
+	Text   string  `json:"text"`
+	Events []Event `json:"events"`
+}
+
+// WebhookNotifier posts events as JSON to webhook URLs in the background.
+// Close flushes the pending events.
+type WebhookNotifier struct {
+	config WebhookConfig
+	syncID string
+	types  map[string]bool
+	client *http.Client
+	log    hclog.Logger
+
+	events    chan Event
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWebhookNotifier starts posting events to the URLs of c, tagged with
+// syncID.
+func NewWebhookNotifier(c WebhookConfig, syncID string, log hclog.Logger) *WebhookNotifier {
+	if c.BatchSize < 1 {
+		c.BatchSize = 1
+	}
+	if c.MaxAttempts < 1 {
+		c.MaxAttempts = 1
+	}
+	n := &WebhookNotifier{
+		config:  c,
+		syncID:  syncID,
+		client:  &http.Client{Timeout: c.Timeout},
+		log:     log,
+		events:  make(chan Event, maxQueuedEvents),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if len(c.Events) > 0 {
+		n.types = map[string]bool{}
+		for _, t := range c.Events {
+			n.types[t] = true
+		}
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues e unless its type is filtered out. Events are dropped when
+// the queue is full or the notifier is closed.
+func (n *WebhookNotifier) Notify(e Event) {
+	if n.types != nil && !n.types[e.Type] {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(e.SyncID) == 0 {
+		e.SyncID = n.syncID
+	}
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+	select {
+	case n.events <- e:
+	default:
+		n.log.Warn("dropping event, too many queued", "type", e.Type)
+	}
+}
+
+// Close posts the pending events and stops the notifier.
+func (n *WebhookNotifier) Close() {
+	n.closeOnce.Do(func() { close(n.done) })
+	<-n.stopped
+}
+
+func (n *WebhookNotifier) run() {
+	defer close(n.stopped)
+	var batch []Event
+	var flush <-chan time.Time
+	for {
+		select {
+		case e := <-n.events:
+			batch = append(batch, e)
+			if len(batch) >= n.config.BatchSize {
+				n.post(batch)
+				batch, flush = nil, nil
+			} else if flush == nil {
+				flush = time.After(n.config.BatchInterval)
+			}
+		case <-flush:
+			n.post(batch)
+			batch, flush = nil, nil
+		case <-n.done:
+			n.drain(batch)
+			return
+		}
+	}
+}
+
+// drain posts batch and all queued events.
+func (n *WebhookNotifier) drain(batch []Event) {
+	for {
+		select {
+		case e := <-n.events:
+			batch = append(batch, e)
+			continue
+		default:
+		}
+		break
+	}
+	for len(batch) > 0 {
+		size := len(batch)
+		if size > n.config.BatchSize {
+			size = n.config.BatchSize
+		}
+		n.post(batch[:size])
+		batch = batch[size:]
+	}
+}
+
+// post sends batch to every URL.
+func (n *WebhookNotifier) post(batch []Event) {
+	lines := make([]string, 0, len(batch))
+	for _, e := range batch {
+		lines = append(lines, e.text())
+	}
+	body, err := json.Marshal(webhookPayload{Text: strings.Join(lines, "\n"), Events: batch})
+	if err != nil {
+		n.log.Error("cannot encode events", "error", err)
+		return
+	}
+	for _, url := range n.config.URLs {
+		if err := n.send(url, body); err != nil {
+			n.log.Error("cannot post events", "url", url, "events", len(batch), "error", err)
+		}
+	}
+}
+
+// send posts body to url until it is accepted, the receiver rejects it or
+// the attempts run out. Client errors other than 429 aren't retried.
+func (n *WebhookNotifier) send(url string, body []byte) error {
+	for attempt := 1; ; attempt++ {
+		retryable, err := n.attempt(url, body)
+		if err == nil || !retryable || attempt >= n.config.MaxAttempts {
+			return err
+		}
+		d := n.config.RetryDelay << uint(attempt-1)
+		n.log.Debug("retrying webhook", "url", url, "attempt", attempt, "delay", d, "error", err)
+		time.Sleep(d)
+	}
+}
+
+func (n *WebhookNotifier) attempt(url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,237 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the payloads posted to it. The first failures
+// requests are answered with status.
+type webhookReceiver struct {
+	lock     sync.Mutex
+	payloads []webhookPayload
+	requests int
+	failures int
+	status   int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		w.WriteHeader(r.status)
+		return
+	}
+	var p webhookPayload
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil || req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.payloads = append(r.payloads, p)
+}
+
+func (r *webhookReceiver) received() ([]webhookPayload, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]webhookPayload(nil), r.payloads...), r.requests
+}
+
+func testWebhookConfig(url string) WebhookConfig {
+	return WebhookConfig{
+		URLs:          []string{url},
+		BatchSize:     2,
+		BatchInterval: time.Hour,
+		MaxAttempts:   3,
+		RetryDelay:    time.Millisecond,
+		Timeout:       time.Second,
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	t.Run("batches events", func(t *testing.T) {
+		r := &webhookReceiver{}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		n := NewWebhookNotifier(testWebhookConfig(srv.URL), "sync-1", hclog.NewNullLogger())
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		n.Notify(Event{Type: EventServiceRemoved, Service: "db", Reason: "service no longer in Eureka"})
+		n.Notify(Event{Type: EventServiceCreated, Service: "api"})
+		n.Close()
+
+		payloads, _ := r.received()
+		require.Len(t, payloads, 2)
+		require.Len(t, payloads[0].Events, 2)
+		require.Equal(t, "[sync-1] Created service web in CloudMap\n"+
+			"[sync-1] Removed service db from CloudMap: service no longer in Eureka", payloads[0].Text)
+		require.Equal(t, "sync-1", payloads[0].Events[0].SyncID)
+		require.False(t, payloads[0].Events[0].Time.IsZero())
+		require.Len(t, payloads[1].Events, 1)
+		require.Equal(t, "api", payloads[1].Events[0].Service)
+	})
+
+	t.Run("flushes after the batch interval", func(t *testing.T) {
+		r := &webhookReceiver{}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		c := testWebhookConfig(srv.URL)
+		c.BatchInterval = 10 * time.Millisecond
+		n := NewWebhookNotifier(c, "", hclog.NewNullLogger())
+		defer n.Close()
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		require.Eventually(t, func() bool {
+			payloads, _ := r.received()
+			return len(payloads) == 1
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("filters event types", func(t *testing.T) {
+		r := &webhookReceiver{}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		c := testWebhookConfig(srv.URL)
+		c.Events = []string{EventWorkerFailing}
+		n := NewWebhookNotifier(c, "", hclog.NewNullLogger())
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		n.Notify(Event{Type: EventWorkerFailing, Worker: WorkerAWSFetch, Error: "boom"})
+		n.Close()
+
+		payloads, _ := r.received()
+		require.Len(t, payloads, 1)
+		require.Len(t, payloads[0].Events, 1)
+		require.Equal(t, EventWorkerFailing, payloads[0].Events[0].Type)
+		require.Equal(t, "Worker aws-fetch failed 3 times in a row: boom", payloads[0].Text)
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		r := &webhookReceiver{failures: 2, status: http.StatusServiceUnavailable}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		n := NewWebhookNotifier(testWebhookConfig(srv.URL), "", hclog.NewNullLogger())
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		n.Close()
+
+		payloads, requests := r.received()
+		require.Len(t, payloads, 1)
+		require.Equal(t, 3, requests)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		r := &webhookReceiver{failures: 5, status: http.StatusTooManyRequests}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		n := NewWebhookNotifier(testWebhookConfig(srv.URL), "", hclog.NewNullLogger())
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		n.Close()
+
+		payloads, requests := r.received()
+		require.Empty(t, payloads)
+		require.Equal(t, 3, requests)
+	})
+
+	t.Run("doesn't retry client errors", func(t *testing.T) {
+		r := &webhookReceiver{failures: 1, status: http.StatusNotFound}
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		n := NewWebhookNotifier(testWebhookConfig(srv.URL), "", hclog.NewNullLogger())
+
+		n.Notify(Event{Type: EventServiceCreated, Service: "web"})
+		n.Close()
+
+		payloads, requests := r.received()
+		require.Empty(t, payloads)
+		require.Equal(t, 1, requests)
+	})
+}
+
+// recordingNotifier keeps the events it receives.
+type recordingNotifier struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (n *recordingNotifier) Notify(e Event) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.events = append(n.events, e)
+}
+
+func TestAWSNotify(t *testing.T) {
+	f := newFakeCloudMap()
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: input.(*sd.CreateServiceInput).CreatorRequestId}}, nil
+	})
+	n := &recordingNotifier{}
+	a := newTestAWS(f)
+	a.notifier = n
+
+	a.create(context.Background(), map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+		}},
+	})
+	a.remove(context.Background(), map[string]service{
+		"db": {name: "db", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{}},
+	}, map[string]service{})
+
+	require.Len(t, n.events, 2)
+	require.Equal(t, EventServiceCreated, n.events[0].Type)
+	require.Equal(t, "web", n.events[0].Service)
+	require.NotEmpty(t, n.events[0].ServiceID)
+	require.Equal(t, Event{Type: EventServiceRemoved, Service: "db", ServiceID: "srv-2",
+		Reason: "service no longer in Eureka"}, n.events[1])
+}
+
+func TestStatusNotifiesRepeatedFailures(t *testing.T) {
+	n := &recordingNotifier{}
+	s := NewStatus()
+	s.setNotifier(n)
+
+	for i := 0; i < unhealthyFailures+2; i++ {
+		s.failure(WorkerAWSFetch, errors.New("boom"))
+	}
+	s.success(WorkerAWSFetch)
+	for i := 0; i < unhealthyFailures; i++ {
+		s.failure(WorkerAWSFetch, errors.New("again"))
+	}
+
+	require.Equal(t, []Event{
+		{Type: EventWorkerFailing, Worker: WorkerAWSFetch, Error: "boom"},
+		{Type: EventWorkerFailing, Worker: WorkerAWSFetch, Error: "again"},
+	}, n.events)
+}
+
+func TestStatusNotifiesFailedReconciles(t *testing.T) {
+	n := &recordingNotifier{}
+	s := NewStatus()
+	s.setNotifier(n)
+	failed := newSyncResult()
+	failed.record(opRegister, "web", "web-1", errors.New("boom"))
+
+	for i := 0; i < unhealthyFailures; i++ {
+		s.reconciled(time.Now(), nil, nil, failed, newSyncResult(), newSyncResult())
+	}
+	s.reconciled(time.Now(), nil, nil, newSyncResult(), newSyncResult(), newSyncResult())
+	s.reconciled(time.Now(), nil, nil, failed, newSyncResult(), newSyncResult())
+
+	require.Len(t, n.events, 1)
+	require.Equal(t, EventWorkerFailing, n.events[0].Type)
+	require.Equal(t, WorkerSyncToAWS, n.events[0].Worker)
+	require.Contains(t, n.events[0].Error, "1 operations failed")
+	require.Equal(t, 1, s.Workers()[WorkerSyncToAWS].ConsecutiveFailures)
+}
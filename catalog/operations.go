@@ -0,0 +1,169 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+const (
+	defaultOperationPollInterval    = 1 * time.Second
+	defaultOperationMaxPollInterval = 10 * time.Second
+	defaultOperationTimeout         = 2 * time.Minute
+	// failed operations are reported for operationResultTTL unless another
+	// operation on the instance supersedes them.
+	operationResultTTL = 1 * time.Hour
+)
+
+// operationResult is the outcome of the last operation on an instance.
+type operationResult struct {
+	operationID string
+	kind        string
+	status      sd.OperationStatus
+	err         error
+	updated     time.Time
+}
+
+// operationTracker waits for the asynchronous operations CloudMap returns
+// for RegisterInstance, DeregisterInstance and UpdateService, and records
+// the outcome per instance until a fetch of CloudMap supersedes it.
+type operationTracker struct {
+	client          *sd.Client
+	log             hclog.Logger
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+	timeout         time.Duration
+	limiter         *rateLimiter
+	metrics         Metrics
+	tracer          trace.Tracer
+
+	lock    sync.RWMutex
+	results map[string]operationResult
+}
+
+func newOperationTracker(client *sd.Client, log hclog.Logger) *operationTracker {
+	return &operationTracker{
+		client:          client,
+		log:             log,
+		pollInterval:    defaultOperationPollInterval,
+		maxPollInterval: defaultOperationMaxPollInterval,
+		timeout:         defaultOperationTimeout,
+		metrics:         nopMetrics{},
+		tracer:          trace.NoopTracer{},
+		results:         map[string]operationResult{},
+	}
+}
+
+func operationKey(serviceID, instanceID string) string {
+	return serviceID + "/" + instanceID
+}
+
+// wait polls GetOperation with exponential backoff until the operation
+// succeeded, failed or timed out. An empty operationID counts as success.
+func (t *operationTracker) wait(ctx context.Context, operationID *string) error {
+	if len(x.StringValue(operationID)) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(t.timeout)
+	delay := t.pollInterval
+	for {
+		if err := t.limiter.wait(ctx, "GetOperation"); err != nil {
+			return err
+		}
+		req := t.client.GetOperationRequest(&sd.GetOperationInput{OperationId: operationID})
+		callCtx, span := t.tracer.Start(ctx, "cloudmap.GetOperation")
+		resp, err := req.Send(callCtx)
+		endSpan(callCtx, span, err)
+		t.metrics.Count("eureka_aws.sync.aws.api.calls", 1,
+			[]string{"operation:GetOperation", "result:" + callResult(err)})
+		if err != nil {
+			t.log.Debug("cannot get operation", "id", *operationID, "error", err)
+		} else {
+			switch resp.Operation.Status {
+			case sd.OperationStatusSuccess:
+				return nil
+			case sd.OperationStatusFail:
+				return fmt.Errorf("operation %s failed: %s: %s", *operationID,
+					x.StringValue(resp.Operation.ErrorCode), x.StringValue(resp.Operation.ErrorMessage))
+			}
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("operation %s didn't finish within %s", *operationID, t.timeout)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		if delay > t.maxPollInterval {
+			delay = t.maxPollInterval
+		}
+	}
+}
+
+// track waits for an operation on an instance and records its outcome.
+func (t *operationTracker) track(ctx context.Context, kind, serviceID, instanceID string, operationID *string) error {
+	err := t.wait(ctx, operationID)
+	r := operationResult{
+		operationID: x.StringValue(operationID),
+		kind:        kind,
+		status:      sd.OperationStatusSuccess,
+		err:         err,
+		updated:     time.Now(),
+	}
+	if err != nil {
+		r.status = sd.OperationStatusFail
+		t.log.Error("operation failed", "kind", kind, "service", serviceID, "instance", instanceID, "error", err)
+	}
+	t.lock.Lock()
+	t.results[operationKey(serviceID, instanceID)] = r
+	t.lock.Unlock()
+	return err
+}
+
+// result returns the outcome of the last operation on an instance.
+func (t *operationTracker) result(serviceID, instanceID string) (operationResult, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	r, ok := t.results[operationKey(serviceID, instanceID)]
+	return r, ok
+}
+
+// prune drops the successful outcomes recorded before a fetch of CloudMap
+// that started at fetched, as the fetched state shows them, and the failed
+// ones older than operationResultTTL.
+func (t *operationTracker) prune(fetched time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for k, r := range t.results {
+		if (r.err == nil && r.updated.Before(fetched)) || time.Since(r.updated) > operationResultTTL {
+			delete(t.results, k)
+		}
+	}
+}
+
+// report returns the recorded outcomes for Status, keyed by service and
+// instance ID.
+func (t *operationTracker) report() map[string]OperationStatus {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	result := make(map[string]OperationStatus, len(t.results))
+	for k, r := range t.results {
+		o := OperationStatus{
+			Kind:        r.kind,
+			OperationID: r.operationID,
+			Status:      string(r.status),
+			Updated:     r.updated,
+		}
+		if r.err != nil {
+			o.Error = r.err.Error()
+		}
+		result[k] = o
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOperationTracker(f *fakeCloudMap, statuses map[string][]sd.OperationStatus) *operationTracker {
+	f.handle("GetOperation", func(input interface{}) (interface{}, error) {
+		id := *input.(*sd.GetOperationInput).OperationId
+		status := statuses[id][0]
+		if len(statuses[id]) > 1 {
+			statuses[id] = statuses[id][1:]
+		}
+		return &sd.GetOperationOutput{Operation: &sd.Operation{Id: &id, Status: status, ErrorCode: x.String("ERROR")}}, nil
+	})
+	t := newOperationTracker(f.client(), hclog.NewNullLogger())
+	t.pollInterval = time.Millisecond
+	t.maxPollInterval = 2 * time.Millisecond
+	t.timeout = 200 * time.Millisecond
+	return t
+}
+
+func TestOperationTrackerWait(t *testing.T) {
+	f := newFakeCloudMap()
+	tracker := newTestOperationTracker(f, map[string][]sd.OperationStatus{
+		"ok":      {sd.OperationStatusSubmitted, sd.OperationStatusPending, sd.OperationStatusSuccess},
+		"fail":    {sd.OperationStatusPending, sd.OperationStatusFail},
+		"pending": {sd.OperationStatusPending},
+	})
+
+	require.NoError(t, tracker.wait(context.Background(), nil))
+	require.NoError(t, tracker.wait(context.Background(), x.String("")))
+	require.Empty(t, f.inputs("GetOperation"))
+
+	require.NoError(t, tracker.wait(context.Background(), x.String("ok")))
+	require.Len(t, f.inputs("GetOperation"), 3)
+
+	err := tracker.wait(context.Background(), x.String("fail"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ERROR")
+
+	err = tracker.wait(context.Background(), x.String("pending"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "didn't finish")
+}
+
+func TestOperationTrackerTrack(t *testing.T) {
+	f := newFakeCloudMap()
+	tracker := newTestOperationTracker(f, map[string][]sd.OperationStatus{
+		"ok":   {sd.OperationStatusSuccess},
+		"fail": {sd.OperationStatusFail},
+	})
+
+	_, ok := tracker.result("srv-1", "i-1")
+	require.False(t, ok)
+
+	require.NoError(t, tracker.track(context.Background(), "register", "srv-1", "i-1", x.String("ok")))
+	r, ok := tracker.result("srv-1", "i-1")
+	require.True(t, ok)
+	require.Equal(t, "ok", r.operationID)
+	require.Equal(t, "register", r.kind)
+	require.Equal(t, sd.OperationStatusSuccess, r.status)
+
+	require.Error(t, tracker.track(context.Background(), "deregister", "srv-1", "i-1", x.String("fail")))
+	r, _ = tracker.result("srv-1", "i-1")
+	require.Equal(t, sd.OperationStatusFail, r.status)
+	require.Error(t, r.err)
+	require.Len(t, f.inputs("GetOperation"), 2)
+}
+
+func TestOperationTrackerPrune(t *testing.T) {
+	f := newFakeCloudMap()
+	tracker := newTestOperationTracker(f, map[string][]sd.OperationStatus{
+		"ok":   {sd.OperationStatusSuccess},
+		"fail": {sd.OperationStatusFail},
+	})
+	require.NoError(t, tracker.track(context.Background(), "register", "srv-1", "i-1", x.String("ok")))
+	require.Error(t, tracker.track(context.Background(), "register", "srv-1", "i-2", x.String("fail")))
+	tracker.results[operationKey("srv-1", "i-3")] = operationResult{kind: "register",
+		status: sd.OperationStatusFail, err: errors.New("failed"), updated: time.Now().Add(-2 * operationResultTTL)}
+
+	// outcomes after the fetch started are kept
+	tracker.prune(time.Now().Add(-time.Minute))
+	require.Len(t, tracker.report(), 2)
+
+	// a later fetch supersedes the successful one, the failed one is kept
+	tracker.prune(time.Now())
+	report := tracker.report()
+	require.Len(t, report, 1)
+	require.Equal(t, string(sd.OperationStatusFail), report["srv-1/i-2"].Status)
+	require.Contains(t, report["srv-1/i-2"].Error, "ERROR")
+
+	status := NewStatus()
+	status.setOperations(tracker.report)
+	require.Equal(t, report, status.Report().Operations)
+}
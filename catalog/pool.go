@@ -0,0 +1,140 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const defaultConcurrency = 10
+
+// Kinds of CloudMap mutations.
+const (
+	opCreateService = "create_service"
+	opDeleteService = "delete_service"
+	opRegister      = "register"
+	opDeregister    = "deregister"
+	opUpdateHealth  = "update_health"
+	opUpdateService = "update_service"
+)
+
+type operationError struct {
+	kind     string
+	service  string
+	instance string
+	err      error
+}
+
+func (e operationError) Error() string {
+	if len(e.instance) > 0 {
+		return fmt.Sprintf("%s %s/%s: %s", e.kind, e.service, e.instance, e.err)
+	}
+	return fmt.Sprintf("%s %s: %s", e.kind, e.service, e.err)
+}
+
+// syncResult summarizes the mutations of a sync cycle.
+type syncResult struct {
+	succeeded map[string]int
+	errors    []operationError
+}
+
+func newSyncResult() syncResult {
+	return syncResult{succeeded: map[string]int{}}
+}
+
+func (r *syncResult) record(kind, service, instance string, err error) {
+	if err != nil {
+		r.errors = append(r.errors, operationError{kind: kind, service: service, instance: instance, err: err})
+		return
+	}
+	r.succeeded[kind]++
+}
+
+func (r syncResult) count(kind string) int {
+	return r.succeeded[kind]
+}
+
+// failed reports whether an operation of kind failed for service.
+func (r syncResult) failed(kind, service string) bool {
+	for _, e := range r.errors {
+		if e.kind == kind && e.service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// failedInstance reports whether an operation of kind failed for instance
+// of service.
+func (r syncResult) failedInstance(kind, service, instance string) bool {
+	for _, e := range r.errors {
+		if e.kind == kind && e.service == service && e.instance == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// workerPool runs CloudMap mutations with bounded concurrency and collects
+// their outcome.
+type workerPool struct {
+	ctx    context.Context
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	result syncResult
+}
+
+func newWorkerPool(ctx context.Context, concurrency int) *workerPool {
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+	return &workerPool{
+		ctx:    ctx,
+		sem:    make(chan struct{}, concurrency),
+		result: newSyncResult(),
+	}
+}
+
+// run executes f on a worker, blocking while all workers are busy. Once the
+// pool's context is done f isn't run anymore and fails with its error.
+func (p *workerPool) run(kind, service, instance string, f func() error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		p.lock.Lock()
+		p.result.record(kind, service, instance, p.ctx.Err())
+		p.lock.Unlock()
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		err := p.call(f)
+		p.lock.Lock()
+		p.result.record(kind, service, instance, err)
+		p.lock.Unlock()
+	}()
+}
+
+// call runs f and turns a panic into an error, so that one failing
+// operation neither takes the process down nor leaks its worker.
+func (p *workerPool) call(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+// wait blocks until all operations finished and returns their summary.
+func (p *workerPool) wait() syncResult {
+	p.wg.Wait()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := p.result
+	p.result = newSyncResult()
+	return result
+}
@@ -0,0 +1,63 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(context.Background(), 3)
+	var lock sync.Mutex
+	running, max := 0, 0
+	for i := 0; i < 20; i++ {
+		i := i
+		p.run(opRegister, "web", "", func() error {
+			lock.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			lock.Unlock()
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			if i%5 == 0 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+	result := p.wait()
+
+	require.Equal(t, 0, running)
+	require.True(t, max <= 3, "max concurrency %d", max)
+	require.Equal(t, 16, result.count(opRegister))
+	require.Len(t, result.errors, 4)
+	require.True(t, result.failed(opRegister, "web"))
+	require.False(t, result.failed(opDeregister, "web"))
+
+	// the pool starts over after wait
+	p.run(opDeregister, "db", "i-1", func() error { return nil })
+	result = p.wait()
+	require.Equal(t, 1, result.count(opDeregister))
+	require.Equal(t, 0, result.count(opRegister))
+	require.Empty(t, result.errors)
+}
+
+func TestWorkerPoolRecoversPanics(t *testing.T) {
+	p := newWorkerPool(context.Background(), 1)
+	p.run(opRegister, "web", "i-1", func() error { panic("boom") })
+	p.run(opRegister, "web", "i-2", func() error { return nil })
+	result := p.wait()
+
+	require.Equal(t, 1, result.count(opRegister))
+	require.Len(t, result.errors, 1)
+	require.Equal(t, "i-1", result.errors[0].instance)
+	require.EqualError(t, result.errors[0].err, "panic: boom")
+}
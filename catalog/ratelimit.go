@@ -0,0 +1,128 @@
+package catalog
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// RateLimits caps the CloudMap calls per second of each API family, so
+// concurrent syncs stay below the account limits instead of being throttled.
+// A limit of 0 disables limiting for the family. Bursts of up to one
+// second's worth of calls are allowed.
+type RateLimits struct {
+	Read     float64
+	Mutate   float64
+	Discover float64
+}
+
+// DefaultRateLimits returns the rate limits used unless configured.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Read:     20,
+		Mutate:   10,
+		Discover: 500,
+	}
+}
+
+// API families of CloudMap operations.
+const (
+	familyRead     = "read"
+	familyMutate   = "mutate"
+	familyDiscover = "discover"
+)
+
+func operationFamily(operation string) string {
+	switch operation {
+	case "DiscoverInstances":
+		return familyDiscover
+	case "CreateService", "UpdateService", "DeleteService", "RegisterInstance",
+		"DeregisterInstance", "UpdateInstanceCustomHealthStatus":
+		return familyMutate
+	default:
+		return familyRead
+	}
+}
+
+// tokenBucket hands out rate tokens per second, holding up to burst tokens.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(1, math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait for it.
+// Tokens may go negative, which queues callers in order.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a token reserved for a call that was given up on.
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens++
+}
+
+// rateLimiter delays CloudMap calls according to the limit of their family.
+// A nil rateLimiter doesn't limit.
+type rateLimiter struct {
+	buckets map[string]*tokenBucket
+	metrics Metrics
+	log     hclog.Logger
+}
+
+func newRateLimiter(limits RateLimits, metrics Metrics, log hclog.Logger) *rateLimiter {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}, metrics: metrics, log: log}
+	for family, rate := range map[string]float64{
+		familyRead:     limits.Read,
+		familyMutate:   limits.Mutate,
+		familyDiscover: limits.Discover,
+	} {
+		if rate > 0 {
+			l.buckets[family] = newTokenBucket(rate)
+		}
+	}
+	return l
+}
+
+// wait blocks until operation may be called or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, operation string) error {
+	if l == nil {
+		return nil
+	}
+	family := operationFamily(operation)
+	b, ok := l.buckets[family]
+	if !ok {
+		return nil
+	}
+	d := b.reserve(time.Now())
+	if d > 0 {
+		l.log.Debug("rate limited", "operation", operation, "wait", d)
+		if err := sleep(ctx, d); err != nil {
+			b.cancel()
+			return err
+		}
+	}
+	l.metrics.Timing("eureka_aws.sync.aws.rate_limit_wait", d,
+		[]string{"family:" + family})
+	return nil
+}
@@ -0,0 +1,67 @@
+package catalog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationFamily(t *testing.T) {
+	require.Equal(t, familyDiscover, operationFamily("DiscoverInstances"))
+	require.Equal(t, familyMutate, operationFamily("RegisterInstance"))
+	require.Equal(t, familyMutate, operationFamily("UpdateInstanceCustomHealthStatus"))
+	require.Equal(t, familyRead, operationFamily("ListServices"))
+	require.Equal(t, familyRead, operationFamily("GetOperation"))
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2)
+	b.last = now
+
+	// the burst is available right away
+	require.Equal(t, time.Duration(0), b.reserve(now))
+	require.Equal(t, time.Duration(0), b.reserve(now))
+	// further calls queue up
+	require.Equal(t, 500*time.Millisecond, b.reserve(now))
+	require.Equal(t, time.Second, b.reserve(now))
+	// tokens refill over time, up to the burst
+	require.Equal(t, time.Duration(0), b.reserve(now.Add(10*time.Second)))
+	require.Equal(t, time.Duration(0), b.reserve(now.Add(10*time.Second)))
+	require.Equal(t, 500*time.Millisecond, b.reserve(now.Add(10*time.Second)))
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	var l *rateLimiter
+	l.wait(context.Background(), "RegisterInstance")
+
+	l = newRateLimiter(RateLimits{Mutate: 100}, nopMetrics{}, hclog.NewNullLogger())
+	start := time.Now()
+	for i := 0; i < 110; i++ {
+		l.wait(context.Background(), "RegisterInstance")
+	}
+	require.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	// families without a limit don't wait
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		l.wait(context.Background(), "ListServices")
+	}
+	require.True(t, time.Since(start) < 50*time.Millisecond)
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	l := newRateLimiter(RateLimits{Mutate: 1}, nopMetrics{}, hclog.NewNullLogger())
+	b := l.buckets[familyMutate]
+	require.NoError(t, l.wait(context.Background(), "RegisterInstance"))
+
+	// a cancelled wait gives its token back, so it doesn't delay later calls
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, l.wait(ctx, "RegisterInstance"))
+	d := b.reserve(time.Now())
+	require.True(t, d > 0 && d <= time.Second, d)
+}
@@ -0,0 +1,151 @@
+package catalog
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+)
+
+// opHeartbeat renews the lease of an instance registered in Eureka.
+const opHeartbeat = "heartbeat"
+
+// registration is a CloudMap instance the sync to Eureka registered.
+type registration struct {
+	service string
+	app     string
+	id      string
+	status  string
+}
+
+// pendingInstance is a CloudMap instance translated for Eureka in a sync,
+// which only needs its lease renewed if it is registered with the same status.
+type pendingInstance struct {
+	service string
+	info    *_e.InstanceInfo
+	renew   bool
+}
+
+// registeredFromAWS reports whether a Eureka instance was registered by the
+// sync to Eureka, so the sync to AWS doesn't import it back.
+func registeredFromAWS(info _e.InstanceInfo) bool {
+	return info.Metadata != nil && info.Metadata.Map[EurekaSourceKey] == EurekaAWSTag
+}
+
+// syncToEureka registers the instances of the services found in CloudMap in
+// Eureka, translated with the mapping of their service. Instances already
+// registered with the same status only get a heartbeat, which registers them
+// again if Eureka dropped them, and instances that vanished from CloudMap are
+// unregistered. Services imported from Eureka are skipped.
+func (a *aws) syncToEureka(e *eureka) syncResult {
+	start := time.Now()
+	failed := newSyncResult()
+	var pending []pendingInstance
+	seen := map[string]bool{}
+	pool := newWorkerPool(context.Background(), a.concurrency)
+	for k, s := range a.getServices() {
+		if s.fromEureka || s.partial {
+			continue
+		}
+		for _, nodes := range s.nodes {
+			for _, n := range nodes {
+				seen[strings.ToUpper(a.awsPrefix+k)+"/"+n.awsID] = true
+				h, ok := s.healths[n.awsID]
+				if !ok {
+					// CloudMap has no health for instances of services
+					// without health checks.
+					h = up
+				}
+				info, err := a.transformInstanceInfo(k, n, h)
+				if err != nil {
+					failed.record(opRegister, k, n.awsID, err)
+					continue
+				}
+				if info.Metadata == nil {
+					info.Metadata = &_e.MetaData{Map: map[string]string{}}
+				}
+				info.Metadata.Map[EurekaSourceKey] = EurekaAWSTag
+				info.Metadata.Map[EurekaAWSNS] = a.namespace.id
+				info.Metadata.Map[EurekaAWSID] = s.awsID
+
+				r, ok := a.registration(info.App + "/" + info.InstanceID)
+				renew := ok && r.status == info.Status
+				pending = append(pending, pendingInstance{service: k, info: info, renew: renew})
+				if renew {
+					pool.run(opHeartbeat, k, info.InstanceID, func() error {
+						return e.client.SendHeartbeat(info.App, info.InstanceID)
+					})
+				}
+			}
+		}
+	}
+	heartbeats := pool.wait()
+	for _, err := range heartbeats.errors {
+		// Eureka dropped the instance, it is registered again below
+		a.log.Debug("heartbeat failed", "service", err.service, "instance", err.instance, "error", err.err)
+	}
+
+	result := newSyncResult()
+	result.succeeded[opHeartbeat] = heartbeats.count(opHeartbeat)
+	for _, p := range pending {
+		if p.renew && !heartbeats.failedInstance(opHeartbeat, p.service, p.info.InstanceID) {
+			continue
+		}
+		service, info := p.service, p.info
+		pool.run(opRegister, service, info.InstanceID, func() error {
+			if err := e.client.RegisterInstance(info.App, info); err != nil {
+				a.log.Error("cannot register instance in eureka", "app", info.App, "instanceId", info.InstanceID, "error", err)
+				return err
+			}
+			a.register(info.App+"/"+info.InstanceID, registration{service: service, app: info.App, id: info.InstanceID, status: info.Status})
+			return nil
+		})
+	}
+
+	a.registeredLock.Lock()
+	var gone []registration
+	for key, r := range a.registered {
+		if !seen[key] {
+			gone = append(gone, r)
+		}
+	}
+	a.registeredLock.Unlock()
+	for _, r := range gone {
+		r := r
+		pool.run(opDeregister, r.service, r.id, func() error {
+			if err := e.client.UnregisterInstance(r.app, r.id); err != nil {
+				a.log.Error("cannot unregister instance from eureka", "app", r.app, "instanceId", r.id, "error", err)
+				return err
+			}
+			a.registeredLock.Lock()
+			delete(a.registered, r.app+"/"+r.id)
+			a.registeredLock.Unlock()
+			return nil
+		})
+	}
+	changed := pool.wait()
+	result.succeeded[opRegister] = changed.count(opRegister)
+	result.succeeded[opDeregister] = changed.count(opDeregister)
+	result.errors = append(failed.errors, changed.errors...)
+	a.metrics.Timing("eureka_aws.sync.eureka.reconcile.duration", time.Since(start), []string{})
+	return result
+}
+
+// registration returns what was registered in Eureka under key.
+func (a *aws) registration(key string) (registration, bool) {
+	a.registeredLock.Lock()
+	defer a.registeredLock.Unlock()
+	r, ok := a.registered[key]
+	return r, ok
+}
+
+// register remembers that r was registered in Eureka under key.
+func (a *aws) register(key string, r registration) {
+	a.registeredLock.Lock()
+	defer a.registeredLock.Unlock()
+	if a.registered == nil {
+		a.registered = map[string]registration{}
+	}
+	a.registered[key] = r
+}
@@ -0,0 +1,144 @@
+package catalog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEureka records the instances registered through its REST API.
+type fakeEureka struct {
+	lock      sync.Mutex
+	instances map[string]map[string]interface{}
+	requests  map[string]int
+}
+
+func newFakeEureka(t *testing.T) (*fakeEureka, *httptest.Server) {
+	f := &fakeEureka{instances: map[string]map[string]interface{}{}, requests: map[string]int{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.requests[r.Method]++
+		key := strings.TrimPrefix(r.URL.Path, "/apps/")
+		switch r.Method {
+		case http.MethodPost:
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			var instance struct {
+				Instance map[string]interface{} `json:"instance"`
+			}
+			require.NoError(t, json.Unmarshal(body, &instance))
+			f.instances[key+"/"+instance.Instance["instanceId"].(string)] = instance.Instance
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPut:
+			if _, ok := f.instances[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		case http.MethodDelete:
+			delete(f.instances, key)
+		}
+	}))
+	return f, srv
+}
+
+func (f *fakeEureka) reset() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	requests := f.requests
+	f.requests = map[string]int{}
+	return requests
+}
+
+func (f *fakeEureka) instance(key string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.instances[key]
+}
+
+func TestAWSSyncToEureka(t *testing.T) {
+	f, srv := newFakeEureka(t)
+	defer srv.Close()
+
+	a := newTestAWS(newFakeCloudMap())
+	a.toEureka = true
+	a.awsPrefix = "aws_"
+	a.trigger = make(chan bool)
+	a.config = &ServicesConfig{Services: map[string]ServiceConfig{
+		"web": {Mapping: &InstanceMapping{VIPAddress: "{{.Name}}.example", ExcludeAttributes: []string{"secret"}}},
+	}}
+	n1 := node{host: "1.1.1.1", port: 80, awsID: "i-1", attributes: map[string]string{
+		awsInstanceIPv4: "1.1.1.1", awsInstancePort: "80", "team": "a", "secret": "x",
+	}}
+	n2 := node{host: "1.1.1.2", port: 80, awsID: "i-2", attributes: map[string]string{
+		awsInstanceIPv4: "1.1.1.2", awsInstancePort: "80",
+	}}
+	a.services = map[string]service{
+		"web": {name: "web", awsID: "srv-1", nodes: map[string]map[int]node{"1.1.1.1": {80: n1}, "1.1.1.2": {80: n2}},
+			healths: map[string]health{"i-2": out_of_service}},
+		// imported from Eureka, registering it would loop
+		"api": {name: "api", awsID: "srv-2", fromEureka: true, nodes: map[string]map[int]node{"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "i-3"}}}},
+	}
+	e := &eureka{client: _e.NewClient([]string{srv.URL})}
+	control := NewControl()
+	cycle := func() {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			a.sync(e, control, stop)
+			close(done)
+		}()
+		a.trigger <- true
+		close(stop)
+		<-done
+	}
+
+	cycle()
+	require.Equal(t, map[string]int{http.MethodPost: 2}, f.reset())
+	i1 := f.instance("AWS_WEB/i-1")
+	require.NotNil(t, i1)
+	require.Equal(t, "web.example", i1["vipAddress"])
+	require.Equal(t, "UP", i1["status"])
+	require.Equal(t, "http://1.1.1.1:80/health", i1["healthCheckUrl"])
+	require.Equal(t, map[string]interface{}{
+		"team":          "a",
+		EurekaSourceKey: EurekaAWSTag,
+		EurekaAWSNS:     "ns-1",
+		EurekaAWSID:     "srv-1",
+	}, i1["metadata"])
+	require.Equal(t, "OUT_OF_SERVICE", f.instance("AWS_WEB/i-2")["status"])
+	require.Nil(t, f.instance("AWS_API/i-3"))
+
+	// registered instances only get heartbeats
+	cycle()
+	require.Equal(t, map[string]int{http.MethodPut: 2}, f.reset())
+
+	// instances Eureka dropped and status changes are registered again
+	f.lock.Lock()
+	delete(f.instances, "AWS_WEB/i-1")
+	f.lock.Unlock()
+	a.services["web"].healths["i-2"] = up
+	cycle()
+	require.Equal(t, map[string]int{http.MethodPut: 1, http.MethodPost: 2}, f.reset())
+	require.NotNil(t, f.instance("AWS_WEB/i-1"))
+	require.Equal(t, "UP", f.instance("AWS_WEB/i-2")["status"])
+
+	// instances gone from CloudMap are unregistered
+	delete(a.services["web"].nodes, "1.1.1.2")
+	cycle()
+	require.Equal(t, map[string]int{http.MethodPut: 1, http.MethodDelete: 1}, f.reset())
+	require.Nil(t, f.instance("AWS_WEB/i-2"))
+
+	// nothing is sent while the direction is paused
+	require.NoError(t, control.Pause(DirectionToEureka))
+	delete(a.services, "web")
+	cycle()
+	require.Empty(t, f.reset())
+}
@@ -0,0 +1,152 @@
+package catalog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"time"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// RetryConfig controls how failed CloudMap calls are retried. Delays grow
+// exponentially from BaseDelay, or from ThrottleDelay when CloudMap throttled
+// the call, up to MaxDelay, and are jittered.
+type RetryConfig struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	ThrottleDelay time.Duration
+	MaxDelay      time.Duration
+}
+
+// DefaultRetryConfig returns the retry settings used unless configured.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:   5,
+		BaseDelay:     100 * time.Millisecond,
+		ThrottleDelay: 1 * time.Second,
+		MaxDelay:      20 * time.Second,
+	}
+}
+
+var throttleErrorCodes = map[string]bool{
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"TooManyRequestsException": true,
+}
+
+func isThrottle(err error) bool {
+	if err, ok := err.(awserr.Error); ok {
+		return throttleErrorCodes[err.Code()]
+	}
+	return false
+}
+
+// isRetryable reports whether err is transient: throttling, server errors
+// and connection problems.
+func isRetryable(err error) bool {
+	return isThrottle(err) || retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == x.TrueTernary
+}
+
+// delay returns the jittered backoff before the given retry, starting at 1.
+func (c RetryConfig) delay(attempt int, err error) time.Duration {
+	base := c.BaseDelay
+	if isThrottle(err) {
+		base = c.ThrottleDelay
+	}
+	d := c.MaxDelay
+	if attempt < 32 && base<<uint(attempt-1) < c.MaxDelay && base<<uint(attempt-1) > 0 {
+		d = base << uint(attempt-1)
+	}
+	// non-positive delays don't wait at all rather than breaking the jitter
+	if d <= 0 {
+		return 0
+	}
+	// equal jitter keeps at least half of the delay
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient,
+// runs out of attempts or ctx is done. Every attempt gets its own context
+// limited by the call timeout. f must build a new request on every call since
+// a failed request can't be sent again.
+func (a *aws) retry(ctx context.Context, operation string, f func(ctx context.Context) error) (err error) {
+	ctx, span := a.tracer.Start(ctx, "cloudmap."+operation)
+	attempt := 0
+	defer func() {
+		span.SetAttributes(kv.Int("attempts", attempt))
+		endSpan(ctx, span, err)
+	}()
+	attempts := a.retries.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt = 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.limiter.wait(ctx, operation); err != nil {
+			return err
+		}
+		err := a.attempt(ctx, f)
+		a.metrics.Count("eureka_aws.sync.aws.api.calls", 1,
+			[]string{"operation:" + operation, "result:" + callResult(err)})
+		if err == nil || !isRetryable(err) || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		d := a.retries.delay(attempt, err)
+		a.log.Debug("retrying", "operation", operation, "attempt", attempt, "delay", d, "error", err)
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *aws) attempt(ctx context.Context, f func(ctx context.Context) error) error {
+	if a.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.callTimeout)
+		defer cancel()
+	}
+	return f(ctx)
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// callResult classifies the outcome of a CloudMap call for metrics.
+func callResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case isThrottle(err):
+		return "throttled"
+	default:
+		return "error"
+	}
+}
+
+// creatorRequestID returns a random ID for CreatorRequestId. It is created
+// once per call and reused for its retries, so a retry of a call that
+// actually succeeded doesn't create a second service or registration.
+func creatorRequestID() *string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return x.String(time.Now().Format(time.RFC3339Nano))
+	}
+	return x.String(hex.EncodeToString(b))
+}
@@ -0,0 +1,135 @@
+package catalog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	type variant struct {
+		err       error
+		retryable bool
+		throttle  bool
+	}
+	variants := []variant{
+		{err: awserr.New("ThrottlingException", "slow down", nil), retryable: true, throttle: true},
+		{err: awserr.New("RequestLimitExceeded", "slow down", nil), retryable: true, throttle: true},
+		{err: awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 503, "req-1"), retryable: true},
+		{err: awserr.New(sd.ErrCodeInvalidInput, "invalid", nil)},
+		{err: awserr.New(sd.ErrCodeServiceAlreadyExists, "exists", nil)},
+	}
+	for _, v := range variants {
+		require.Equal(t, v.retryable, isRetryable(v.err), v.err.Error())
+		require.Equal(t, v.throttle, isThrottle(v.err), v.err.Error())
+	}
+}
+
+func TestRetryConfigDelay(t *testing.T) {
+	c := RetryConfig{BaseDelay: 100 * time.Millisecond, ThrottleDelay: time.Second, MaxDelay: 4 * time.Second}
+	other := awserr.New("InternalFailure", "oops", nil)
+	throttle := awserr.New("ThrottlingException", "slow down", nil)
+	for i := 0; i < 20; i++ {
+		d := c.delay(1, other)
+		require.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond, d)
+		d = c.delay(3, other)
+		require.True(t, d >= 200*time.Millisecond && d <= 400*time.Millisecond, d)
+		d = c.delay(1, throttle)
+		require.True(t, d >= 500*time.Millisecond && d <= time.Second, d)
+		d = c.delay(40, throttle)
+		require.True(t, d >= 2*time.Second && d <= 4*time.Second, d)
+	}
+
+	for _, c := range []RetryConfig{{MaxDelay: -time.Second, BaseDelay: -time.Second}, {}} {
+		require.Equal(t, time.Duration(0), c.delay(1, other))
+		require.Equal(t, time.Duration(0), c.delay(3, throttle))
+	}
+}
+
+func TestAWSRetry(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.retries = RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, ThrottleDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	services := map[string]service{
+		"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+		}},
+	}
+
+	// throttled calls are retried with the same CreatorRequestId
+	calls := 0
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		calls++
+		if calls < 3 {
+			return nil, awserr.New("ThrottlingException", "slow down", nil)
+		}
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: input.(*sd.CreateServiceInput).CreatorRequestId}}, nil
+	})
+	result := a.create(context.Background(), services)
+	require.Equal(t, 1, result.count(opCreateService))
+	inputs := f.inputs("CreateService")
+	require.Len(t, inputs, 3)
+	id := *inputs[0].(*sd.CreateServiceInput).CreatorRequestId
+	require.NotEmpty(t, id)
+	for _, i := range inputs {
+		require.Equal(t, id, *i.(*sd.CreateServiceInput).CreatorRequestId)
+	}
+	require.NotEmpty(t, *f.inputs("RegisterInstance")[0].(*sd.RegisterInstanceInput).CreatorRequestId)
+
+	// errors that aren't transient are not retried
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return nil, awserr.New(sd.ErrCodeInvalidInput, "invalid", nil)
+	})
+	result = a.create(context.Background(), services)
+	require.True(t, result.failed(opCreateService, "web"))
+	require.Len(t, f.inputs("CreateService"), 4)
+
+	// retries stop after MaxAttempts
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return nil, awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 500, "req-1")
+	})
+	result = a.create(context.Background(), services)
+	require.True(t, result.failed(opCreateService, "web"))
+	require.Len(t, f.inputs("CreateService"), 7)
+}
+
+func TestAWSRetryContext(t *testing.T) {
+	f := newFakeCloudMap()
+	a := newTestAWS(f)
+	a.retries = RetryConfig{MaxAttempts: 3, BaseDelay: time.Hour, ThrottleDelay: time.Hour, MaxDelay: time.Hour}
+
+	// every attempt is limited by the call timeout
+	a.callTimeout = time.Millisecond
+	a.retries.MaxAttempts = 1
+	err := a.retry(context.Background(), "GetService", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// a cancelled context stops waiting for the next attempt
+	a.retries.MaxAttempts = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = a.retry(ctx, "GetService", func(ctx context.Context) error {
+		calls++
+		return awserr.New("ThrottlingException", "slow down", nil)
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, calls)
+
+	// nothing is sent once the context is cancelled
+	services := map[string]service{
+		"web": {name: "web", fromEureka: true, awsID: "srv-1", nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+		}},
+	}
+	result := a.create(ctx, services)
+	require.True(t, result.failed(opRegister, "web"))
+	require.Empty(t, f.inputs("RegisterInstance"))
+}
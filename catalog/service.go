@@ -2,8 +2,11 @@ package catalog
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 )
 
 type health string
@@ -47,6 +50,13 @@ type service struct {
 	awsID        string
 	eurekaID     string
 	awsNamespace string
+	description  string
+	dnsConfig    *sd.DnsConfig
+	healthCheck  *sd.HealthCheckConfig
+	customHealth *sd.HealthCheckCustomConfig
+	// partial is set for services cached from the state or a sync rather
+	// than a fetch, which lack their configuration until the next fetch.
+	partial bool
 }
 
 type node struct {
@@ -56,6 +66,28 @@ type node struct {
 	eurekaID   string
 	instanceID string
 	attributes map[string]string
+	// attributesHash is the hash of attributes when only it is known.
+	attributesHash string
+}
+
+type addressType int
+
+const (
+	addressIPv4 addressType = iota
+	addressIPv6
+	addressHostname
+)
+
+func addressTypeOf(address string) addressType {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return addressHostname
+	case ip.To4() != nil:
+		return addressIPv4
+	default:
+		return addressIPv6
+	}
 }
 
 func hostPortFromID(checkid string) (string, int) {
@@ -74,6 +106,30 @@ func id(id, host string, port int) string {
 	return fmt.Sprintf("%s_%s_%d", id, host, port)
 }
 
+// countNodes returns the number of nodes of all services.
+func countNodes(services map[string]service) int {
+	count := 0
+	for _, s := range services {
+		for _, nodes := range s.nodes {
+			count += len(nodes)
+		}
+	}
+	return count
+}
+
+// onlyService returns the service called name of services, or all services
+// if name is empty.
+func onlyService(services map[string]service, name string) map[string]service {
+	if len(name) == 0 {
+		return services
+	}
+	result := map[string]service{}
+	if s, ok := services[name]; ok {
+		result[name] = s
+	}
+	return result
+}
+
 func onlyInFirst(servicesA, servicesB map[string]service) map[string]service {
 	result := map[string]service{}
 	for k, sa := range servicesA {
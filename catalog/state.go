@@ -0,0 +1,292 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+)
+
+// stateVersion is the version of the state file format. Files of other
+// versions are ignored.
+const stateVersion = 1
+
+// syncState is what CloudMap holds of the services imported from Eureka as
+// of the last sync to AWS. It is persisted so a restarted Sync doesn't start
+// from an empty cache and mutate everything again.
+type syncState struct {
+	Version   int                     `json:"version"`
+	Namespace string                  `json:"namespace"`
+	Saved     time.Time               `json:"saved"`
+	Services  map[string]stateService `json:"services"`
+}
+
+type stateService struct {
+	ID           string                   `json:"id"`
+	CustomHealth bool                     `json:"customHealth,omitempty"`
+	Instances    map[string]stateInstance `json:"instances"`
+}
+
+type stateInstance struct {
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	Health         string `json:"health,omitempty"`
+	AttributesHash string `json:"attributesHash"`
+}
+
+// attributesHash returns a hash of the instance attributes that doesn't
+// depend on their order.
+func attributesHash(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(k), k, len(attributes[k]), attributes[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hash returns the hash of the attributes of n. Nodes loaded from the state
+// only have the hash.
+func (n node) hash() string {
+	if n.attributes == nil && len(n.attributesHash) > 0 {
+		return n.attributesHash
+	}
+	return attributesHash(n.attributes)
+}
+
+// newSyncState captures the services imported from Eureka of services.
+func newSyncState(namespace string, services map[string]service) syncState {
+	s := syncState{
+		Version:   stateVersion,
+		Namespace: namespace,
+		Saved:     time.Now().UTC(),
+		Services:  map[string]stateService{},
+	}
+	for k, svc := range services {
+		if !svc.fromEureka || len(svc.awsID) == 0 {
+			continue
+		}
+		ss := stateService{ID: svc.awsID, CustomHealth: svc.customHealth != nil, Instances: map[string]stateInstance{}}
+		for _, nodes := range svc.nodes {
+			for _, n := range nodes {
+				ss.Instances[n.awsID] = stateInstance{
+					Host:           n.host,
+					Port:           n.port,
+					Health:         string(svc.healths[n.awsID]),
+					AttributesHash: n.hash(),
+				}
+			}
+		}
+		s.Services[k] = ss
+	}
+	return s
+}
+
+// services turns the state back into cached services. Their nodes only
+// carry the hash of their attributes.
+func (s syncState) services() map[string]service {
+	services := make(map[string]service, len(s.Services))
+	for k, ss := range s.Services {
+		svc := service{
+			id:           ss.ID,
+			name:         k,
+			awsID:        ss.ID,
+			awsNamespace: s.Namespace,
+			fromEureka:   true,
+			partial:      true,
+			nodes:        map[string]map[int]node{},
+			healths:      map[string]health{},
+		}
+		if ss.CustomHealth {
+			svc.customHealth = &sd.HealthCheckCustomConfig{}
+		}
+		for id, i := range ss.Instances {
+			if svc.nodes[i.Host] == nil {
+				svc.nodes[i.Host] = map[int]node{}
+			}
+			svc.nodes[i.Host][i.Port] = node{
+				host:           i.Host,
+				port:           i.Port,
+				awsID:          id,
+				instanceID:     id,
+				attributesHash: i.AttributesHash,
+			}
+			if len(i.Health) > 0 {
+				svc.healths[id] = health(i.Health)
+			}
+		}
+		services[k] = svc
+	}
+	return services
+}
+
+// diff counts the services and instances that differ between s and
+// services.
+func (s syncState) diff(services map[string]service) int {
+	fresh := newSyncState(s.Namespace, services)
+	count := 0
+	for k, ss := range s.Services {
+		fs, ok := fresh.Services[k]
+		if !ok || fs.ID != ss.ID {
+			count++
+			continue
+		}
+		for id, i := range ss.Instances {
+			fi, ok := fs.Instances[id]
+			if !ok || fi.Host != i.Host || fi.Port != i.Port || fi.AttributesHash != i.AttributesHash {
+				count++
+			}
+		}
+		for id := range fs.Instances {
+			if _, ok := ss.Instances[id]; !ok {
+				count++
+			}
+		}
+	}
+	for k := range fresh.Services {
+		if _, ok := s.Services[k]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// stateStore persists the syncState of an aws to a file. A nil stateStore
+// persists nothing.
+type stateStore struct {
+	path string
+	log  hclog.Logger
+
+	lock sync.Mutex
+	// loaded is the state loaded at startup until a fresh fetch validated
+	// it.
+	loaded *syncState
+}
+
+func newStateStore(path string, log hclog.Logger) *stateStore {
+	return &stateStore{path: path, log: log}
+}
+
+// load reads the state of namespace. A missing file, or one of another
+// namespace or version, is no state.
+func (s *stateStore) load(namespace string) (syncState, bool, error) {
+	if s == nil {
+		return syncState{}, false, nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return syncState{}, false, nil
+	}
+	if err != nil {
+		return syncState{}, false, err
+	}
+	var state syncState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return syncState{}, false, fmt.Errorf("cannot parse %s: %s", s.path, err)
+	}
+	if state.Version != stateVersion || state.Namespace != namespace {
+		s.log.Warn("ignoring state of another namespace or version", "path", s.path,
+			"namespace", state.Namespace, "version", state.Version)
+		return syncState{}, false, nil
+	}
+	s.lock.Lock()
+	s.loaded = &state
+	s.lock.Unlock()
+	return state, true, nil
+}
+
+// validate compares the loaded state with the services of the first fetch
+// after loading it and returns the number of differences.
+func (s *stateStore) validate(services map[string]service) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.lock.Lock()
+	loaded := s.loaded
+	s.loaded = nil
+	s.lock.Unlock()
+	if loaded == nil {
+		return 0, false
+	}
+	return loaded.diff(services), true
+}
+
+// save writes state to a temporary file first and renames it, so a crash
+// never leaves a partial file behind.
+func (s *stateStore) save(state syncState) error {
+	if s == nil {
+		return nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// loadState fills the cache with the persisted state, if any, so the first
+// sync doesn't need to wait for a fetch of CloudMap.
+func (a *aws) loadState() {
+	state, ok, err := a.state.load(a.namespace.id)
+	if err != nil {
+		a.log.Error("cannot load state", "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	services := state.services()
+	a.setServices(services)
+	a.log.Info("loaded state", "saved", state.Saved, "services", len(services), "instances", countNodes(services))
+}
+
+// validateState reports how far the loaded state was off from the fetched
+// services.
+func (a *aws) validateState(services map[string]service) {
+	diff, ok := a.state.validate(services)
+	if !ok {
+		return
+	}
+	a.metrics.Gauge("eureka_aws.sync.aws.state.differences", float64(diff), []string{})
+	if diff > 0 {
+		a.log.Warn("loaded state differs from CloudMap", "differences", diff)
+		return
+	}
+	a.log.Info("loaded state matches CloudMap")
+}
+
+// saveState persists the cache.
+func (a *aws) saveState() {
+	if a.state == nil {
+		return
+	}
+	if err := a.state.save(newSyncState(a.namespace.id, a.getServices())); err != nil {
+		a.log.Error("cannot save state", "error", err)
+	}
+}
@@ -0,0 +1,157 @@
+package catalog
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+func TestAttributesHash(t *testing.T) {
+	a := attributesHash(map[string]string{"a": "1", "b": "2"})
+	require.Equal(t, a, attributesHash(map[string]string{"b": "2", "a": "1"}))
+	require.NotEqual(t, a, attributesHash(map[string]string{"a": "12"}))
+	require.NotEqual(t, attributesHash(map[string]string{"a": "1b"}), attributesHash(map[string]string{"a1": "b"}))
+	require.Equal(t, attributesHash(nil), attributesHash(map[string]string{}))
+}
+
+func TestSyncStateDiff(t *testing.T) {
+	services := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1", attributes: map[string]string{"a": "1"}}},
+			"1.1.1.2": {80: {host: "1.1.1.2", port: 80, awsID: "web-2", attributes: map[string]string{"a": "2"}}},
+		}, healths: map[string]health{"web-1": healthy}},
+		"other": {name: "other", awsID: "srv-2"},
+	}
+	state := newSyncState("ns-1", services)
+	require.Len(t, state.Services, 1)
+	require.Equal(t, "HEALTHY", state.Services["web"].Instances["web-1"].Health)
+
+	// the loaded services only have hashes but compare equal
+	loaded := state.services()
+	require.Equal(t, "web-1", loaded["web"].nodes["1.1.1.1"][80].instanceID)
+	require.Equal(t, healthy, loaded["web"].healths["web-1"])
+	require.Equal(t, 0, state.diff(services))
+	require.Equal(t, 0, newSyncState("ns-1", loaded).diff(services))
+
+	changed := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1", attributes: map[string]string{"a": "changed"}}},
+			"1.1.1.3": {80: {host: "1.1.1.3", port: 80, awsID: "web-3"}},
+		}},
+		"db": {name: "db", awsID: "srv-3", fromEureka: true},
+	}
+	// web-1 changed, web-2 is gone, web-3 and db are new
+	require.Equal(t, 4, state.diff(changed))
+}
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eureka-aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	s := newStateStore(path, hclog.NewNullLogger())
+
+	_, ok, err := s.load("ns-1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	state := newSyncState("ns-1", map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromEureka: true, nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "web-1"}},
+		}},
+	})
+	require.NoError(t, s.save(state))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	_, ok, err = s.load("ns-2")
+	require.NoError(t, err)
+	require.False(t, ok)
+	loaded, ok, err := s.load("ns-1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, state.Services, loaded.Services)
+
+	diff, ok := s.validate(map[string]service{})
+	require.True(t, ok)
+	require.Equal(t, 1, diff)
+	_, ok = s.validate(map[string]service{})
+	require.False(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, _, err = s.load("ns-1")
+	require.Error(t, err)
+}
+
+func TestSyncToAWSAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eureka-aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	f := newFakeCloudMap()
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: x.String("srv-web")}}, nil
+	})
+	e := &eureka{
+		log:     hclog.NewNullLogger(),
+		metrics: nopMetrics{},
+		tracer:  trace.NoopTracer{},
+		services: map[string]service{
+			"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+				"1.1.1.2": {80: {host: "1.1.1.2", port: 80, instanceID: "web-2"}},
+			}, healths: map[string]health{"web-1": healthy, "web-2": unhealthy}},
+		},
+	}
+
+	a := newTestAWS(f)
+	a.state = newStateStore(path, hclog.NewNullLogger())
+	e.syncToAWS(context.Background(), a, NewStatus(), "")
+	require.Len(t, f.inputs("CreateService"), 1)
+	require.Len(t, f.inputs("RegisterInstance"), 2)
+	require.Len(t, f.inputs("UpdateInstanceCustomHealthStatus"), 2)
+	// the created service is cached with its configuration
+	web := a.getServices()["web"]
+	require.False(t, web.partial)
+	require.NotNil(t, web.customHealth)
+
+	// a restarted sync doesn't sync before it knows what's in CloudMap
+	f = newFakeCloudMap()
+	restarted := newTestAWS(f)
+	restarted.services = nil
+	restarted.fetched = false
+	require.False(t, restarted.known())
+	require.False(t, restarted.ready())
+
+	// with the state it knows and doesn't mutate anything
+	restarted.state = newStateStore(path, hclog.NewNullLogger())
+	restarted.loadState()
+	require.True(t, restarted.known())
+	require.False(t, restarted.ready())
+	e.syncToAWS(context.Background(), restarted, NewStatus(), "")
+	require.Empty(t, f.inputs("CreateService"))
+	require.Empty(t, f.inputs("RegisterInstance"))
+	require.Empty(t, f.inputs("UpdateInstanceCustomHealthStatus"))
+	require.Empty(t, f.inputs("DeregisterInstance"))
+	require.NotNil(t, restarted.getServices()["web"].customHealth)
+
+	// but it doesn't remove anything the state has and Eureka hasn't until it
+	// fetched CloudMap
+	e.services = map[string]service{}
+	r := e.syncToAWS(context.Background(), restarted, NewStatus(), "")
+	require.Equal(t, 0, r.RemovedInstances)
+	require.Empty(t, f.inputs("DeregisterInstance"))
+	require.Empty(t, f.inputs("DeleteService"))
+	require.NoError(t, restarted.fetch(context.Background()))
+	require.True(t, restarted.ready())
+}
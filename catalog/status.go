@@ -0,0 +1,319 @@
+package catalog
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Sides of the sync reported by Status.
+const (
+	SideAWS    = "aws"
+	SideEureka = "eureka"
+)
+
+// maxReportedErrors limits the errors kept of the last reconcile.
+const maxReportedErrors = 20
+
+// WorkerStatus is the state of a single worker.
+type WorkerStatus struct {
+	Running             bool      `json:"running"`
+	Restarts            int       `json:"restarts"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastErrorTime       time.Time `json:"lastErrorTime,omitempty"`
+	LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+}
+
+// FetchStatus is the result of the last successful fetch of one side.
+type FetchStatus struct {
+	LastSuccess time.Time `json:"lastSuccess"`
+	Services    int       `json:"services"`
+	Instances   int       `json:"instances"`
+}
+
+// ReconcileStatus is the result of the last sync to AWS.
+type ReconcileStatus struct {
+	LastRun          time.Time `json:"lastRun,omitempty"`
+	Duration         string    `json:"duration,omitempty"`
+	CreatedServices  int       `json:"createdServices"`
+	CreatedInstances int       `json:"createdInstances"`
+	UpdatedServices  int       `json:"updatedServices"`
+	UpdatedHealths   int       `json:"updatedHealths"`
+	RemovedServices  int       `json:"removedServices"`
+	RemovedInstances int       `json:"removedInstances"`
+	Failed           int       `json:"failed"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+// ServiceStatus is the sync state of a single service as of the last sync
+// to AWS.
+type ServiceStatus struct {
+	EurekaInstances int       `json:"eurekaInstances"`
+	AWSInstances    int       `json:"awsInstances"`
+	InEureka        bool      `json:"inEureka"`
+	InAWS           bool      `json:"inAWS"`
+	LastSync        time.Time `json:"lastSync"`
+	LastError       string    `json:"lastError,omitempty"`
+}
+
+// OperationStatus is the outcome of the last asynchronous CloudMap
+// operation on an instance that no fetch superseded yet.
+type OperationStatus struct {
+	Kind        string    `json:"kind"`
+	OperationID string    `json:"operationId,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Report is a snapshot of Status.
+type Report struct {
+	Started    time.Time                `json:"started"`
+	Role       string                   `json:"role"`
+	Healthy    bool                     `json:"healthy"`
+	Goroutines int                      `json:"goroutines"`
+	Workers    map[string]WorkerStatus  `json:"workers"`
+	Fetches    map[string]FetchStatus   `json:"fetches"`
+	Reconcile  ReconcileStatus          `json:"reconcile"`
+	Services   map[string]ServiceStatus `json:"services"`
+	// Operations are keyed by CloudMap service and instance ID.
+	Operations map[string]OperationStatus `json:"operations,omitempty"`
+}
+
+// Status reports the health of the workers of Sync and the state of the
+// sync. It is safe for concurrent use.
+type Status struct {
+	lock      sync.RWMutex
+	started   time.Time
+	workers   map[string]WorkerStatus
+	fetches   map[string]FetchStatus
+	reconcile ReconcileStatus
+	services  map[string]ServiceStatus
+	notifier  Notifier
+	role      string
+	// operations reports the outcomes of the tracked operations.
+	operations func() map[string]OperationStatus
+}
+
+// NewStatus returns an empty Status to pass to WithStatus.
+func NewStatus() *Status {
+	return &Status{
+		started:  time.Now(),
+		workers:  map[string]WorkerStatus{},
+		fetches:  map[string]FetchStatus{},
+		services: map[string]ServiceStatus{},
+		notifier: nopNotifier{},
+		role:     RoleLeader,
+	}
+}
+
+// Workers returns a copy of the status of all workers.
+func (s *Status) Workers() map[string]WorkerStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make(map[string]WorkerStatus, len(s.workers))
+	for k, v := range s.workers {
+		result[k] = v
+	}
+	return result
+}
+
+// Healthy reports whether all workers are running and none of them failed
+// repeatedly in a row.
+func (s *Status) Healthy() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.healthy()
+}
+
+func (s *Status) healthy() bool {
+	for _, w := range s.workers {
+		if !w.Running || w.ConsecutiveFailures >= unhealthyFailures {
+			return false
+		}
+	}
+	return true
+}
+
+// Role reports whether Sync is the leader or a standby that only fetches.
+func (s *Status) Role() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.role
+}
+
+func (s *Status) setRole(role string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.role = role
+}
+
+// Ready reports whether both sides were fetched successfully within maxAge.
+func (s *Status) Ready(maxAge time.Duration) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, side := range []string{SideAWS, SideEureka} {
+		f, ok := s.fetches[side]
+		if !ok || time.Since(f.LastSuccess) > maxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Report returns a snapshot of the status.
+func (s *Status) Report() Report {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := Report{
+		Started:    s.started,
+		Role:       s.role,
+		Healthy:    s.healthy(),
+		Goroutines: runtime.NumGoroutine(),
+		Workers:    make(map[string]WorkerStatus, len(s.workers)),
+		Fetches:    make(map[string]FetchStatus, len(s.fetches)),
+		Reconcile:  s.reconcile,
+		Services:   make(map[string]ServiceStatus, len(s.services)),
+	}
+	for k, v := range s.workers {
+		r.Workers[k] = v
+	}
+	for k, v := range s.fetches {
+		r.Fetches[k] = v
+	}
+	for k, v := range s.services {
+		r.Services[k] = v
+	}
+	r.Reconcile.Errors = append([]string(nil), s.reconcile.Errors...)
+	if s.operations != nil {
+		r.Operations = s.operations()
+	}
+	return r
+}
+
+func (s *Status) update(name string, f func(w *WorkerStatus)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.workers[name]
+	f(&w)
+	s.workers[name] = w
+}
+
+func (s *Status) running(name string, running bool) {
+	s.update(name, func(w *WorkerStatus) { w.Running = running })
+}
+
+func (s *Status) success(name string) {
+	s.update(name, func(w *WorkerStatus) {
+		w.ConsecutiveFailures = 0
+		w.LastSuccess = time.Now()
+	})
+}
+
+// failure records a failure of worker name and notifies once it failed
+// unhealthyFailures times in a row.
+func (s *Status) failure(name string, err error) {
+	failures := 0
+	s.update(name, func(w *WorkerStatus) {
+		w.ConsecutiveFailures++
+		w.LastError = err.Error()
+		w.LastErrorTime = time.Now()
+		failures = w.ConsecutiveFailures
+	})
+	if failures == unhealthyFailures {
+		s.getNotifier().Notify(Event{Type: EventWorkerFailing, Worker: name, Error: err.Error()})
+	}
+}
+
+func (s *Status) setNotifier(n Notifier) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.notifier = n
+}
+
+func (s *Status) setOperations(f func() map[string]OperationStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.operations = f
+}
+
+func (s *Status) getNotifier() Notifier {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.notifier
+}
+
+func (s *Status) restarted(name string, err error) {
+	s.update(name, func(w *WorkerStatus) {
+		w.Running = false
+		w.Restarts++
+		w.LastError = err.Error()
+		w.LastErrorTime = time.Now()
+	})
+}
+
+// fetched records a successful fetch of side.
+func (s *Status) fetched(side string, services map[string]service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fetches[side] = FetchStatus{
+		LastSuccess: time.Now(),
+		Services:    len(services),
+		Instances:   countNodes(services),
+	}
+}
+
+// reconciled records a sync to AWS of the eureka services to the aws
+// services, which are the services of the last fetch It returns the
+// summary it recorded. A sync with failed operations counts as a failure of
+// the sync to AWS worker, which notifies once it failed unhealthyFailures
+// times in a row.
+func (s *Status) reconciled(start time.Time, eureka, aws map[string]service, created, updated, removed syncResult) ReconcileStatus {
+	now := time.Now()
+	r := ReconcileStatus{
+		LastRun:          now,
+		Duration:         now.Sub(start).String(),
+		CreatedServices:  created.count(opCreateService),
+		CreatedInstances: created.count(opRegister),
+		UpdatedServices:  updated.count(opUpdateService),
+		UpdatedHealths:   created.count(opUpdateHealth),
+		RemovedServices:  removed.count(opDeleteService),
+		RemovedInstances: removed.count(opDeregister),
+	}
+
+	services := map[string]ServiceStatus{}
+	for k, v := range eureka {
+		services[k] = ServiceStatus{InEureka: true, EurekaInstances: countNodes(map[string]service{k: v}), LastSync: now}
+	}
+	for k, v := range aws {
+		ss := services[k]
+		ss.InAWS = true
+		ss.AWSInstances = countNodes(map[string]service{k: v})
+		ss.LastSync = now
+		services[k] = ss
+	}
+	errors := append(append(append([]operationError{}, created.errors...), updated.errors...), removed.errors...)
+	r.Failed = len(errors)
+	for _, e := range errors {
+		if len(r.Errors) < maxReportedErrors {
+			r.Errors = append(r.Errors, e.Error())
+		}
+		if ss, ok := services[e.service]; ok {
+			ss.LastError = e.err.Error()
+			services[e.service] = ss
+		}
+	}
+
+	s.lock.Lock()
+	s.reconcile = r
+	s.services = services
+	s.lock.Unlock()
+	if r.Failed > 0 {
+		s.failure(WorkerSyncToAWS, fmt.Errorf("%d operations failed: %s", r.Failed, errors[0].Error()))
+	} else {
+		s.success(WorkerSyncToAWS)
+	}
+	return r
+}
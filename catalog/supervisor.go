@@ -0,0 +1,153 @@
+package catalog
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Workers run by Sync.
+const (
+	WorkerAWSFetch     = "aws-fetch"
+	WorkerEurekaFetch  = "eureka-fetch"
+	WorkerSyncToEureka = "sync-to-eureka"
+	WorkerSyncToAWS    = "sync-to-aws"
+	WorkerLeader       = "leader-election"
+)
+
+const (
+	defaultRestartDelay    = 1 * time.Second
+	defaultMaxRestartDelay = 1 * time.Minute
+	maxFetchBackoff        = 5 * time.Minute
+
+	// unhealthyFailures is the number of consecutive failures after which a
+	// worker is reported unhealthy.
+	unhealthyFailures = 3
+)
+
+// supervisor runs workers until they are stopped. A worker that panics or
+// returns before it was stopped is restarted with backoff.
+type supervisor struct {
+	log             hclog.Logger
+	status          *Status
+	restartDelay    time.Duration
+	maxRestartDelay time.Duration
+	wg              sync.WaitGroup
+}
+
+func newSupervisor(log hclog.Logger, status *Status) *supervisor {
+	return &supervisor{
+		log:             log,
+		status:          status,
+		restartDelay:    defaultRestartDelay,
+		maxRestartDelay: defaultMaxRestartDelay,
+	}
+}
+
+// run starts f and keeps it running until stop is closed.
+func (s *supervisor) run(name string, stop <-chan struct{}, f func(stop <-chan struct{})) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		delay := s.restartDelay
+		for {
+			s.status.running(name, true)
+			started := time.Now()
+			err := call(f, stop)
+			if IsClosed(stop) {
+				s.status.running(name, false)
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("worker exited")
+			}
+			if time.Since(started) > s.maxRestartDelay {
+				delay = s.restartDelay
+			}
+			s.log.Error("worker failed, restarting", "worker", name, "delay", delay, "error", err)
+			s.status.restarted(name, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > s.maxRestartDelay {
+				delay = s.maxRestartDelay
+			}
+		}
+	}()
+}
+
+// wait blocks until all workers returned.
+func (s *supervisor) wait() {
+	s.wg.Wait()
+}
+
+// call runs f and turns a panic into an error.
+func call(f func(stop <-chan struct{}), stop <-chan struct{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	f(stop)
+	return nil
+}
+
+// fetchLoop calls fetch every interval, or right away when force receives,
+// until stop is closed and triggers a sync after every successful fetch.
+// Triggers are coalesced, so a busy sync never blocks fetching. After failures
+// the interval grows exponentially.
+func fetchLoop(name string, log hclog.Logger, status *Status, interval time.Duration,
+	trigger chan bool, force <-chan struct{}, fetch func() error, stop <-chan struct{}) {
+	failures := 0
+	for {
+		delay := interval
+		if err := fetch(); err != nil {
+			log.Error("error fetching", "error", err)
+			status.failure(name, err)
+			failures++
+			delay = fetchBackoff(interval, failures)
+		} else {
+			status.success(name)
+			failures = 0
+			select {
+			case trigger <- true:
+			default:
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-force:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetchBackoff returns the delay after the given number of consecutive
+// failures: the interval doubled for every further failure up to
+// maxFetchBackoff or the interval, whichever is longer, with up to 10%
+// jitter.
+func fetchBackoff(interval time.Duration, failures int) time.Duration {
+	max := maxFetchBackoff
+	if interval > max {
+		max = interval
+	}
+	d := interval
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
@@ -0,0 +1,93 @@
+package catalog
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisorRestarts(t *testing.T) {
+	status := NewStatus()
+	s := newSupervisor(hclog.NewNullLogger(), status)
+	s.restartDelay = time.Millisecond
+	s.maxRestartDelay = 2 * time.Millisecond
+
+	var runs int32
+	stop := make(chan struct{})
+	s.run("worker", stop, func(stop <-chan struct{}) {
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			panic("boom")
+		case 2:
+			return
+		}
+		<-stop
+	})
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) == 3 }, time.Second, time.Millisecond)
+	w := status.Workers()["worker"]
+	require.True(t, w.Running)
+	require.Equal(t, 2, w.Restarts)
+	require.Equal(t, "worker exited", w.LastError)
+	require.True(t, status.Healthy())
+
+	close(stop)
+	s.wait()
+	require.False(t, status.Workers()["worker"].Running)
+	require.False(t, status.Healthy())
+	require.EqualValues(t, 3, atomic.LoadInt32(&runs))
+}
+
+func TestFetchLoop(t *testing.T) {
+	status := NewStatus()
+	trigger := make(chan bool, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var fetches int32
+	go func() {
+		fetchLoop("fetch", hclog.NewNullLogger(), status, time.Millisecond, trigger, nil, func() error {
+			if atomic.AddInt32(&fetches, 1) <= 3 {
+				return errors.New("unavailable")
+			}
+			return nil
+		}, stop)
+		close(done)
+	}()
+
+	// nobody reads the triggers, which must not block fetching
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fetches) > 5 }, time.Second, time.Millisecond)
+	require.Len(t, trigger, 1)
+	close(stop)
+	<-done
+
+	w := status.Workers()["fetch"]
+	require.Equal(t, 0, w.ConsecutiveFailures)
+	require.Equal(t, "unavailable", w.LastError)
+	require.False(t, w.LastSuccess.IsZero())
+}
+
+func TestFetchBackoff(t *testing.T) {
+	require.True(t, fetchBackoff(time.Second, 1) >= time.Second)
+	require.True(t, fetchBackoff(time.Second, 1) <= 1100*time.Millisecond)
+	require.True(t, fetchBackoff(time.Second, 3) >= 4*time.Second)
+	require.True(t, fetchBackoff(time.Second, 30) <= maxFetchBackoff+maxFetchBackoff/10)
+	require.True(t, fetchBackoff(10*time.Minute, 3) <= 11*time.Minute)
+}
+
+func TestStatusHealthy(t *testing.T) {
+	status := NewStatus()
+	status.running("fetch", true)
+	err := errors.New("unavailable")
+	for i := 0; i < unhealthyFailures-1; i++ {
+		status.failure("fetch", err)
+	}
+	require.True(t, status.Healthy())
+	status.failure("fetch", err)
+	require.False(t, status.Healthy())
+	status.success("fetch")
+	require.True(t, status.Healthy())
+}
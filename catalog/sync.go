@@ -1,27 +1,339 @@
 package catalog
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	_e "github.com/ArthurHlt/go-eureka-client/eureka"
-	"github.com/DataDog/datadog-go/statsd"
 	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
-// Sync aws->eureka and vice versa.
+// Option configures optional behaviour of Sync.
+type Option func(*options)
 
-func Sync(toAWS, toEureka bool, namespaceID, eurekaPrefix, awsPrefix, awsPullInterval string, awsDNSTTL int64, stale bool, awsClient *sd.Client, eurekaClient *_e.Client, stop, stopped chan struct{}) {
+type options struct {
+	services     *ServicesConfig
+	concurrency  int
+	retries      RetryConfig
+	rateLimits   RateLimits
+	callTimeout  time.Duration
+	gracePeriod  time.Duration
+	status       *Status
+	control      *Control
+	metrics      Metrics
+	metricTags   []string
+	traces       trace.Provider
+	auditor      Auditor
+	notifier     Notifier
+	leaderLock   LeaderLock
+	lease        string
+	leaseHolder  string
+	leaseTTL     time.Duration
+	renew        time.Duration
+	stateFile    string
+	observations int
+	minDwell     time.Duration
+	maxDeletions int
+	maxFraction  float64
+}
+
+const (
+	defaultCallTimeout   = 30 * time.Second
+	defaultGracePeriod   = 10 * time.Second
+	defaultRenewInterval = 10 * time.Second
+)
+
+// WithServicesConfig sets the per-service settings.
+func WithServicesConfig(c *ServicesConfig) Option {
+	return func(o *options) {
+		o.services = c
+	}
+}
+
+// WithConcurrency limits the number of concurrent CloudMap mutations.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithRetryConfig sets how failed CloudMap calls are retried. The client
+// passed to Sync shouldn't retry on its own, otherwise retries multiply.
+func WithRetryConfig(c RetryConfig) Option {
+	return func(o *options) {
+		o.retries = c
+	}
+}
+
+// WithRateLimits sets the CloudMap calls per second of each API family.
+func WithRateLimits(l RateLimits) Option {
+	return func(o *options) {
+		o.rateLimits = l
+	}
+}
+
+// WithCallTimeout limits how long a single CloudMap call may take.
+func WithCallTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.callTimeout = d
+	}
+}
+
+// WithGracePeriod sets how long Sync waits for in-flight work to finish on
+// shutdown before cancelling it.
+func WithGracePeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.gracePeriod = d
+	}
+}
+
+// WithStatus sets the Status Sync reports the health of its workers to.
+func WithStatus(s *Status) Option {
+	return func(o *options) {
+		o.status = s
+	}
+}
+
+// WithControl sets the Control to pause, resume and force the sync with.
+func WithControl(c *Control) Option {
+	return func(o *options) {
+		o.control = c
+	}
+}
+
+// WithMetrics sets where metrics are sent to. By default they go to the
+// statsd agent on 127.0.0.1:8125.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithMetricTags adds key:value tags, such as "environment:prod", to every
+// metric.
+func WithMetricTags(tags ...string) Option {
+	return func(o *options) {
+		o.metricTags = append(o.metricTags, tags...)
+	}
+}
+
+// WithTraceProvider sets the provider of the tracer that records a span for
+// every fetch and sync cycle, with child spans per service and CloudMap call.
+// By default nothing is traced.
+func WithTraceProvider(p trace.Provider) Option {
+	return func(o *options) {
+		o.traces = p
+	}
+}
+
+// WithAuditor sets the Auditor that records every mutation. By default
+// nothing is recorded.
+func WithAuditor(a Auditor) Option {
+	return func(o *options) {
+		o.auditor = a
+	}
+}
+
+// WithNotifier sets the Notifier told about created and removed services and
+// workers that fail repeatedly. By default nobody is notified.
+func WithNotifier(n Notifier) Option {
+	return func(o *options) {
+		o.notifier = n
+	}
+}
+
+// WithLeaderLock runs Sync as one of several replicas: it only changes
+// CloudMap while it holds lock, which it tries to acquire or renew every
+// renew interval. Standbys keep fetching.
+func WithLeaderLock(lock LeaderLock, renew time.Duration) Option {
+	return func(o *options) {
+		o.leaderLock = lock
+		o.lease = ""
+		o.renew = renew
+	}
+}
+
+// WithCloudMapLease is WithLeaderLock with a lease in CloudMap, for replicas
+// on different hosts. The lease is the instance "leader" of the service
+// <service>-<epoch> in the namespace, which the replica taking the lease
+// creates. holder must be unique per replica. The lease expires after ttl and
+// is renewed every third of it.
+func WithCloudMapLease(service, holder string, ttl time.Duration) Option {
+	return func(o *options) {
+		o.leaderLock = nil
+		o.lease = service
+		o.leaseHolder = holder
+		o.leaseTTL = ttl
+		o.renew = ttl / 3
+	}
+}
+
+// WithStateFile persists what was synced to CloudMap to path after every
+// sync and loads it on start, so a restart doesn't mutate everything again.
+func WithStateFile(path string) Option {
+	return func(o *options) {
+		o.stateFile = path
+	}
+}
+
+// WithHealthHysteresis only propagates a changed health of an instance once it
+// was observed in observations fetches of Eureka in a row and the previous
+// health lasted for minDwell. By default every change is propagated.
+func WithHealthHysteresis(observations int, minDwell time.Duration) Option {
+	return func(o *options) {
+		o.observations = observations
+		o.minDwell = minDwell
+	}
+}
+
+// WithDeletionThreshold holds back the removals of a sync that would delete
+// more than max of the services imported from Eureka, or more than fraction
+// of them, and notifies about it once. 0 disables either limit. By default
+// every removal runs.
+func WithDeletionThreshold(max int, fraction float64) Option {
+	return func(o *options) {
+		o.maxDeletions = max
+		o.maxFraction = fraction
+	}
+}
+
+// Sync aws->eureka and vice versa. Workers that fail are restarted and report
+// to the Status set with WithStatus; Sync only returns once stop is closed or
+// the namespace can't be set up.
+func Sync(toAWS, toEureka bool, namespaceID, eurekaPrefix, awsPrefix, awsPullInterval string, awsDNSTTL int64, stale bool, awsClient *sd.Client, eurekaClient *_e.Client, stop, stopped chan struct{}, opts ...Option) {
 	defer close(stopped)
 	log := hclog.Default().Named("sync")
 
+	o := newOptions(log, opts)
+
 	pullInterval, err := time.ParseDuration(awsPullInterval)
 	if err != nil {
 		log.Error("cannot parse aws pull interval", "error", err)
 		return
 	}
+	eureka, aws := newSyncers(o, toAWS, toEureka, eurekaPrefix, awsPrefix, pullInterval, awsDNSTTL, stale, awsClient, eurekaClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = aws.setupNamespace(ctx, namespaceID)
+	if err != nil {
+		log.Error("cannot setup namespace", "namespaceID", namespaceID, "error", err)
+		return
+	}
+
+	aws.loadState()
+
+	o.status.setNotifier(o.notifier)
+	if len(o.lease) > 0 {
+		o.leaderLock = aws.newLease(o.lease, o.leaseHolder, o.leaseTTL)
+	}
+	if o.leaderLock != nil {
+		if o.renew <= 0 {
+			o.renew = defaultRenewInterval
+		}
+		l := &leader{
+			lock:          o.leaderLock,
+			renewInterval: o.renew,
+			log:           hclog.Default().Named("leader"),
+			status:        o.status,
+		}
+		l.set(false)
+		eureka.leader = l
+		aws.leader = l
+	}
 
-	eureka := eureka{
+	sup := newSupervisor(log, o.status)
+	workersStop := make(chan struct{})
+	if aws.leader != nil {
+		sup.run(WorkerLeader, workersStop, func(stop <-chan struct{}) {
+			aws.leader.run(ctx, stop)
+		})
+	}
+	sup.run(WorkerAWSFetch, workersStop, func(stop <-chan struct{}) {
+		aws.fetchIndefinetely(ctx, o.status, o.control.fetch[SideAWS], stop)
+	})
+	sup.run(WorkerEurekaFetch, workersStop, func(stop <-chan struct{}) {
+		eureka.fetchIndefinetely(ctx, o.status, o.control.fetch[SideEureka], stop)
+	})
+	sup.run(WorkerSyncToEureka, workersStop, func(stop <-chan struct{}) {
+		aws.sync(eureka, o.control, stop)
+	})
+	sup.run(WorkerSyncToAWS, workersStop, func(stop <-chan struct{}) {
+		eureka.sync(ctx, aws, o.status, o.control, stop)
+	})
+
+	<-stop
+	log.Info("shutting down...")
+	close(workersStop)
+	workersStopped := make(chan struct{})
+	go func() {
+		sup.wait()
+		close(workersStopped)
+	}()
+	shutdown(log, o.gracePeriod, cancel, workersStopped)
+}
+
+// SyncOnce fetches AWS and Eureka once and syncs Eureka to AWS once, like a
+// cycle of Sync. It returns what was done, including the failed operations,
+// and only fails itself if the namespace or one of the sides can't be
+// fetched or ctx is done.
+func SyncOnce(ctx context.Context, namespaceID, eurekaPrefix, awsPrefix string, awsDNSTTL int64, stale bool, awsClient *sd.Client, eurekaClient *_e.Client, opts ...Option) (ReconcileStatus, error) {
+	o := newOptions(hclog.Default().Named("sync"), opts)
+	eureka, aws := newSyncers(o, true, false, eurekaPrefix, awsPrefix, 0, awsDNSTTL, stale, awsClient, eurekaClient)
+
+	if err := aws.setupNamespace(ctx, namespaceID); err != nil {
+		return ReconcileStatus{}, fmt.Errorf("cannot setup namespace %s: %s", namespaceID, err)
+	}
+	if err := aws.fetch(ctx); err != nil {
+		return ReconcileStatus{}, fmt.Errorf("cannot fetch aws: %s", err)
+	}
+	o.status.fetched(SideAWS, aws.getServices())
+	if err := eureka.fetch(ctx); err != nil {
+		return ReconcileStatus{}, fmt.Errorf("cannot fetch eureka: %s", err)
+	}
+	o.status.fetched(SideEureka, eureka.getServices())
+	r := eureka.syncToAWS(ctx, aws, o.status, "")
+	return r, ctx.Err()
+}
+
+// newOptions applies opts to the defaults.
+func newOptions(log hclog.Logger, opts []Option) options {
+	o := options{
+		concurrency: defaultConcurrency,
+		retries:     DefaultRetryConfig(),
+		rateLimits:  DefaultRateLimits(),
+		callTimeout: defaultCallTimeout,
+		gracePeriod: defaultGracePeriod,
+		status:      NewStatus(),
+		control:     NewControl(),
+		traces:      trace.NoopProvider{},
+		auditor:     nopAuditor{},
+		notifier:    nopNotifier{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.metrics == nil {
+		m, err := NewStatsdMetrics("127.0.0.1:8125", log)
+		if err != nil {
+			log.Error("Unable to init statsd", "error", err)
+			m = nopMetrics{}
+		}
+		o.metrics = m
+	}
+	o.metrics = TaggedMetrics(o.metrics, o.metricTags...)
+	return o
+}
+
+// newSyncers sets up both sides of a sync with the options.
+func newSyncers(o options, toAWS, toEureka bool, eurekaPrefix, awsPrefix string, pullInterval time.Duration, awsDNSTTL int64, stale bool, awsClient *sd.Client, eurekaClient *_e.Client) (*eureka, *aws) {
+	tracer := o.traces.Tracer(tracerName)
+	e := &eureka{
 		client:       eurekaClient,
 		log:          hclog.Default().Named("eureka"),
 		trigger:      make(chan bool, 1),
@@ -30,14 +342,13 @@ func Sync(toAWS, toEureka bool, namespaceID, eurekaPrefix, awsPrefix, awsPullInt
 		toAWS:        toAWS,
 		stale:        stale,
 		pullInterval: pullInterval,
+		metrics:      o.metrics,
+		tracer:       tracer,
+		damper:       newHealthDamper(o.observations, o.minDwell),
+		deletions:    newDeletionGuard(o.maxDeletions, o.maxFraction),
 	}
 
-	eureka.dd, err = statsd.New("127.0.0.1:8125")
-	if err != nil {
-		log.Error("Unable to init statsd", "error", err)
-	}
-
-	aws := aws{
+	a := &aws{
 		client:       awsClient,
 		log:          hclog.Default().Named("aws"),
 		trigger:      make(chan bool, 1),
@@ -46,78 +357,37 @@ func Sync(toAWS, toEureka bool, namespaceID, eurekaPrefix, awsPrefix, awsPullInt
 		toEureka:     toEureka,
 		pullInterval: pullInterval,
 		dnsTTL:       awsDNSTTL,
+		config:       o.services,
+		operations:   newOperationTracker(awsClient, hclog.Default().Named("aws")),
+		concurrency:  o.concurrency,
+		retries:      o.retries,
+		callTimeout:  o.callTimeout,
+		metrics:      o.metrics,
+		tracer:       tracer,
+		auditor:      o.auditor,
+		notifier:     o.notifier,
 	}
 
-	aws.dd, err = statsd.New("127.0.0.1:8125")
-	if err != nil {
-		log.Error("Unable to init statsd", "error", err)
-	}
-
-	err = aws.setupNamespace(namespaceID)
-	if err != nil {
-		log.Error("cannot setup namespace", "namespaceID", namespaceID, "error", err)
-		return
+	a.limiter = newRateLimiter(o.rateLimits, o.metrics, a.log)
+	a.operations.limiter = a.limiter
+	a.operations.metrics = o.metrics
+	a.operations.tracer = tracer
+	o.status.setOperations(a.operations.report)
+	if len(o.stateFile) > 0 {
+		a.state = newStateStore(o.stateFile, a.log)
 	}
+	return e, a
+}
 
-	fetchEurekaStop := make(chan struct{})
-	fetchEurekaStopped := make(chan struct{})
-	fetchAWSStop := make(chan struct{})
-	fetchAWSStopped := make(chan struct{})
-
-	go aws.fetchIndefinetely(fetchAWSStop, fetchAWSStopped)
-	go eureka.fetchIndefinetely(fetchEurekaStop, fetchEurekaStopped)
-
-	toEurekaStop := make(chan struct{})
-	toEurekaStopped := make(chan struct{})
-	toAWSStop := make(chan struct{})
-	toAWSStopped := make(chan struct{})
-
-	go aws.sync(&eureka, toEurekaStop, toEurekaStopped)
-	go eureka.sync(&aws, toAWSStop, toAWSStopped)
-
-	select {
-	case <-stop:
-		close(toEurekaStop)
-		close(toAWSStop)
-		close(fetchEurekaStop)
-		close(fetchAWSStop)
-		<-toEurekaStopped
-		<-toAWSStopped
-		<-fetchAWSStopped
-		<-fetchEurekaStopped
-	case <-fetchAWSStopped:
-		log.Info("problem with aws fetch. shutting down...")
-		close(toEurekaStop)
-		close(toAWSStop)
-		close(fetchEurekaStop)
-		<-toEurekaStopped
-		<-toAWSStopped
-		<-fetchEurekaStopped
-	case <-fetchEurekaStopped:
-		log.Info("problem with eureka fetch. shutting down...")
-		close(toEurekaStop)
-		close(fetchAWSStop)
-		close(toAWSStop)
-		<-toEurekaStopped
-		<-toAWSStopped
-		<-fetchAWSStopped
-
-	case <-toEurekaStopped:
-		log.Info("problem with eureka sync. shutting down...")
-		close(fetchEurekaStop)
-		close(toAWSStop)
-		close(fetchAWSStop)
-		<-toAWSStopped
-		<-fetchAWSStopped
-		<-fetchEurekaStopped
-
-	case <-toAWSStopped:
-		log.Info("problem with aws sync. shutting down...")
-		close(toEurekaStop)
-		close(fetchEurekaStop)
-		close(fetchAWSStop)
-		<-toEurekaStopped
-		<-fetchEurekaStopped
-		<-fetchAWSStopped
+// shutdown waits for the stopped channels. In-flight CloudMap calls are
+// cancelled once the grace period is over.
+func shutdown(log hclog.Logger, grace time.Duration, cancel context.CancelFunc, stopped ...chan struct{}) {
+	t := time.AfterFunc(grace, func() {
+		log.Warn("grace period is over, cancelling in-flight requests", "grace", grace)
+		cancel()
+	})
+	defer t.Stop()
+	for _, ch := range stopped {
+		<-ch
 	}
 }
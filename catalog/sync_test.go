@@ -2,14 +2,21 @@ package catalog
 
 import (
 	"context"
+	"encoding/xml"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
 	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	x "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSync(t *testing.T) {
@@ -23,6 +30,70 @@ func TestSync(t *testing.T) {
 	runSyncTest(t, namespaceID)
 }
 
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(stopped)
+	}()
+	start := time.Now()
+	shutdown(hclog.NewNullLogger(), 10*time.Millisecond, cancel, stopped)
+	require.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	// work that finishes within the grace period isn't cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped = make(chan struct{})
+	close(stopped)
+	shutdown(hclog.NewNullLogger(), time.Hour, cancel, stopped)
+	require.NoError(t, ctx.Err())
+}
+
+func TestSyncOnce(t *testing.T) {
+	apps := _e.Applications{Applications: []_e.Application{{Name: "web", Instances: []_e.InstanceInfo{
+		{App: "web", IpAddr: "1.1.1.1", Status: "UP", Port: &_e.Port{Port: 80}, DataCenterInfo: &_e.DataCenterInfo{}},
+		{App: "web", IpAddr: "1.1.1.2", Status: "UP", Port: &_e.Port{Port: 80}, DataCenterInfo: &_e.DataCenterInfo{}},
+	}}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/apps", r.URL.Path)
+		require.NoError(t, xml.NewEncoder(w).Encode(apps))
+	}))
+	defer srv.Close()
+
+	f := newFakeCloudMap()
+	f.handle("GetNamespace", func(input interface{}) (interface{}, error) {
+		return &sd.GetNamespaceOutput{Namespace: &sd.Namespace{Id: x.String("ns-1"), Name: x.String("example.local"), Type: sd.NamespaceTypeDnsPrivate}}, nil
+	})
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: x.String("srv-web")}}, nil
+	})
+	f.handle("RegisterInstance", func(input interface{}) (interface{}, error) {
+		if *input.(*sd.RegisterInstanceInput).InstanceId == "1.1.1.2" {
+			return nil, awserr.New(sd.ErrCodeInvalidInput, "invalid", nil)
+		}
+		return &sd.RegisterInstanceOutput{}, nil
+	})
+
+	r, err := SyncOnce(context.Background(), "ns-1", "", "", 60, true, f.client(), _e.NewClient([]string{srv.URL}),
+		WithMetrics(nopMetrics{}))
+	require.NoError(t, err)
+	require.Equal(t, 1, r.CreatedServices)
+	require.Equal(t, 1, r.CreatedInstances)
+	require.Equal(t, 1, r.UpdatedHealths)
+	require.Equal(t, 1, r.Failed)
+	require.Len(t, f.inputs("ListServices"), 1)
+	// the health of the instance that failed to register isn't updated
+	require.Len(t, f.inputs("UpdateInstanceCustomHealthStatus"), 1)
+
+	// the namespace must exist
+	f.handle("GetNamespace", func(input interface{}) (interface{}, error) {
+		return nil, awserr.New(sd.ErrCodeNamespaceNotFound, "not found", nil)
+	})
+	_, err = SyncOnce(context.Background(), "ns-1", "", "", 60, true, f.client(), _e.NewClient([]string{srv.URL}),
+		WithMetrics(nopMetrics{}))
+	require.Error(t, err)
+}
+
 func runSyncTest(t *testing.T, namespaceID string) {
 	config, err := external.LoadDefaultAWSConfig()
 	if err != nil {
@@ -0,0 +1,106 @@
+package catalog
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// tracerName names the tracer of the spans of Sync.
+const tracerName = "github.com/awsiv/eureka-aws/catalog"
+
+// endSpan records err, if any, and ends span.
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Unknown))
+	}
+	span.End()
+}
+
+// serviceSpans are the child spans per service of a cycle. Work for a service
+// may run concurrently, so the spans only end with the cycle.
+type serviceSpans struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	name   string
+
+	lock  sync.Mutex
+	spans map[string]trace.Span
+	ctxs  map[string]context.Context
+}
+
+func newServiceSpans(ctx context.Context, tracer trace.Tracer, name string) *serviceSpans {
+	return &serviceSpans{
+		ctx:    ctx,
+		tracer: tracer,
+		name:   name,
+		spans:  map[string]trace.Span{},
+		ctxs:   map[string]context.Context{},
+	}
+}
+
+// start returns the context of the span of service, starting it on first
+// use.
+func (s *serviceSpans) start(service string) context.Context {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ctx, ok := s.ctxs[service]; ok {
+		return ctx
+	}
+	ctx, span := s.tracer.Start(s.ctx, s.name, trace.WithAttributes(kv.String("service", service)))
+	s.ctxs[service] = ctx
+	s.spans[service] = span
+	return ctx
+}
+
+// end ends all spans, recording the errors of result on the span of their
+// service.
+func (s *serviceSpans) end(result syncResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, e := range result.errors {
+		if span, ok := s.spans[e.service]; ok {
+			span.RecordError(s.ctxs[e.service], e, trace.WithErrorStatus(codes.Unknown))
+		}
+	}
+	for _, span := range s.spans {
+		span.End()
+	}
+}
+
+// InMemoryExporter keeps the spans it receives, for example to test the
+// instrumentation. Pass it to sdktrace.WithSyncer.
+type InMemoryExporter struct {
+	lock  sync.Mutex
+	spans []*export.SpanData
+}
+
+// NewInMemoryExporter returns an empty InMemoryExporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpan implements export.SpanSyncer.
+func (e *InMemoryExporter) ExportSpan(_ context.Context, span *export.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far in the order they ended.
+func (e *InMemoryExporter) Spans() []*export.SpanData {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*export.SpanData(nil), e.spans...)
+}
+
+// Reset drops all spans.
+func (e *InMemoryExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = nil
+}
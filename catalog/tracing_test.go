@@ -0,0 +1,78 @@
+package catalog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+func newTestTracer(t *testing.T, e *InMemoryExporter) *sdktrace.Provider {
+	p, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(e),
+	)
+	require.NoError(t, err)
+	return p
+}
+
+// spansByName returns the exported spans keyed by name. Of spans with the
+// same name the last one wins.
+func spansByName(e *InMemoryExporter) map[string]*export.SpanData {
+	result := map[string]*export.SpanData{}
+	for _, s := range e.Spans() {
+		result[s.Name] = s
+	}
+	return result
+}
+
+func TestSyncToAWSSpans(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := newTestTracer(t, exporter).Tracer(tracerName)
+
+	f := newFakeCloudMap()
+	f.handle("CreateService", func(input interface{}) (interface{}, error) {
+		return &sd.CreateServiceOutput{Service: &sd.Service{Id: input.(*sd.CreateServiceInput).CreatorRequestId}}, nil
+	})
+	f.handle("RegisterInstance", func(input interface{}) (interface{}, error) {
+		return nil, awserr.New(sd.ErrCodeInvalidInput, "invalid", nil)
+	})
+	a := newTestAWS(f)
+	a.tracer = tracer
+	e := &eureka{
+		log:     hclog.NewNullLogger(),
+		metrics: nopMetrics{},
+		tracer:  tracer,
+		services: map[string]service{
+			"web": {name: "web", fromEureka: true, nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, instanceID: "web-1"}},
+			}},
+		},
+	}
+	e.syncToAWS(context.Background(), a, NewStatus(), "")
+
+	spans := spansByName(exporter)
+	cycle := spans["sync.to-aws"]
+	require.NotNil(t, cycle)
+	for _, name := range []string{"diff", "aws.create", "aws.reconcile", "aws.remove"} {
+		require.Contains(t, spans, name)
+		require.Equal(t, cycle.SpanContext.SpanID, spans[name].ParentSpanID, name)
+	}
+	service := spans["aws.create.service"]
+	require.Equal(t, spans["aws.create"].SpanContext.SpanID, service.ParentSpanID)
+	require.Equal(t, codes.Unknown, service.StatusCode)
+	require.Equal(t, service.SpanContext.SpanID, spans["cloudmap.CreateService"].ParentSpanID)
+	register := spans["cloudmap.RegisterInstance"]
+	require.Equal(t, service.SpanContext.SpanID, register.ParentSpanID)
+	require.Equal(t, codes.Unknown, register.StatusCode)
+	require.Equal(t, cycle.SpanContext.TraceID, register.SpanContext.TraceID)
+
+	exporter.Reset()
+	require.Empty(t, exporter.Spans())
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"os"
 
+	cmdAdmin "github.com/awsiv/eureka-aws/subcommand/admin"
+	cmdCatalogView "github.com/awsiv/eureka-aws/subcommand/catalog-view"
 	cmdSyncCatalog "github.com/awsiv/eureka-aws/subcommand/sync-catalog"
+	cmdSyncOnce "github.com/awsiv/eureka-aws/subcommand/sync-once"
 	cmdVersion "github.com/awsiv/eureka-aws/subcommand/version"
 	"github.com/awsiv/eureka-aws/version"
 	"github.com/mitchellh/cli"
@@ -19,6 +22,29 @@ func init() {
 		"sync-catalog": func() (cli.Command, error) {
 			return &cmdSyncCatalog.Command{UI: ui}, nil
 		},
+		"sync-once": func() (cli.Command, error) {
+			return &cmdSyncOnce.Command{UI: ui}, nil
+		},
+
+		"admin pause": func() (cli.Command, error) {
+			return &cmdAdmin.Command{UI: ui, Action: cmdAdmin.ActionPause}, nil
+		},
+		"admin resume": func() (cli.Command, error) {
+			return &cmdAdmin.Command{UI: ui, Action: cmdAdmin.ActionResume}, nil
+		},
+		"admin fetch": func() (cli.Command, error) {
+			return &cmdAdmin.Command{UI: ui, Action: cmdAdmin.ActionFetch}, nil
+		},
+		"admin reconcile": func() (cli.Command, error) {
+			return &cmdAdmin.Command{UI: ui, Action: cmdAdmin.ActionReconcile}, nil
+		},
+
+		"catalog list": func() (cli.Command, error) {
+			return &cmdCatalogView.Command{UI: ui, Action: cmdCatalogView.ActionList}, nil
+		},
+		"catalog inspect": func() (cli.Command, error) {
+			return &cmdCatalogView.Command{UI: ui, Action: cmdCatalogView.ActionInspect}, nil
+		},
 
 		"version": func() (cli.Command, error) {
 			return &cmdVersion.Command{UI: ui, Version: version.GetHumanVersion()}, nil
@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/command/flags"
+	"github.com/mitchellh/cli"
+)
+
+// Actions of the admin API.
+const (
+	ActionPause     = "pause"
+	ActionResume    = "resume"
+	ActionFetch     = "fetch"
+	ActionReconcile = "reconcile"
+)
+
+// Command calls Action on the admin API of a running sync-catalog.
+type Command struct {
+	UI     cli.Ui
+	Action string
+
+	flags         *flag.FlagSet
+	flagAddr      string
+	flagToken     string
+	flagDirection string
+	flagService   string
+
+	once sync.Once
+	help string
+}
+
+func (c *Command) init() {
+	c.flags = flag.NewFlagSet("", flag.ContinueOnError)
+	c.flags.StringVar(&c.flagAddr, "admin-addr",
+		"http://127.0.0.1:8080", "Address of the admin server of "+
+			"sync-catalog, overridden by ADMIN_ADDR. (Defaults to http://127.0.0.1:8080)")
+	c.flags.StringVar(&c.flagToken, "admin-token",
+		"", "Token of the admin server, overridden by ADMIN_TOKEN.")
+	switch c.Action {
+	case ActionPause, ActionResume:
+		c.flags.StringVar(&c.flagDirection, "direction",
+			"", "Direction to "+c.Action+", to-aws or to-eureka. (Defaults to both)")
+	case ActionReconcile:
+		c.flags.StringVar(&c.flagService, "service",
+			"", "Service to reconcile. (Defaults to all services)")
+	}
+	c.help = flags.Usage(fmt.Sprintf(help, c.Action, synopses[c.Action]), c.flags)
+}
+
+func (c *Command) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+
+	if addr, ok := os.LookupEnv("ADMIN_ADDR"); ok {
+		c.flagAddr = addr
+	}
+	if token, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		c.flagToken = token
+	}
+	if len(c.flagToken) == 0 {
+		c.UI.Error("-admin-token is not set")
+		return 1
+	}
+	addr := c.flagAddr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	query := url.Values{}
+	if len(c.flagDirection) > 0 {
+		query.Set("direction", c.flagDirection)
+	}
+	if len(c.flagService) > 0 {
+		query.Set("service", c.flagService)
+	}
+	u := strings.TrimSuffix(addr, "/") + "/admin/" + c.Action
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error creating request: %s", err))
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+c.flagToken)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error calling admin server: %s", err))
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		c.UI.Error(fmt.Sprintf("Error from admin server: %s: %s", resp.Status, strings.TrimSpace(string(body))))
+		return 1
+	}
+	c.UI.Output(strings.TrimSpace(string(body)))
+	return 0
+}
+
+func (c *Command) Synopsis() string { return synopses[c.Action] }
+func (c *Command) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+var synopses = map[string]string{
+	ActionPause:     "Pauses syncing of a running sync-catalog",
+	ActionResume:    "Resumes syncing of a running sync-catalog",
+	ActionFetch:     "Fetches AWS and Eureka right away",
+	ActionReconcile: "Syncs services to AWS right away",
+}
+
+const help = `
+Usage: eureka-aws admin %s [options]
+
+  %s. Requires sync-catalog to run with
+  -admin-addr and -admin-token set to the same values.
+
+`
@@ -0,0 +1,266 @@
+package catalogview
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/awsiv/eureka-aws/catalog"
+	"github.com/awsiv/eureka-aws/subcommand"
+	"github.com/hashicorp/consul/command/flags"
+	"github.com/hashicorp/go-hclog"
+	"github.com/mitchellh/cli"
+)
+
+// Actions of the catalog command.
+const (
+	ActionList    = "list"
+	ActionInspect = "inspect"
+)
+
+// Output formats.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// Command shows the services of Eureka and AWS CloudMap side by side.
+type Command struct {
+	UI     cli.Ui
+	Action string
+
+	flags                   *flag.FlagSet
+	flagAWSNamespaceID      string
+	flagAWSServicePrefix    string
+	flagEurekaServicePrefix string
+	flagEurekaDomain        string
+	flagFormat              string
+	flagTimeout             time.Duration
+	flagMaxDeletions        int
+	flagMaxDeletionFraction float64
+
+	once sync.Once
+	help string
+}
+
+func (c *Command) init() {
+	c.flags = flag.NewFlagSet("", flag.ContinueOnError)
+	c.flags.StringVar(&c.flagAWSNamespaceID, "aws-namespace-id",
+		"", "The AWS namespace synced with Eureka, overridden by CLOUDMAP_NAMESPACE.")
+	c.flags.StringVar(&c.flagEurekaDomain, "eureka-domain",
+		"", "The Eureka server synced with AWS, overridden by EUREKA_DOMAIN.")
+	c.flags.StringVar(&c.flagAWSServicePrefix, "aws-service-prefix",
+		"", "The prefix of services written to AWS from Eureka.")
+	c.flags.StringVar(&c.flagEurekaServicePrefix, "eureka-service-prefix",
+		"", "The prefix of services written to Eureka from AWS.")
+	c.flags.StringVar(&c.flagFormat, "format",
+		FormatTable, "Output format, table or json. (Defaults to table)")
+	c.flags.DurationVar(&c.flagTimeout, "timeout",
+		time.Minute, "Maximum duration of fetching both sides. (Defaults to 1m)")
+	c.flags.IntVar(&c.flagMaxDeletions, "max-deletions",
+		0, "The -max-deletions of sync-catalog, to show which removals it "+
+			"would hold back, overridden by MAX_DELETIONS. (Defaults to 0)")
+	c.flags.Float64Var(&c.flagMaxDeletionFraction, "max-deletion-fraction",
+		0, "The -max-deletion-fraction of sync-catalog, to show which removals "+
+			"it would hold back, overridden by MAX_DELETION_FRACTION. (Defaults to 0)")
+	c.help = flags.Usage(helps[c.Action], c.flags)
+}
+
+func (c *Command) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	name := ""
+	switch c.Action {
+	case ActionInspect:
+		if len(c.flags.Args()) != 1 {
+			c.UI.Error("Should have exactly one service as argument.")
+			return 1
+		}
+		name = c.flags.Arg(0)
+	default:
+		if len(c.flags.Args()) > 0 {
+			c.UI.Error("Should have no non-flag arguments.")
+			return 1
+		}
+	}
+	if c.flagFormat != FormatTable && c.flagFormat != FormatJSON {
+		c.UI.Error(fmt.Sprintf("Unknown format %q, must be table or json", c.flagFormat))
+		return 1
+	}
+
+	if id, ok := os.LookupEnv("CLOUDMAP_NAMESPACE"); ok {
+		c.flagAWSNamespaceID = id
+	}
+	if len(c.flagAWSNamespaceID) == 0 {
+		c.UI.Error("-aws-namespace-id or CLOUDMAP_NAMESPACE is not set")
+		return 1
+	}
+	if domain, ok := os.LookupEnv("EUREKA_DOMAIN"); ok {
+		c.flagEurekaDomain = domain
+	}
+	if len(c.flagEurekaDomain) == 0 {
+		c.UI.Error("-eureka-domain or EUREKA_DOMAIN is not set")
+		return 1
+	}
+
+	if maxDeletions, err := strconv.Atoi(os.Getenv("MAX_DELETIONS")); err == nil {
+		c.flagMaxDeletions = maxDeletions
+	}
+	if maxDeletionFraction, err := strconv.ParseFloat(os.Getenv("MAX_DELETION_FRACTION"), 64); err == nil {
+		c.flagMaxDeletionFraction = maxDeletionFraction
+	}
+
+	config, err := subcommand.AWSConfig()
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error retrieving AWS session: %s", err))
+		return 1
+	}
+	// CloudMap calls are retried by catalog
+	config.Retryer = aws.NoOpRetryer{}
+
+	// only warnings would get in the way of the output
+	hclog.Default().SetLevel(hclog.Warn)
+	ctx, cancel := context.WithTimeout(context.Background(), c.flagTimeout)
+	defer cancel()
+	services, err := catalog.Inspect(ctx, c.flagAWSNamespaceID,
+		c.flagEurekaServicePrefix, c.flagAWSServicePrefix, true,
+		sd.New(config), _e.NewClient([]string{c.flagEurekaDomain}),
+		catalog.WithMetrics(catalog.MultiMetrics()),
+		catalog.WithDeletionThreshold(c.flagMaxDeletions, c.flagMaxDeletionFraction))
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error fetching services: %s", err))
+		return 1
+	}
+
+	if c.Action == ActionList {
+		return c.output(services, func() string { return table(services) })
+	}
+	for _, s := range services {
+		if s.Name == name {
+			return c.output(s, func() string { return inspectTable(s) })
+		}
+	}
+	c.UI.Error(fmt.Sprintf("Service %q is neither in Eureka nor in AWS CloudMap", name))
+	return 1
+}
+
+// output prints v as JSON or as table renders it.
+func (c *Command) output(v interface{}, table func() string) int {
+	if c.flagFormat == FormatTable {
+		c.UI.Output(table())
+		return 0
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error encoding services: %s", err))
+		return 1
+	}
+	c.UI.Output(string(b))
+	return 0
+}
+
+func table(services []catalog.CatalogService) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tOWNED\tCLOUDMAP ID\tEUREKA\tCLOUDMAP\tDIFF")
+	for _, s := range services {
+		eureka, cloudMap := 0, 0
+		for _, i := range s.Instances {
+			if i.InEureka {
+				eureka++
+			}
+			if i.InCloudMap {
+				cloudMap++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", s.Name, yesNo(s.Owned), orDash(s.CloudMapID), eureka, cloudMap, s.Diff)
+	}
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func inspectTable(s catalog.CatalogService) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Service:\t%s\n", s.Name)
+	fmt.Fprintf(w, "In Eureka:\t%s\n", yesNo(s.InEureka))
+	fmt.Fprintf(w, "CloudMap ID:\t%s\n", orDash(s.CloudMapID))
+	fmt.Fprintf(w, "Owned:\t%s\n", yesNo(s.Owned))
+	fmt.Fprintf(w, "Diff:\t%s\n", s.Diff)
+	if len(s.Held) > 0 {
+		fmt.Fprintf(w, "Held:\t%s\n", s.Held)
+	}
+	w.Flush()
+	if len(s.Instances) > 0 {
+		b.WriteString("\n")
+		w = tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "INSTANCE\tHOST\tPORT\tEUREKA\tCLOUDMAP\tDIFF")
+		for _, i := range s.Instances {
+			eureka, cloudMap := "-", "-"
+			if i.InEureka {
+				eureka = orDash(i.EurekaHealth)
+			}
+			if i.InCloudMap {
+				cloudMap = orDash(i.CloudMapHealth)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", i.ID, i.Host, i.Port, eureka, cloudMap, orDash(i.Diff))
+		}
+		w.Flush()
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func (c *Command) Synopsis() string { return synopses[c.Action] }
+func (c *Command) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+var synopses = map[string]string{
+	ActionList:    "Lists the services of Eureka and AWS side by side",
+	ActionInspect: "Shows a service of Eureka and AWS side by side",
+}
+
+var helps = map[string]string{
+	ActionList: `
+Usage: eureka-aws catalog list [options]
+
+  Lists every service of Eureka and AWS CloudMap with the number of its
+  instances on both sides, its CloudMap service ID, whether it's owned by
+  eureka-aws and what the next sync to AWS would change.
+
+`,
+	ActionInspect: `
+Usage: eureka-aws catalog inspect [options] <service>
+
+  Shows the instances of a service in Eureka and AWS CloudMap side by side
+  with their health, and what the next sync to AWS would change.
+
+`,
+}
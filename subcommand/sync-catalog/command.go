@@ -3,21 +3,32 @@ package synccatalog
 import (
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
-	"runtime/debug"
-	_pprof "runtime/pprof"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	"github.com/awsiv/eureka-aws/catalog"
 	"github.com/awsiv/eureka-aws/subcommand"
 	"github.com/hashicorp/consul/command/flags"
+	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const DefaultPollInterval = "30s"
@@ -36,6 +47,44 @@ type Command struct {
 	flagAWSDNSTTL           int64
 	flagEurekaServicePrefix string
 	flagEurekaDomain        string
+	flagServicesConfig      string
+	flagAWSConcurrency      int
+	flagAWSMaxAttempts      int
+	flagAWSRetryBaseDelay   time.Duration
+	flagAWSThrottleDelay    time.Duration
+	flagAWSRetryMaxDelay    time.Duration
+	flagAWSReadRate         float64
+	flagAWSMutateRate       float64
+	flagAWSDiscoverRate     float64
+	flagAWSCallTimeout      time.Duration
+	flagGracePeriod         time.Duration
+	flagStatsdAddr          string
+	flagPrometheusAddr      string
+	flagEnvironment         string
+	flagSyncID              string
+	flagMetricTags          string
+	flagAdminAddr           string
+	flagAdminPprof          bool
+	flagAdminToken          string
+	flagReadyIntervals      int
+	flagOTLPEndpoint        string
+	flagOTLPInsecure        bool
+	flagAuditLog            string
+	flagWebhookURLs         string
+	flagWebhookEvents       string
+	flagWebhookBatchSize    int
+	flagWebhookInterval     time.Duration
+	flagWebhookMaxAttempts  int
+	flagLeaderElection      string
+	flagLeaderLockFile      string
+	flagLeaderLeaseService  string
+	flagLeaderLeaseTTL      time.Duration
+	flagLeaderRenew         time.Duration
+	flagStateFile           string
+	flagHealthObservations  int
+	flagHealthMinDwell      time.Duration
+	flagMaxDeletions        int
+	flagMaxDeletionFraction float64
 
 	once sync.Once
 	help string
@@ -62,6 +111,124 @@ func (c *Command) init() {
 			"Defaults to 30s)")
 	c.flags.Int64Var(&c.flagAWSDNSTTL, "aws-dns-ttl",
 		60, "DNS TTL for services created in AWS CloudMap in seconds. (Defaults to 60)")
+	c.flags.StringVar(&c.flagServicesConfig, "services-config",
+		"", "Path to a JSON file with per-service settings, such as how AWS "+
+			"instances are mapped to Eureka instances.")
+	c.flags.IntVar(&c.flagAWSConcurrency, "aws-concurrency",
+		10, "Maximum number of concurrent CloudMap mutations, such as "+
+			"instance registrations. (Defaults to 10)")
+	retries := catalog.DefaultRetryConfig()
+	c.flags.IntVar(&c.flagAWSMaxAttempts, "aws-max-attempts",
+		retries.MaxAttempts, "Maximum number of attempts for a CloudMap call "+
+			"failing with a throttling, server or connection error. (Defaults to 5)")
+	c.flags.DurationVar(&c.flagAWSRetryBaseDelay, "aws-retry-base-delay",
+		retries.BaseDelay, "Delay before the first retry of a failed CloudMap "+
+			"call, doubled for every further retry, overridden by "+
+			"AWS_RETRY_BASE_DELAY. (Defaults to 100ms)")
+	c.flags.DurationVar(&c.flagAWSThrottleDelay, "aws-throttle-delay",
+		retries.ThrottleDelay, "Delay before the first retry of a throttled "+
+			"CloudMap call, doubled for every further retry, overridden by "+
+			"AWS_THROTTLE_DELAY. (Defaults to 1s)")
+	c.flags.DurationVar(&c.flagAWSRetryMaxDelay, "aws-retry-max-delay",
+		retries.MaxDelay, "Maximum delay between retries of a CloudMap call, "+
+			"overridden by AWS_RETRY_MAX_DELAY. (Defaults to 20s)")
+	limits := catalog.DefaultRateLimits()
+	c.flags.Float64Var(&c.flagAWSReadRate, "aws-read-rate",
+		limits.Read, "Maximum CloudMap read calls, such as ListServices, per "+
+			"second. 0 disables the limit. (Defaults to 20)")
+	c.flags.Float64Var(&c.flagAWSMutateRate, "aws-mutate-rate",
+		limits.Mutate, "Maximum CloudMap calls that change services or "+
+			"instances per second. 0 disables the limit. (Defaults to 10)")
+	c.flags.Float64Var(&c.flagAWSDiscoverRate, "aws-discover-rate",
+		limits.Discover, "Maximum CloudMap DiscoverInstances calls per second. "+
+			"0 disables the limit. (Defaults to 500)")
+	c.flags.DurationVar(&c.flagAWSCallTimeout, "aws-call-timeout",
+		30*time.Second, "Maximum duration of a single CloudMap call. (Defaults to 30s)")
+	c.flags.DurationVar(&c.flagGracePeriod, "shutdown-grace-period",
+		10*time.Second, "How long to wait for in-flight CloudMap calls on "+
+			"shutdown before cancelling them. (Defaults to 10s)")
+	c.flags.StringVar(&c.flagStatsdAddr, "statsd-addr",
+		"127.0.0.1:8125", "Address of the statsd or DogStatsD agent metrics are "+
+			"sent to. Empty disables statsd. (Defaults to 127.0.0.1:8125)")
+	c.flags.StringVar(&c.flagPrometheusAddr, "prometheus-addr",
+		"", "Address to serve Prometheus metrics on /metrics, such as "+
+			"\":9102\". Empty disables Prometheus.")
+	c.flags.StringVar(&c.flagEnvironment, "environment",
+		"", "Environment added as environment tag to all metrics, such as \"prod\".")
+	c.flags.StringVar(&c.flagSyncID, "sync-id",
+		"", "Identifies this sync in the sync-id tag of all metrics. "+
+			"(Defaults to the hostname)")
+	c.flags.StringVar(&c.flagMetricTags, "metric-tags",
+		"", "Comma separated key:value tags added to all metrics, such as "+
+			"\"team:platform,cluster:blue\".")
+	c.flags.StringVar(&c.flagAdminAddr, "admin-addr",
+		"", "Address to serve /healthz, /readyz and /status on, such as "+
+			"\":8080\". Empty disables the admin server.")
+	c.flags.BoolVar(&c.flagAdminPprof, "admin-pprof",
+		false, "If true, the admin server also serves /debug/pprof/. (Defaults to false)")
+	c.flags.StringVar(&c.flagAdminToken, "admin-token",
+		"", "Bearer token required by the /admin/ endpoints of the admin "+
+			"server, which pause, resume and force the sync. Empty disables them.")
+	c.flags.StringVar(&c.flagOTLPEndpoint, "otlp-endpoint",
+		"", "Address of the OpenTelemetry collector traces are exported to "+
+			"with OTLP, such as \"localhost:55680\". Empty disables tracing.")
+	c.flags.BoolVar(&c.flagOTLPInsecure, "otlp-insecure",
+		false, "If true, traces are exported without TLS. (Defaults to false)")
+	c.flags.StringVar(&c.flagAuditLog, "audit-log",
+		"", "File every change of AWS CloudMap is appended to as a line of "+
+			"JSON, or \"-\" for stdout. Empty disables the audit log.")
+	webhooks := catalog.DefaultWebhookConfig()
+	c.flags.StringVar(&c.flagWebhookURLs, "webhook-urls",
+		"", "Comma separated webhook URLs, such as Slack incoming webhooks, "+
+			"events are posted to as JSON. Empty disables notifications.")
+	c.flags.StringVar(&c.flagWebhookEvents, "webhook-events",
+		"", "Comma separated event types to post: service.created, "+
+			"service.removed, worker.failing and deletion.mass. (Defaults to all)")
+	c.flags.IntVar(&c.flagWebhookBatchSize, "webhook-batch-size",
+		webhooks.BatchSize, "Maximum number of events per webhook post. (Defaults to 20)")
+	c.flags.DurationVar(&c.flagWebhookInterval, "webhook-batch-interval",
+		webhooks.BatchInterval, "Maximum time an event waits for more events "+
+			"to post with. (Defaults to 10s)")
+	c.flags.IntVar(&c.flagWebhookMaxAttempts, "webhook-max-attempts",
+		webhooks.MaxAttempts, "Maximum number of attempts for a webhook post "+
+			"failing with a server or connection error. (Defaults to 5)")
+	c.flags.StringVar(&c.flagLeaderElection, "leader-election",
+		"", "How replicas elect the one that changes CloudMap: \"file\" for "+
+			"replicas on the same host, \"cloudmap\" for a lease in the namespace. "+
+			"Empty disables leader election.")
+	c.flags.StringVar(&c.flagLeaderLockFile, "leader-lock-file",
+		filepath.Join(os.TempDir(), "eureka-aws.lock"), "File the leader locks "+
+			"with -leader-election=file.")
+	c.flags.DurationVar(&c.flagLeaderRenew, "leader-renew-interval",
+		10*time.Second, "How often standbys try to take the lock with "+
+			"-leader-election=file. (Defaults to 10s)")
+	c.flags.StringVar(&c.flagLeaderLeaseService, "leader-lease-service",
+		"eureka-aws-leader", "Name of the CloudMap services holding the lease with "+
+			"-leader-election=cloudmap, suffixed with the lease epoch. (Defaults to eureka-aws-leader)")
+	c.flags.DurationVar(&c.flagLeaderLeaseTTL, "leader-lease-ttl",
+		30*time.Second, "How long the lease is valid without renewal with "+
+			"-leader-election=cloudmap. It's renewed every third of it. (Defaults to 30s)")
+	c.flags.StringVar(&c.flagStateFile, "state-file",
+		"", "File the state of CloudMap is saved to after every sync and "+
+			"loaded from on start, so restarts don't change CloudMap again. "+
+			"Empty disables it.")
+	c.flags.IntVar(&c.flagHealthObservations, "health-observations",
+		1, "Number of fetches of Eureka in a row an instance must have a "+
+			"new health in before it's propagated to CloudMap. (Defaults to 1)")
+	c.flags.DurationVar(&c.flagHealthMinDwell, "health-min-dwell",
+		0, "How long an instance keeps a health in CloudMap at least before "+
+			"a change is propagated. (Defaults to 0)")
+	c.flags.IntVar(&c.flagMaxDeletions, "max-deletions",
+		0, "Maximum number of services imported from Eureka a sync may "+
+			"delete from CloudMap. Removals of a sync deleting more are held "+
+			"back. 0 disables the limit. (Defaults to 0)")
+	c.flags.Float64Var(&c.flagMaxDeletionFraction, "max-deletion-fraction",
+		0, "Maximum fraction of the services imported from Eureka a sync may "+
+			"delete from CloudMap, between 0 and 1. Removals of a sync deleting "+
+			"more are held back. 0 disables the limit. (Defaults to 0)")
+	c.flags.IntVar(&c.flagReadyIntervals, "ready-intervals",
+		3, "Number of poll intervals within which both AWS and Eureka must "+
+			"have been fetched for /readyz to succeed. (Defaults to 3)")
 
 	c.http = &flags.HTTPFlags{}
 	flags.Merge(c.flags, c.http.ClientFlags())
@@ -69,19 +236,11 @@ func (c *Command) init() {
 	c.help = flags.Usage(help, c.flags)
 }
 
-func countGoRoutines(w http.ResponseWriter, r *http.Request) {
-	b := []byte(strconv.Itoa(runtime.NumGoroutine()))
-	w.Write(b)
-}
-
-func getStackTraceHandler() {
-	stack := debug.Stack()
-	os.Stdout.Write(stack)
-	_pprof.Lookup("goroutine").WriteTo(os.Stdout, 2)
-}
-
 func (c *Command) Run(args []string) int {
 	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
 
 	if len(c.flags.Args()) > 0 {
 		c.UI.Error("Should have no non-flag arguments.")
@@ -106,10 +265,225 @@ func (c *Command) Run(args []string) int {
 	}
 
 	awsDnsTTL, err := strconv.ParseInt(os.Getenv("AWS_DNS_TTL"), 10, 64)
-	if err != nil && awsDnsTTL > 0 && awsDnsTTL < 60 {
+	if err == nil && awsDnsTTL > 0 && awsDnsTTL < 60 {
 		c.flagAWSDNSTTL = awsDnsTTL
 	}
 
+	servicesConfig := os.Getenv("SERVICES_CONFIG")
+	if len(servicesConfig) > 0 {
+		c.flagServicesConfig = servicesConfig
+	}
+
+	awsConcurrency, err := strconv.Atoi(os.Getenv("AWS_CONCURRENCY"))
+	if err == nil && awsConcurrency > 0 {
+		c.flagAWSConcurrency = awsConcurrency
+	}
+	if c.flagAWSConcurrency < 1 {
+		c.UI.Error("-aws-concurrency must be at least 1")
+		return 1
+	}
+
+	awsMaxAttempts, err := strconv.Atoi(os.Getenv("AWS_MAX_ATTEMPTS"))
+	if err == nil && awsMaxAttempts > 0 {
+		c.flagAWSMaxAttempts = awsMaxAttempts
+	}
+	if c.flagAWSMaxAttempts < 1 {
+		c.UI.Error("-aws-max-attempts must be at least 1")
+		return 1
+	}
+	for _, d := range []struct {
+		flag, env string
+		value     *time.Duration
+	}{
+		{"aws-retry-base-delay", "AWS_RETRY_BASE_DELAY", &c.flagAWSRetryBaseDelay},
+		{"aws-throttle-delay", "AWS_THROTTLE_DELAY", &c.flagAWSThrottleDelay},
+		{"aws-retry-max-delay", "AWS_RETRY_MAX_DELAY", &c.flagAWSRetryMaxDelay},
+	} {
+		if v, ok := os.LookupEnv(d.env); ok {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error parsing %s: %s", d.env, err))
+				return 1
+			}
+			*d.value = parsed
+		}
+		if *d.value <= 0 {
+			c.UI.Error(fmt.Sprintf("-%s must be positive", d.flag))
+			return 1
+		}
+	}
+
+	if addr, ok := os.LookupEnv("STATSD_ADDR"); ok {
+		c.flagStatsdAddr = addr
+	}
+	if addr, ok := os.LookupEnv("PROMETHEUS_ADDR"); ok {
+		c.flagPrometheusAddr = addr
+	}
+	if env, ok := os.LookupEnv("ENVIRONMENT"); ok {
+		c.flagEnvironment = env
+	}
+	if id, ok := os.LookupEnv("SYNC_ID"); ok {
+		c.flagSyncID = id
+	}
+	if tags, ok := os.LookupEnv("METRIC_TAGS"); ok {
+		c.flagMetricTags = tags
+	}
+	metricTags, err := c.metricTags()
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error parsing metric tags: %s", err))
+		return 1
+	}
+	metrics, err := c.metrics()
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error setting up metrics: %s", err))
+		return 1
+	}
+
+	if addr, ok := os.LookupEnv("ADMIN_ADDR"); ok {
+		c.flagAdminAddr = addr
+	}
+	if token, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		c.flagAdminToken = token
+	}
+	status := catalog.NewStatus()
+	control := catalog.NewControl()
+	if len(c.flagAdminAddr) > 0 {
+		if err := c.admin(status, control); err != nil {
+			c.UI.Error(fmt.Sprintf("Error starting admin server: %s", err))
+			return 1
+		}
+	}
+
+	if endpoint, ok := os.LookupEnv("OTLP_ENDPOINT"); ok {
+		c.flagOTLPEndpoint = endpoint
+	}
+	opts := []catalog.Option{}
+	if len(c.flagOTLPEndpoint) > 0 {
+		traces, stop, err := c.tracing()
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error setting up tracing: %s", err))
+			return 1
+		}
+		defer stop()
+		opts = append(opts, catalog.WithTraceProvider(traces))
+	}
+
+	if path, ok := os.LookupEnv("AUDIT_LOG"); ok {
+		c.flagAuditLog = path
+	}
+	if len(c.flagAuditLog) > 0 {
+		auditor, close, err := c.auditor()
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error opening audit log: %s", err))
+			return 1
+		}
+		defer close()
+		opts = append(opts, catalog.WithAuditor(auditor))
+	}
+
+	if path, ok := os.LookupEnv("STATE_FILE"); ok {
+		c.flagStateFile = path
+	}
+	if len(c.flagStateFile) > 0 {
+		opts = append(opts, catalog.WithStateFile(c.flagStateFile))
+	}
+
+	healthObservations, err := strconv.Atoi(os.Getenv("HEALTH_OBSERVATIONS"))
+	if err == nil && healthObservations > 0 {
+		c.flagHealthObservations = healthObservations
+	}
+	if c.flagHealthObservations < 1 {
+		c.UI.Error("-health-observations must be at least 1")
+		return 1
+	}
+	if dwell, ok := os.LookupEnv("HEALTH_MIN_DWELL"); ok {
+		d, err := time.ParseDuration(dwell)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error parsing HEALTH_MIN_DWELL: %s", err))
+			return 1
+		}
+		c.flagHealthMinDwell = d
+	}
+	opts = append(opts, catalog.WithHealthHysteresis(c.flagHealthObservations, c.flagHealthMinDwell))
+
+	maxDeletions, err := strconv.Atoi(os.Getenv("MAX_DELETIONS"))
+	if err == nil {
+		c.flagMaxDeletions = maxDeletions
+	}
+	if c.flagMaxDeletions < 0 {
+		c.UI.Error("-max-deletions must not be negative")
+		return 1
+	}
+	maxDeletionFraction, err := strconv.ParseFloat(os.Getenv("MAX_DELETION_FRACTION"), 64)
+	if err == nil {
+		c.flagMaxDeletionFraction = maxDeletionFraction
+	}
+	if c.flagMaxDeletionFraction < 0 || c.flagMaxDeletionFraction > 1 {
+		c.UI.Error("-max-deletion-fraction must be between 0 and 1")
+		return 1
+	}
+	opts = append(opts, catalog.WithDeletionThreshold(c.flagMaxDeletions, c.flagMaxDeletionFraction))
+
+	if election, ok := os.LookupEnv("LEADER_ELECTION"); ok {
+		c.flagLeaderElection = election
+	}
+	switch c.flagLeaderElection {
+	case "":
+	case "file":
+		opts = append(opts, catalog.WithLeaderLock(catalog.NewFileLock(c.flagLeaderLockFile), c.flagLeaderRenew))
+	case "cloudmap":
+		opts = append(opts, catalog.WithCloudMapLease(c.flagLeaderLeaseService, c.syncID(), c.flagLeaderLeaseTTL))
+	default:
+		c.UI.Error(fmt.Sprintf("Unknown leader election %q, must be file or cloudmap", c.flagLeaderElection))
+		return 1
+	}
+
+	if urls, ok := os.LookupEnv("WEBHOOK_URLS"); ok {
+		c.flagWebhookURLs = urls
+	}
+	if events, ok := os.LookupEnv("WEBHOOK_EVENTS"); ok {
+		c.flagWebhookEvents = events
+	}
+	if urls := splitList(c.flagWebhookURLs); len(urls) > 0 {
+		webhooks := catalog.DefaultWebhookConfig()
+		webhooks.URLs = urls
+		webhooks.Events = splitList(c.flagWebhookEvents)
+		webhooks.BatchSize = c.flagWebhookBatchSize
+		webhooks.BatchInterval = c.flagWebhookInterval
+		webhooks.MaxAttempts = c.flagWebhookMaxAttempts
+		notifier := catalog.NewWebhookNotifier(webhooks, c.syncID(), hclog.Default().Named("webhook"))
+		defer notifier.Close()
+		opts = append(opts, catalog.WithNotifier(notifier))
+	}
+
+	opts = append(opts,
+		catalog.WithStatus(status),
+		catalog.WithControl(control),
+		catalog.WithMetrics(metrics),
+		catalog.WithConcurrency(c.flagAWSConcurrency),
+		catalog.WithRetryConfig(catalog.RetryConfig{
+			MaxAttempts:   c.flagAWSMaxAttempts,
+			BaseDelay:     c.flagAWSRetryBaseDelay,
+			ThrottleDelay: c.flagAWSThrottleDelay,
+			MaxDelay:      c.flagAWSRetryMaxDelay,
+		}),
+		catalog.WithRateLimits(catalog.RateLimits{
+			Read:     c.flagAWSReadRate,
+			Mutate:   c.flagAWSMutateRate,
+			Discover: c.flagAWSDiscoverRate,
+		}),
+		catalog.WithCallTimeout(c.flagAWSCallTimeout),
+		catalog.WithGracePeriod(c.flagGracePeriod),
+	)
+	if len(c.flagServicesConfig) > 0 {
+		services, err := catalog.LoadServicesConfig(c.flagServicesConfig)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error loading services config: %s", err))
+			return 1
+		}
+		opts = append(opts, catalog.WithServicesConfig(services))
+	}
+
 	//Note:
 	//		use credentials_source = EC2InstanceMetadata
 	//		https://github.com/aws/aws-sdk-go/issues/1993
@@ -120,7 +494,13 @@ func (c *Command) Run(args []string) int {
 	} else {
 		c.UI.Info(fmt.Sprintf("Retrieved AWS session: %v", config.Region))
 	}
+	// CloudMap calls are retried by catalog
+	config.Retryer = aws.NoOpRetryer{}
 	awsClient := sd.New(config)
+	metricTags = append(metricTags,
+		"region:"+config.Region,
+		"namespace:"+c.flagAWSNamespaceID)
+	opts = append(opts, catalog.WithMetricTags(metricTags...))
 
 	//return 1
 	eurekaClient := _e.NewClient([]string{
@@ -144,6 +524,7 @@ func (c *Command) Run(args []string) int {
 		c.flagAWSPollInterval, c.flagAWSDNSTTL, c.getStaleWithDefaultTrue(),
 		awsClient, eurekaClient,
 		stop, stopped,
+		opts...,
 	)
 
 	sigCh := make(chan os.Signal, 1)
@@ -162,6 +543,151 @@ func (c *Command) Run(args []string) int {
 	return 0
 }
 
+// metrics sets up the configured metrics sinks and serves /metrics if
+// Prometheus is enabled.
+func (c *Command) metrics() (catalog.Metrics, error) {
+	log := hclog.Default().Named("metrics")
+	var sinks []catalog.Metrics
+	if len(c.flagStatsdAddr) > 0 {
+		m, err := catalog.NewStatsdMetrics(c.flagStatsdAddr, log)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, m)
+	}
+	if len(c.flagPrometheusAddr) > 0 {
+		sinks = append(sinks, catalog.NewPrometheusMetrics(prometheus.DefaultRegisterer, log))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		ln, err := net.Listen("tcp", c.flagPrometheusAddr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				log.Error("cannot serve metrics", "error", err)
+			}
+		}()
+		c.UI.Info(fmt.Sprintf("Serving Prometheus metrics on %s/metrics", ln.Addr()))
+	}
+	return catalog.MultiMetrics(sinks...), nil
+}
+
+// admin serves the health and status of the sync.
+func (c *Command) admin(status *catalog.Status, control *catalog.Control) error {
+	interval, err := time.ParseDuration(c.flagAWSPollInterval)
+	if err != nil {
+		return err
+	}
+	if c.flagReadyIntervals < 1 {
+		return fmt.Errorf("-ready-intervals must be at least 1")
+	}
+	handler := catalog.NewAdminHandler(status, catalog.AdminConfig{
+		ReadyMaxAge: time.Duration(c.flagReadyIntervals) * interval,
+		Pprof:       c.flagAdminPprof,
+		Control:     control,
+		Token:       c.flagAdminToken,
+	})
+	ln, err := net.Listen("tcp", c.flagAdminAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, handler); err != nil {
+			hclog.Default().Named("admin").Error("cannot serve admin", "error", err)
+		}
+	}()
+	c.UI.Info(fmt.Sprintf("Serving admin on %s", ln.Addr()))
+	return nil
+}
+
+// tracing exports traces to the OTLP collector. The returned function
+// flushes pending spans and closes the connection.
+func (c *Command) tracing() (trace.Provider, func(), error) {
+	opts := []otlp.ExporterOption{otlp.WithAddress(c.flagOTLPEndpoint)}
+	if c.flagOTLPInsecure {
+		opts = append(opts, otlp.WithInsecure())
+	}
+	exporter, err := otlp.NewExporter(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	processor, err := sdktrace.NewBatchSpanProcessor(exporter)
+	if err != nil {
+		exporter.Stop()
+		return nil, nil, err
+	}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(kv.String(string(standard.ServiceNameKey), "eureka-aws"))),
+	)
+	if err != nil {
+		exporter.Stop()
+		return nil, nil, err
+	}
+	provider.RegisterSpanProcessor(processor)
+	c.UI.Info(fmt.Sprintf("Exporting traces to %s", c.flagOTLPEndpoint))
+	return provider, func() {
+		provider.UnregisterSpanProcessor(processor)
+		exporter.Stop()
+	}, nil
+}
+
+// syncID identifies this sync in metrics and the audit log.
+func (c *Command) syncID() string {
+	if len(c.flagSyncID) > 0 {
+		return c.flagSyncID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// auditor opens the audit log. The returned function closes it.
+func (c *Command) auditor() (catalog.Auditor, func(), error) {
+	log := hclog.Default().Named("audit")
+	if c.flagAuditLog == "-" {
+		return catalog.NewJSONAuditor(os.Stdout, c.syncID(), log), func() {}, nil
+	}
+	f, err := os.OpenFile(c.flagAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return catalog.NewJSONAuditor(f, c.syncID(), log), func() { f.Close() }, nil
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); len(e) > 0 {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// metricTags returns the tags added to all metrics.
+func (c *Command) metricTags() ([]string, error) {
+	var tags []string
+	if len(c.flagEnvironment) > 0 {
+		tags = append(tags, "environment:"+c.flagEnvironment)
+	}
+	if syncID := c.syncID(); len(syncID) > 0 {
+		tags = append(tags, "sync-id:"+syncID)
+	}
+	for _, t := range strings.Split(c.flagMetricTags, ",") {
+		t = strings.TrimSpace(t)
+		if len(t) == 0 {
+			continue
+		}
+		if kv := strings.SplitN(t, ":", 2); len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("tag %q is not key:value", t)
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
 func (c *Command) getStaleWithDefaultTrue() bool {
 	stale := true
 	c.flags.Visit(func(f *flag.Flag) {
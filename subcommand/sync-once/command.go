@@ -0,0 +1,197 @@
+package synconce
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	_e "github.com/ArthurHlt/go-eureka-client/eureka"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/awsiv/eureka-aws/catalog"
+	"github.com/awsiv/eureka-aws/subcommand"
+	"github.com/hashicorp/consul/command/flags"
+	"github.com/mitchellh/cli"
+)
+
+// Command syncs Eureka to AWS CloudMap once.
+type Command struct {
+	UI cli.Ui
+
+	flags                   *flag.FlagSet
+	flagTimeout             time.Duration
+	flagAWSNamespaceID      string
+	flagAWSServicePrefix    string
+	flagAWSDNSTTL           int64
+	flagEurekaServicePrefix string
+	flagEurekaDomain        string
+	flagServicesConfig      string
+	flagAWSConcurrency      int
+	flagAWSMaxAttempts      int
+	flagAWSCallTimeout      time.Duration
+	flagStateFile           string
+
+	once sync.Once
+	help string
+}
+
+func (c *Command) init() {
+	c.flags = flag.NewFlagSet("", flag.ContinueOnError)
+	c.flags.DurationVar(&c.flagTimeout, "timeout",
+		5*time.Minute, "Maximum duration of the whole sync. Operations still "+
+			"running then are cancelled and count as failed. (Defaults to 5m)")
+	c.flags.StringVar(&c.flagAWSNamespaceID, "aws-namespace-id",
+		"", "The AWS namespace to sync Eureka services to, overridden by "+
+			"CLOUDMAP_NAMESPACE.")
+	c.flags.StringVar(&c.flagEurekaDomain, "eureka-domain",
+		"", "The Eureka server to sync services from, overridden by EUREKA_DOMAIN.")
+	c.flags.StringVar(&c.flagAWSServicePrefix, "aws-service-prefix",
+		"", "A prefix to prepend to all services written to AWS from Eureka. "+
+			"If this is not set then services will have no prefix.")
+	c.flags.StringVar(&c.flagEurekaServicePrefix, "eureka-service-prefix",
+		"", "A prefix to prepend to all services written to Eureka from AWS. "+
+			"If this is not set then services will have no prefix.")
+	c.flags.Int64Var(&c.flagAWSDNSTTL, "aws-dns-ttl",
+		60, "DNS TTL for services created in AWS CloudMap in seconds. (Defaults to 60)")
+	c.flags.StringVar(&c.flagServicesConfig, "services-config",
+		"", "Path to a JSON file with per-service settings, overridden by "+
+			"SERVICES_CONFIG.")
+	c.flags.IntVar(&c.flagAWSConcurrency, "aws-concurrency",
+		10, "Maximum number of concurrent CloudMap mutations, such as "+
+			"instance registrations. (Defaults to 10)")
+	c.flags.IntVar(&c.flagAWSMaxAttempts, "aws-max-attempts",
+		catalog.DefaultRetryConfig().MaxAttempts, "Maximum number of attempts "+
+			"for a CloudMap call failing with a throttling, server or connection "+
+			"error. (Defaults to 5)")
+	c.flags.DurationVar(&c.flagAWSCallTimeout, "aws-call-timeout",
+		30*time.Second, "Maximum duration of a single CloudMap call. (Defaults to 30s)")
+	c.flags.StringVar(&c.flagStateFile, "state-file",
+		"", "File the state of CloudMap is saved to after the sync, to start "+
+			"sync-catalog from. Empty disables it.")
+	c.help = flags.Usage(help, c.flags)
+}
+
+func (c *Command) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+
+	if id, ok := os.LookupEnv("CLOUDMAP_NAMESPACE"); ok {
+		c.flagAWSNamespaceID = id
+	}
+	if len(c.flagAWSNamespaceID) == 0 {
+		c.UI.Error("-aws-namespace-id or CLOUDMAP_NAMESPACE is not set")
+		return 1
+	}
+	if domain, ok := os.LookupEnv("EUREKA_DOMAIN"); ok {
+		c.flagEurekaDomain = domain
+	}
+	if len(c.flagEurekaDomain) == 0 {
+		c.UI.Error("-eureka-domain or EUREKA_DOMAIN is not set")
+		return 1
+	}
+	if config, ok := os.LookupEnv("SERVICES_CONFIG"); ok {
+		c.flagServicesConfig = config
+	}
+	if c.flagAWSConcurrency < 1 {
+		c.UI.Error("-aws-concurrency must be at least 1")
+		return 1
+	}
+	if c.flagAWSMaxAttempts < 1 {
+		c.UI.Error("-aws-max-attempts must be at least 1")
+		return 1
+	}
+
+	retries := catalog.DefaultRetryConfig()
+	retries.MaxAttempts = c.flagAWSMaxAttempts
+	opts := []catalog.Option{
+		catalog.WithMetrics(catalog.MultiMetrics()),
+		catalog.WithConcurrency(c.flagAWSConcurrency),
+		catalog.WithRetryConfig(retries),
+		catalog.WithCallTimeout(c.flagAWSCallTimeout),
+	}
+	if len(c.flagServicesConfig) > 0 {
+		services, err := catalog.LoadServicesConfig(c.flagServicesConfig)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error loading services config: %s", err))
+			return 1
+		}
+		opts = append(opts, catalog.WithServicesConfig(services))
+	}
+	if len(c.flagStateFile) > 0 {
+		opts = append(opts, catalog.WithStateFile(c.flagStateFile))
+	}
+
+	config, err := subcommand.AWSConfig()
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error retrieving AWS session: %s", err))
+		return 1
+	}
+	// CloudMap calls are retried by catalog
+	config.Retryer = aws.NoOpRetryer{}
+	awsClient := sd.New(config)
+	eurekaClient := _e.NewClient([]string{c.flagEurekaDomain})
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.flagTimeout)
+	defer cancel()
+	start := time.Now()
+	r, err := catalog.SyncOnce(ctx, c.flagAWSNamespaceID,
+		c.flagEurekaServicePrefix, c.flagAWSServicePrefix, c.flagAWSDNSTTL, true,
+		awsClient, eurekaClient, opts...)
+	if err != nil && r.LastRun.IsZero() {
+		c.UI.Error(fmt.Sprintf("Error syncing: %s", err))
+		return 1
+	}
+	c.summary(r, time.Since(start))
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error syncing: %s", err))
+		return 1
+	}
+	if r.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// summary prints what the sync did.
+func (c *Command) summary(r catalog.ReconcileStatus, d time.Duration) {
+	c.UI.Output(fmt.Sprintf("Synced Eureka to AWS CloudMap in %s", d.Round(time.Millisecond)))
+	c.UI.Output(fmt.Sprintf("  created: %d services, %d instances", r.CreatedServices, r.CreatedInstances))
+	c.UI.Output(fmt.Sprintf("  updated: %d services, %d healths", r.UpdatedServices, r.UpdatedHealths))
+	c.UI.Output(fmt.Sprintf("  removed: %d services, %d instances", r.RemovedServices, r.RemovedInstances))
+	if r.Failed == 0 {
+		return
+	}
+	c.UI.Error(fmt.Sprintf("  failed: %d operations", r.Failed))
+	for _, e := range r.Errors {
+		c.UI.Error("    " + e)
+	}
+	if more := r.Failed - len(r.Errors); more > 0 {
+		c.UI.Error(fmt.Sprintf("    and %d more", more))
+	}
+}
+
+func (c *Command) Synopsis() string { return synopsis }
+func (c *Command) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const synopsis = "Sync Eureka services to AWS once."
+const help = `
+Usage: eureka-aws sync-once [options]
+
+  Fetches the services of Eureka and AWS CloudMap, syncs them to AWS
+  CloudMap once like a cycle of sync-catalog and prints a summary. Exits
+  with 1 if any operation failed, for example to bootstrap a namespace
+  or in deployment pipelines.
+
+`